@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// cpanelAccount is one of several CPanel accounts (possibly on different hosts) used by a single Issuer, serving
+// challenges for the zones it lists.
+type cpanelAccount struct {
+	// As cpanelUrl and secretRef of the config
+	CpanelUrl cpanelUrls      `json:"cpanelUrl"`
+	SecretRef secretReference `json:"secretRef"`
+
+	// Further CPanel servers serving the account's zones, as mirrors of the config
+	Mirrors []cpanelMirror `json:"mirrors,omitempty"`
+
+	// The zones served by the account, e.g. example.com. These match the names within them as well, with the longest
+	// match across all accounts winning, so a subdomain delegated to another account can be listed there.
+	Zones []string `json:"zones"`
+}
+
+// forName returns the config with the CPanel URL and credentials of the account serving the name, or the config
+// as it is if it doesn't list accounts.
+func (cfg customDNSProviderConfig) forName(name string) (customDNSProviderConfig, error) {
+	if len(cfg.Accounts) == 0 {
+		return cfg, nil
+	}
+
+	name = canonicalZone(name)
+	var account *cpanelAccount
+	longest := -1
+	for i := range cfg.Accounts {
+		for _, zone := range cfg.Accounts[i].Zones {
+			zone = canonicalZone(zone)
+			if (name == zone || strings.HasSuffix(name, "."+zone)) && len(zone) > longest {
+				account = &cfg.Accounts[i]
+				longest = len(zone)
+			}
+		}
+	}
+	if account == nil {
+		return cfg, fmt.Errorf("none of the accounts in the config serve %s", name)
+	}
+
+	cfg.CpanelUrl = account.CpanelUrl
+	cfg.SecretRef = account.SecretRef
+	cfg.Mirrors = account.Mirrors
+	cfg.Accounts = nil
+	return cfg, nil
+}
+
+func canonicalZone(zone string) string {
+	return strings.TrimSuffix(cpanel.CanonicalName(zone), ".")
+}
+
+func validateAccounts(path *field.Path, cfg *customDNSProviderConfig) field.ErrorList {
+	var errs field.ErrorList
+	if len(cfg.Accounts) == 0 {
+		return errs
+	}
+
+	if len(cfg.CpanelUrl) > 0 {
+		errs = append(errs, field.Forbidden(configPath.Child("cpanelUrl"), "must not be set with accounts"))
+	}
+	if cfg.SecretRef != (secretReference{}) {
+		errs = append(errs, field.Forbidden(configPath.Child("secretRef"), "must not be set with accounts"))
+	}
+	if len(cfg.Mirrors) > 0 {
+		errs = append(errs, field.Forbidden(configPath.Child("mirrors"), "must be set on each account rather than with accounts"))
+	}
+
+	seen := map[string]bool{}
+	for i := range cfg.Accounts {
+		account := &cfg.Accounts[i]
+		accountPath := path.Index(i)
+		errs = append(errs, validateCredentialsUrl(accountPath, account.CpanelUrl, account.SecretRef)...)
+		errs = append(errs, validateCpanelUrls(accountPath.Child("cpanelUrl"), account.CpanelUrl)...)
+		errs = append(errs, validateSecretRef(accountPath.Child("secretRef"), account.SecretRef)...)
+		errs = append(errs, validateMirrors(accountPath.Child("mirrors"), account.Mirrors)...)
+
+		if len(account.Zones) == 0 {
+			errs = append(errs, field.Required(accountPath.Child("zones"), ""))
+		}
+		for j, zone := range account.Zones {
+			zonePath := accountPath.Child("zones").Index(j)
+			canonical := canonicalZone(zone)
+			for _, msg := range validation.IsDNS1123Subdomain(canonical) {
+				errs = append(errs, field.Invalid(zonePath, zone, msg))
+			}
+			if seen[canonical] {
+				errs = append(errs, field.Duplicate(zonePath, zone))
+			}
+			seen[canonical] = true
+		}
+	}
+	return errs
+}
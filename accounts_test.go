@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+const accountsConfig = `{"accounts": [
+	{"cpanelUrl": "https://cpanel.test-domain.com/", "secretRef": {"name": "main-account"}, "zones": ["test-domain.com", "other-domain.com."]},
+	{"cpanelUrl": "https://cpanel.other-host.com", "secretRef": {"name": "delegated-account"}, "zones": ["Shop.Test-Domain.com"]}
+]}`
+
+func TestAccountRouting(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(accountsConfig)})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		cpanelUrl string
+		secret    string
+	}{
+		{name: "_acme-challenge.test-domain.com.", cpanelUrl: "https://cpanel.test-domain.com", secret: "main-account"},
+		{name: "_acme-challenge.www.other-domain.com.", cpanelUrl: "https://cpanel.test-domain.com", secret: "main-account"},
+		{name: "_acme-challenge.shop.test-domain.com.", cpanelUrl: "https://cpanel.other-host.com", secret: "delegated-account"},
+		{name: "_acme-challenge.eu.SHOP.test-domain.com.", cpanelUrl: "https://cpanel.other-host.com", secret: "delegated-account"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			accountCfg, err := cfg.forName(test.name)
+			assert.NoError(t, err)
+			assert.Equal(t, cpanelUrls{test.cpanelUrl}, accountCfg.CpanelUrl)
+			assert.Equal(t, test.secret, accountCfg.SecretRef.Name)
+		})
+	}
+
+	// A suffix of the name that isn't a whole label doesn't match
+	_, err = cfg.forName("_acme-challenge.not-test-domain.com.")
+	assert.EqualError(t, err, "none of the accounts in the config serve _acme-challenge.not-test-domain.com")
+}
+
+func TestAccountValidation(t *testing.T) {
+	_, err := loadConfig(&extapi.JSON{Raw: []byte(`{"cpanelUrl": "https://cpanel.test-domain.com", "accounts": [
+		{"secretRef": {"name": "main-account"}, "zones": ["test-domain.com"]},
+		{"zones": ["TEST-domain.com", "not a zone"]}
+	]}`)})
+	assert.EqualError(t, err, `invalid solver config: [`+
+		`config.cpanelUrl: Forbidden: must not be set with accounts, `+
+		`config.accounts[0].cpanelUrl: Required value, `+
+		`config.accounts[1].zones[0]: Duplicate value: "TEST-domain.com", `+
+		`config.accounts[1].zones[1]: Invalid value: "not a zone": a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')]`)
+}
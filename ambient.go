@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// Ambient credentials are read from files in this directory (e.g. a mounted Secret) or otherwise the environment
+// variables alongside each file name.
+const ambientCredentialsDirEnv = "CPANEL_CREDENTIALS_DIR"
+
+var ambientCredentialFiles = []struct {
+	file string
+	env  string
+}{
+	{file: "cpanelUrl", env: "CPANEL_URL"},
+	{file: "username", env: "CPANEL_USERNAME"},
+	{file: "password", env: "CPANEL_PASSWORD"},
+	{file: "apiToken", env: "CPANEL_API_TOKEN"},
+}
+
+// ambientCredentials provides a CPanel client from the webhook's own environment for Issuers that allow ambient
+// credentials and don't reference a secret, so single-tenant installs needn't be able to read secrets at all.
+// Files are checked for changes on each use so that a rotated mounted Secret is picked up without a restart.
+type ambientCredentials struct {
+	dir string
+
+	mutex       sync.Mutex
+	fingerprint string
+	client      *cpanel.CpanelClient
+}
+
+func newAmbientCredentials(dir string) *ambientCredentials {
+	return &ambientCredentials{dir: dir}
+}
+
+// Client returns a client built from the ambient credentials. Its URL only ever comes from them, as otherwise an
+// Issuer allowed to use them could have them sent to a host of its choosing.
+func (a *ambientCredentials) Client() (*cpanel.CpanelClient, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	fingerprint := a.getFingerprint()
+	if a.client == nil || fingerprint != a.fingerprint {
+		if a.client != nil {
+			log.Info("Ambient credentials have changed, reloading them")
+			a.client.CloseIdleConnections()
+			a.client = nil
+		}
+
+		client, err := a.load()
+		if err != nil {
+			return nil, err
+		}
+		a.client = client
+		a.fingerprint = fingerprint
+	}
+
+	client := a.client.ForZone("")
+	if client.CpanelUrl == "" {
+		return nil, errors.New("cpanelUrl wasn't provided in the ambient credentials")
+	}
+	return client, nil
+}
+
+func (a *ambientCredentials) load() (*cpanel.CpanelClient, error) {
+	values := map[string]string{}
+	for _, credential := range ambientCredentialFiles {
+		value, err := a.read(credential.file, credential.env)
+		if err != nil {
+			return nil, err
+		}
+		values[credential.file] = value
+	}
+
+	if values["username"] == "" {
+		return nil, errors.New("username not present in ambient credentials")
+	}
+	if values["password"] == "" && values["apiToken"] == "" {
+		return nil, errors.New("password or API token not present in ambient credentials")
+	}
+
+	// Held to the same rules as a cpanelUrl in the config, with several separated by commas to fail over between
+	var urls cpanelUrls
+	for _, cpanelUrl := range strings.Split(values["cpanelUrl"], ",") {
+		if cpanelUrl = strings.TrimSpace(cpanelUrl); cpanelUrl != "" {
+			urls = append(urls, cpanelUrl)
+		}
+	}
+	if errs := validateCpanelUrls(field.NewPath("cpanelUrl"), urls); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid ambient credentials: %s", errs.ToAggregate())
+	}
+
+	log.Info("Got credentials from ambient credentials")
+	client := cpanel.NewCpanelClient(urls.primary(), values["username"], values["password"], values["apiToken"])
+	client.Failover = newFailover(urls)
+	return client, nil
+}
+
+// A file in the credentials directory takes precedence over its environment variable.
+func (a *ambientCredentials) read(file string, env string) (string, error) {
+	if a.dir != "" {
+		contents, err := os.ReadFile(filepath.Join(a.dir, file))
+		if err == nil {
+			return strings.TrimSpace(string(contents)), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("could not read ambient credential %s: %w", file, err)
+		}
+	}
+	return os.Getenv(env), nil
+}
+
+// The modification times and sizes of the credential files, which change whenever the files are replaced.
+func (a *ambientCredentials) getFingerprint() string {
+	if a.dir == "" {
+		return ""
+	}
+
+	var fingerprint strings.Builder
+	for _, credential := range ambientCredentialFiles {
+		info, err := os.Stat(filepath.Join(a.dir, credential.file))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&fingerprint, "%s:%d:%d;", credential.file, info.ModTime().UnixNano(), info.Size())
+	}
+	return fingerprint.String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeAmbientCredential(t *testing.T, dir string, file string, value string, modTime time.Time) {
+	path := filepath.Join(dir, file)
+	assert.NoError(t, os.WriteFile(path, []byte(value+"\n"), 0600))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestAmbientCredentialsFromFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeAmbientCredential(t, dir, "cpanelUrl", "https://cpanel.test-domain.com", now)
+	writeAmbientCredential(t, dir, "username", "user", now)
+	writeAmbientCredential(t, dir, "apiToken", "ABCDEF1234567890", now)
+	ambient := newAmbientCredentials(dir)
+
+	client, err := ambient.Client()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://cpanel.test-domain.com", client.CpanelUrl)
+	assert.Equal(t, "user", client.Username)
+	assert.Equal(t, "ABCDEF1234567890", client.ApiToken)
+
+	// Rotating the token on disk is picked up
+	writeAmbientCredential(t, dir, "apiToken", "0987654321FEDCBA", now.Add(time.Minute))
+	client, err = ambient.Client()
+	assert.NoError(t, err)
+	assert.Equal(t, "0987654321FEDCBA", client.ApiToken)
+
+	// Several URLs are failed over between
+	writeAmbientCredential(t, dir, "cpanelUrl", "https://cpanel.test-domain.com/, https://server123.host.test:2083", now.Add(2*time.Minute))
+	client, err = ambient.Client()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://cpanel.test-domain.com", client.CpanelUrl)
+	if assert.NotNil(t, client.Failover) {
+		assert.Equal(t, "https://cpanel.test-domain.com", client.Failover.Current())
+	}
+}
+
+func TestAmbientCredentialsFromEnv(t *testing.T) {
+	t.Setenv("CPANEL_URL", "https://cpanel.test-domain.com")
+	t.Setenv("CPANEL_USERNAME", "user")
+	t.Setenv("CPANEL_PASSWORD", "")
+	t.Setenv("CPANEL_API_TOKEN", "")
+
+	_, err := newAmbientCredentials("").Client()
+	assert.EqualError(t, err, "password or API token not present in ambient credentials")
+
+	t.Setenv("CPANEL_PASSWORD", "password")
+	client, err := newAmbientCredentials("").Client()
+	assert.NoError(t, err)
+	assert.Equal(t, "password", client.Password)
+
+	// The URL must be https, as in the config
+	t.Setenv("CPANEL_URL", "http://cpanel.test-domain.com")
+	_, err = newAmbientCredentials("").Client()
+	assert.EqualError(t, err, `invalid ambient credentials: cpanelUrl: Invalid value: "http://cpanel.test-domain.com": must use https`)
+}
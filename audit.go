@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// The audit log is enabled by giving its sink in this environment variable: "stdout", "file:<path>", or
+// "configmap" (optionally "configmap:<name>").
+const auditLogEnv = "AUDIT_LOG"
+
+const (
+	auditConfigMapName = "cpanel-webhook-audit"
+	auditConfigMapKey  = "audit.jsonl"
+
+	// The most entries kept in the ConfigMap, the oldest being dropped first, as ConfigMaps are limited to 1MiB
+	auditConfigMapMaxEntries = 1000
+)
+
+// newAuditSink creates the sink described by spec, or none if spec is empty.
+func newAuditSink(spec string, client kubernetes.Interface) (cpanel.AuditSink, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "":
+		return nil, nil
+	case "stdout":
+		// Logs go to stderr, so stdout carries nothing but the audit log
+		return cpanel.NewJSONLinesSink(os.Stdout), nil
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("%s must give a path, e.g. file:/var/log/cpanel-webhook/audit.jsonl", auditLogEnv)
+		}
+		file, err := os.OpenFile(arg, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("could not open audit log: %w", err)
+		}
+		return cpanel.NewJSONLinesSink(file), nil
+	case "configmap":
+		if arg == "" {
+			arg = auditConfigMapName
+		}
+		return newConfigMapAuditSink(client, podNamespace, arg, auditConfigMapMaxEntries), nil
+	}
+	return nil, fmt.Errorf("unknown %s sink %q, expected stdout, file:<path> or configmap", auditLogEnv, spec)
+}
+
+// configMapAuditSink keeps the most recent audit entries as JSON lines in a ConfigMap, for clusters without
+// persistent storage or log shipping.
+type configMapAuditSink struct {
+	client     kubernetes.Interface
+	namespace  string
+	name       string
+	maxEntries int
+
+	mutex sync.Mutex
+}
+
+func newConfigMapAuditSink(client kubernetes.Interface, namespace string, name string, maxEntries int) *configMapAuditSink {
+	return &configMapAuditSink{
+		client:     client,
+		namespace:  namespace,
+		name:       name,
+		maxEntries: maxEntries,
+	}
+}
+
+func (s *configMapAuditSink) Write(entry cpanel.AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return updateConfigMap(s.client, s.namespace, s.name, func(data map[string]string) {
+		lines := strings.SplitAfter(data[auditConfigMapKey], "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		lines = append(lines, string(line)+"\n")
+		if len(lines) > s.maxEntries {
+			lines = lines[len(lines)-s.maxEntries:]
+		}
+		data[auditConfigMapKey] = strings.Join(lines, "")
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"zone":"earlier"}`+"\n"), 0600))
+
+	sink, err := newAuditSink("file:"+path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(cpanel.AuditEntry{Zone: "test-domain.com", Action: "create", Result: "success"}))
+
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	assert.Len(t, lines, 2)
+	assert.JSONEq(t, `{"time": "0001-01-01T00:00:00Z", "host": "", "account": "", "zone": "test-domain.com", "action": "create", "changes": null, "serialBefore": "", "result": "success"}`, lines[1])
+
+	_, err = newAuditSink("syslog", nil)
+	assert.EqualError(t, err, `unknown AUDIT_LOG sink "syslog", expected stdout, file:<path> or configmap`)
+}
+
+func TestConfigMapAuditSinkRolls(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	sink := newConfigMapAuditSink(client, "cert-manager", auditConfigMapName, 2)
+
+	for _, zone := range []string{"first.com", "second.com", "third.com"} {
+		assert.NoError(t, sink.Write(cpanel.AuditEntry{Zone: zone}))
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps("cert-manager").Get(context.Background(), auditConfigMapName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(configMap.Data[auditConfigMapKey], "\n"), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"zone":"second.com"`)
+		assert.Contains(t, lines[1], `"zone":"third.com"`)
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/propagation"
+)
+
+// cliCommand is an operator subcommand, run in place of the webhook server when named as the first argument. They
+// talk to CPanel directly, to reproduce what the webhook does against an account without creating Challenges.
+type cliCommand struct {
+	// The positional arguments, for usage
+	args        string
+	description string
+
+	// Takes the account from an Issuer in the cluster rather than from flags
+	fromIssuer bool
+
+	// Changes zones, so records the changes in the audit log
+	mutates bool
+
+	// Registers any flags beyond those for the account
+	flags func(c *cli, flags *flag.FlagSet)
+	run   func(c *cli, args []string) error
+}
+
+var cliCommands = map[string]cliCommand{
+	"check": {
+		description: "Check that the credentials are accepted and the zone can be read",
+		run:         (*cli).check,
+	},
+	"list-txt": {
+		description: "List the TXT records in the zone",
+		run:         (*cli).listTxt,
+	},
+	"present": {
+		args:        "<fqdn> <value>",
+		description: "Create a TXT record as the webhook does for a challenge",
+		mutates:     true,
+		run:         (*cli).present,
+	},
+	"cleanup": {
+		args:        "<fqdn> <value>",
+		description: "Delete a TXT record as the webhook does once a challenge is over",
+		mutates:     true,
+		run:         (*cli).cleanup,
+	},
+	"zone-dump": {
+		description: "Print every line of the zone as CPanel parses it, as JSON",
+		run:         (*cli).zoneDump,
+	},
+	"gc": {
+		description: "Delete challenge records in the zone that don't belong to any Challenge in the cluster",
+		mutates:     true,
+		flags: func(c *cli, flags *flag.FlagSet) {
+			flags.BoolVar(&c.gcDryRun, "dry-run", true, "only log the records that would be deleted")
+			flags.Var(&c.gcPatterns, "pattern", "a regular expression record names must also match to be deleted, may be repeated")
+		},
+		run: (*cli).gc,
+	},
+	"doctor": {
+		args:        "<issuer>",
+		description: "Check everything an Issuer needs to solve challenges with the webhook, suggesting fixes for any problems",
+		fromIssuer:  true,
+		mutates:     true,
+		flags: func(c *cli, flags *flag.FlagSet) {
+			flags.StringVar(&c.namespace, "namespace", "", "the namespace of the Issuer (default the kubeconfig's namespace)")
+			flags.BoolVar(&c.clusterIssuer, "cluster-issuer", false, "check a ClusterIssuer rather than an Issuer")
+			flags.StringVar(&c.zone, "zone", "", "the zone to check (default those in the solver's selector or accounts)")
+			flags.BoolVar(&c.skipWrite, "skip-write", false, "don't add and remove a test TXT record")
+		},
+		run: (*cli).doctor,
+	},
+}
+
+// runCli runs the subcommand named by the first argument, returning the exit code.
+func runCli(args []string, stdout io.Writer, stderr io.Writer) int {
+	c := &cli{stdout: stdout, kubeClients: kubeClientsFor}
+	return c.run(args, stderr)
+}
+
+func (c *cli) run(args []string, stderr io.Writer) int {
+	if args[0] == "help" {
+		printCliUsage(c.stdout)
+		return 0
+	}
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q\n", args[0])
+		printCliUsage(stderr)
+		return 2
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&c.kubeconfig, "kubeconfig", "", "the kubeconfig to use (default $KUBECONFIG or ~/.kube/config)")
+	flags.BoolVar(&c.verbose, "v", false, "log in more detail")
+	if !command.fromIssuer {
+		c.registerAccount(flags)
+	}
+	if command.mutates {
+		flags.StringVar(&c.auditLog, "audit-log", "", "where changes are recorded: stdout, file:<path> or configmap[:<name>] (default $AUDIT_LOG, or stdout)")
+	}
+	if command.flags != nil {
+		command.flags(c, flags)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s %s [flags] %s\n\n%s.\n\nFlags:\n", os.Args[0], args[0], command.args, command.description)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	log.SetOutput(stderr)
+	log.SetLevel(log.InfoLevel)
+	if c.verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	if err := command.run(c, flags.Args()); err != nil {
+		var cpanelErr *cpanel.Error
+		if errors.As(err, &cpanelErr) {
+			fmt.Fprintf(stderr, "Error (%s): %s\n", cpanelErr.Reason, err)
+		} else {
+			fmt.Fprintf(stderr, "Error: %s\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func printCliUsage(w io.Writer) {
+	var names []string
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nWithout a command the webhook server is run. Commands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, cliCommands[name].description)
+	}
+	_ = tw.Flush()
+}
+
+// cli holds the flags of the subcommand being run.
+type cli struct {
+	stdout io.Writer
+
+	urls       string
+	username   string
+	password   string
+	apiToken   string
+	secret     string
+	kubeconfig string
+	zone       string
+	ttl        int
+	ownership  string
+	auditLog   string
+	verbose    bool
+
+	gcDryRun   bool
+	gcPatterns stringsFlag
+
+	namespace     string
+	clusterIssuer bool
+	skipWrite     bool
+
+	// Builds clients for the cluster in the kubeconfig along with its namespace, replaceable for testing
+	kubeClients func(kubeconfig string) (kubernetes.Interface, cmclient.Interface, string, error)
+
+	// Looks up the public nameservers of zones, replaceable for testing
+	resolver propagation.Resolver
+}
+
+func (c *cli) registerAccount(flags *flag.FlagSet) {
+	flags.StringVar(&c.urls, "url", "", "the CPanel URL, or several separated by commas to fail over between (default $CPANEL_URL)")
+	flags.StringVar(&c.username, "username", "", "the CPanel username (default $CPANEL_USERNAME)")
+	flags.StringVar(&c.password, "password", "", "the CPanel password (default $CPANEL_PASSWORD)")
+	flags.StringVar(&c.apiToken, "api-token", "", "a CPanel API token, in place of the password (default $CPANEL_API_TOKEN)")
+	flags.StringVar(&c.secret, "secret", "", "a Secret to read the credentials from instead, as namespace/name or just the name in the kubeconfig's namespace")
+	flags.StringVar(&c.zone, "zone", "", "the zone, e.g. example.com")
+	flags.IntVar(&c.ttl, "ttl", 0, "the TTL of created records (default 300)")
+	flags.StringVar(&c.ownership, "ownership", "", "\"marker\" to only delete records with a marker, as with 'ownership: marker' in the solver config")
+}
+
+// Build the client for the zone from the flags, falling back on the same environment variables as ambient
+// credentials.
+func (c *cli) client() (*cpanel.CpanelClient, error) {
+	if c.zone == "" {
+		return nil, errors.New("-zone must be given")
+	}
+	switch c.ownership {
+	case "", ownershipMarker:
+	case ownershipRegistry:
+		return nil, errors.New("-ownership registry isn't supported outside the cluster, the registry is only kept by the webhook")
+	default:
+		return nil, fmt.Errorf("unknown -ownership %q, expected marker", c.ownership)
+	}
+
+	var urls cpanelUrls
+	for _, url := range strings.Split(orEnv(c.urls, "CPANEL_URL"), ",") {
+		if url = strings.TrimSuffix(strings.TrimSpace(url), "/"); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("-url must be given")
+	}
+
+	dnsZone := strings.TrimSuffix(c.zone, ".") + "."
+	var client *cpanel.CpanelClient
+	if c.secret != "" {
+		var err error
+		client, err = c.secretClient(dnsZone, urls.primary())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		username := orEnv(c.username, "CPANEL_USERNAME")
+		password := orEnv(c.password, "CPANEL_PASSWORD")
+		apiToken := orEnv(c.apiToken, "CPANEL_API_TOKEN")
+		if username == "" {
+			return nil, errors.New("-username or -secret must be given")
+		}
+		if password == "" && apiToken == "" {
+			return nil, errors.New("-password or -api-token must be given")
+		}
+		client = cpanel.NewCpanelClient(urls.primary(), username, password, apiToken).ForZone(dnsZone)
+	}
+
+	client.Failover = newFailover(urls)
+	client.TtlPolicy = cpanel.TtlPolicy{Ttl: c.ttl}
+	if c.ownership == ownershipMarker {
+		client.Ownership = &cpanel.MarkerOwnership{Owner: ownerId}
+	}
+	return client, nil
+}
+
+// Build the client for the zone as for client, for a subcommand that changes it.
+func (c *cli) mutatingClient() (*cpanel.CpanelClient, error) {
+	client, err := c.client()
+	if err != nil {
+		return nil, err
+	}
+	client.AuditSink, err = c.auditSink()
+	if err != nil {
+		return nil, err
+	}
+	client.Locker, err = c.zoneLocker()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// The sink for the audit log as given by -audit-log or AUDIT_LOG as for the webhook. Unlike the webhook it defaults
+// to stdout, so that changes made by hand are always recorded somewhere.
+func (c *cli) auditSink() (cpanel.AuditSink, error) {
+	spec := orEnv(c.auditLog, auditLogEnv)
+	if spec == "" || spec == "stdout" {
+		return cpanel.NewJSONLinesSink(c.stdout), nil
+	}
+
+	var kubeClient kubernetes.Interface
+	if strings.HasPrefix(spec, "configmap") {
+		var err error
+		kubeClient, _, _, err = c.kubeClients(c.kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newAuditSink(spec, kubeClient)
+}
+
+// The locker given by ZONE_LOCKS as for the webhook, so that changes made by hand wait for the webhook's own changes
+// to the zone rather than racing them. Leases are looked for in POD_NAMESPACE, or cert-manager.
+func (c *cli) zoneLocker() (cpanel.ZoneLocker, error) {
+	mode := os.Getenv(zoneLocksEnv)
+	if mode == zoneLocksLocal {
+		return newZoneLocker(mode, nil)
+	}
+	kubeClient, _, _, err := c.kubeClients(c.kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock the zone against the webhook (set %s=%s if it isn't running): %w", zoneLocksEnv, zoneLocksLocal, err)
+	}
+	return newZoneLocker(mode, kubeClient)
+}
+
+func (c *cli) secretClient(dnsZone string, cpanelUrl string) (*cpanel.CpanelClient, error) {
+	kubeClient, _, namespace, err := c.kubeClients(c.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := secretReference{Namespace: namespace, Name: c.secret}
+	if strings.Contains(c.secret, "/") {
+		encoded, _ := json.Marshal(c.secret)
+		if err := json.Unmarshal(encoded, &ref); err != nil {
+			return nil, err
+		}
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(ref.Namespace).Get(context.Background(), ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get secret %s/%s: %w", ref.Namespace, ref.Name, err)
+	}
+	return CreateClientFromSecretValues(secret, ref, dnsZone, cpanelUrl)
+}
+
+func (c *cli) check(args []string) error {
+	if err := expectArgs(args, 0); err != nil {
+		return err
+	}
+	client, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	records, err := client.ListTxtRecords()
+	if err != nil {
+		return err
+	}
+	server := client.CpanelUrl
+	if client.Failover != nil {
+		server = client.Failover.Current()
+	}
+	fmt.Fprintf(c.stdout, "Authenticated to %s as %s and read zone %s with %d TXT records\n", server, client.Username, strings.TrimSuffix(client.DnsZone, "."), len(records))
+	return nil
+}
+
+func (c *cli) listTxt(args []string) error {
+	if err := expectArgs(args, 0); err != nil {
+		return err
+	}
+	client, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	records, err := client.ListTxtRecords()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTTL\tVALUE")
+	for _, record := range records {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", record.Name, record.TTL, record.Value)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) present(args []string) error {
+	if err := expectArgs(args, 2); err != nil {
+		return err
+	}
+	client, err := c.mutatingClient()
+	if err != nil {
+		return err
+	}
+
+	if err := client.SetDnsTxt(absoluteName(args[0]), args[1]); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Presented %s\n", absoluteName(args[0]))
+	return nil
+}
+
+func (c *cli) cleanup(args []string) error {
+	if err := expectArgs(args, 2); err != nil {
+		return err
+	}
+	client, err := c.mutatingClient()
+	if err != nil {
+		return err
+	}
+
+	if err := client.ClearDnsTxt(absoluteName(args[0]), args[1]); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Cleaned up %s\n", absoluteName(args[0]))
+	return nil
+}
+
+func (c *cli) zoneDump(args []string) error {
+	if err := expectArgs(args, 0); err != nil {
+		return err
+	}
+	client, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	records, err := client.ListZoneRecords()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
+
+// A single pass of the garbage collector over the zone. As there's no history of when records were first seen,
+// every orphaned record is deleted at once rather than after a grace period.
+func (c *cli) gc(args []string) error {
+	if err := expectArgs(args, 0); err != nil {
+		return err
+	}
+	client, err := c.mutatingClient()
+	if err != nil {
+		return err
+	}
+	_, cmClient, _, err := c.kubeClients(c.kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	// Every Challenge has to have been seen before any record can be taken as orphaned
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	challenges := newChallengeIndex(cmClient, stopCh)
+	if !cache.WaitForCacheSync(stopCh, challenges.informer.HasSynced) {
+		return errors.New("could not list Challenges")
+	}
+
+	collector, err := newGarbageCollector(&customDNSProviderSolver{cmClient: cmClient, challenges: challenges}, &gcConfig{
+		DryRun:         &c.gcDryRun,
+		RecordPatterns: c.gcPatterns,
+	})
+	if err != nil {
+		return err
+	}
+	collector.clientFor = func(zone gcZone) ([]*cpanel.CpanelClient, error) {
+		return []*cpanel.CpanelClient{client}, nil
+	}
+
+	return collector.collectZone(gcZone{Zone: strings.TrimSuffix(c.zone, ".")})
+}
+
+func expectArgs(args []string, count int) error {
+	if len(args) != count {
+		return fmt.Errorf("expected %d arguments, got %d", count, len(args))
+	}
+	return nil
+}
+
+// Names are taken as fully qualified, as in a Challenge, whether or not they end with a dot.
+func absoluteName(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+func orEnv(value string, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
+
+func kubeClientsFor(kubeconfig string) (kubernetes.Interface, cmclient.Interface, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("could not load kubeconfig: %w", err)
+	}
+	restConfig.Timeout = 30 * time.Second
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("could not load kubeconfig: %w", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	cmClient, err := cmclient.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return kubeClient, cmClient, namespace, nil
+}
+
+// stringsFlag is a flag that may be given several times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
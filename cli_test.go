@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	cmfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// Run a subcommand against the fake CPanel, with a cluster holding the test secret and challenge.
+func runTestCli(server *httptest.Server, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	c := &cli{
+		stdout: &stdout,
+		kubeClients: func(kubeconfig string) (kubernetes.Interface, cmclient.Interface, string, error) {
+			return fake.NewSimpleClientset(newTestSecret("1", "password")), cmfake.NewSimpleClientset(newTestChallenge("app", "Issuer")), "cert-manager", nil
+		},
+	}
+	// Flags must come before positional arguments
+	args = append([]string{args[0], "-url", server.URL, "-zone", "test-domain.com"}, args[1:]...)
+	code := c.run(args, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCliPresentAndCleanup(t *testing.T) {
+	fake, server := newFakeCpanel(t)
+
+	code, stdout, stderr := runTestCli(server, "present", "-username", "user", "-password", "password", "_acme-challenge.test-domain.com", "test-value")
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, []string{"_acme-challenge=test-value"}, fake.txtValues())
+
+	// Changes are audited to stdout unless told otherwise, ahead of the command's own output
+	lines := strings.Split(stdout, "\n")
+	assert.Equal(t, []string{"Presented _acme-challenge.test-domain.com.", ""}, lines[1:])
+	var entry cpanel.AuditEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "create", entry.Action)
+	assert.Equal(t, "test-domain.com", entry.Zone)
+	assert.Equal(t, "success", entry.Result)
+
+	code, stdout, stderr = runTestCli(server, "list-txt", "-username", "user", "-password", "password")
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "NAME             TTL  VALUE\n_acme-challenge  300  test-value\n", stdout)
+
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	code, stdout, stderr = runTestCli(server, "cleanup", "-username", "user", "-password", "password", "-audit-log", "file:"+auditLog, "_acme-challenge.test-domain.com.", "test-value")
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "Cleaned up _acme-challenge.test-domain.com.\n", stdout)
+	assert.Empty(t, fake.txtValues())
+	entries, err := os.ReadFile(auditLog)
+	assert.NoError(t, err)
+	assert.Contains(t, string(entries), `"action":"delete"`)
+}
+
+func TestCliCheckWithSecret(t *testing.T) {
+	_, server := newFakeCpanel(t, fakeRecord{Name: "_dmarc", TTL: 300, Data: []string{"v=DMARC1; p=none"}})
+
+	// The secret's namespace comes from the kubeconfig when not given
+	for _, secret := range []string{"cpanel-credentials", "cert-manager/cpanel-credentials"} {
+		code, stdout, stderr := runTestCli(server, "check", "-secret", secret)
+		assert.Equal(t, 0, code, stderr)
+		assert.Equal(t, "Authenticated to "+server.URL+" as user and read zone test-domain.com with 1 TXT records\n", stdout)
+	}
+
+	code, _, stderr := runTestCli(server, "check", "-secret", "cert-manager/missing")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "could not get secret cert-manager/missing")
+}
+
+func TestCliZoneDump(t *testing.T) {
+	_, server := newFakeCpanel(t, fakeRecord{Name: "_dmarc", TTL: 300, Data: []string{"v=DMARC1; p=none"}})
+
+	code, stdout, stderr := runTestCli(server, "zone-dump", "-username", "user", "-api-token", "token")
+	assert.Equal(t, 0, code, stderr)
+	var records []cpanel.ZoneRecord
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &records))
+	assert.Len(t, records, 2)
+	assert.Equal(t, "SOA", records[0].RecordType)
+	assert.Equal(t, cpanel.ZoneRecord{LineIndex: 2, Type: "record", RecordType: "TXT", Name: "_dmarc", TTL: 300, Data: []string{"v=DMARC1; p=none"}}, records[1])
+}
+
+func TestCliGc(t *testing.T) {
+	fake, server := newFakeCpanel(t,
+		fakeRecord{Name: "_acme-challenge.active", TTL: 300, Data: []string{"test-value"}},
+		fakeRecord{Name: "_acme-challenge.orphan", TTL: 300, Data: []string{"orphaned-value"}},
+	)
+
+	code, _, stderr := runTestCli(server, "gc", "-username", "user", "-password", "password")
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, 0, fake.mutations)
+
+	code, _, stderr = runTestCli(server, "gc", "-username", "user", "-password", "password", "-dry-run=false")
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, []string{"_acme-challenge.active=test-value"}, fake.txtValues())
+}
+
+func TestCliErrors(t *testing.T) {
+	_, server := newFakeCpanel(t)
+
+	code, _, stderr := runTestCli(server, "check")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "Error: -username or -secret must be given\n", stderr)
+
+	code, _, stderr = runTestCli(server, "present", "-username", "user", "-password", "password", "_acme-challenge.test-domain.com")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "Error: expected 2 arguments, got 1\n", stderr)
+
+	code, _, stderr = runTestCli(server, "check", "-username", "user", "-password", "password", "-ownership", "registry")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "isn't supported outside the cluster")
+
+	code, _, stderr = runTestCli(server, "frobnicate")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "Unknown command \"frobnicate\"")
+}
+
+func TestCliKubeconfigError(t *testing.T) {
+	_, server := newFakeCpanel(t)
+	var stdout, stderr bytes.Buffer
+	c := &cli{
+		stdout: &stdout,
+		kubeClients: func(kubeconfig string) (kubernetes.Interface, cmclient.Interface, string, error) {
+			return nil, nil, "", errors.New("could not load kubeconfig: no configuration has been provided")
+		},
+	}
+
+	code := c.run([]string{"check", "-url", server.URL, "-zone", "test-domain.com", "-secret", "cpanel-credentials"}, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "Error: could not load kubeconfig: no configuration has been provided\n", stderr.String())
+}
+
+func TestCliLocksZone(t *testing.T) {
+	_, server := newFakeCpanel(t)
+	kubeClient := fake.NewSimpleClientset()
+	c := &cli{
+		stdout: &bytes.Buffer{},
+		kubeClients: func(kubeconfig string) (kubernetes.Interface, cmclient.Interface, string, error) {
+			return kubeClient, cmfake.NewSimpleClientset(), "cert-manager", nil
+		},
+	}
+
+	// The zone's Lease is taken while it's changed, and released afterwards
+	var stderr bytes.Buffer
+	code := c.run([]string{"present", "-url", server.URL, "-zone", "test-domain.com", "-username", "user", "-password", "password", "_acme-challenge.test-domain.com", "test-value"}, &stderr)
+	assert.Equal(t, 0, code, stderr.String())
+	lease := getTestLease(t, kubeClient)
+	assert.Equal(t, "test-domain.com", lease.Annotations[zoneLeaseZoneAnnotation])
+	assert.Nil(t, lease.Spec.HolderIdentity)
+
+	// Unless told to only lock within the process
+	t.Setenv(zoneLocksEnv, zoneLocksLocal)
+	kubeClient = fake.NewSimpleClientset()
+	code = c.run([]string{"cleanup", "-url", server.URL, "-zone", "test-domain.com", "-username", "user", "-password", "password", "_acme-challenge.test-domain.com", "test-value"}, &stderr)
+	assert.Equal(t, 0, code, stderr.String())
+	leases, err := kubeClient.CoordinationV1().Leases("cert-manager").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, leases.Items)
+}
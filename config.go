@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+var configPath = field.NewPath("config")
+
+// validateConfig checks the decoded config, normalising it where that's harmless (e.g. a trailing slash on the URL).
+// Every problem is returned rather than just the first, so that users can fix their Issuer in one go.
+func validateConfig(cfg *customDNSProviderConfig) field.ErrorList {
+	var errs field.ErrorList
+
+	// With accounts these are checked on each of them instead
+	if len(cfg.Accounts) == 0 {
+		errs = append(errs, validateCredentialsUrl(configPath, cfg.CpanelUrl, cfg.SecretRef)...)
+	}
+	errs = append(errs, validateCpanelUrls(configPath.Child("cpanelUrl"), cfg.CpanelUrl)...)
+
+	errs = append(errs, validateSecretRef(configPath.Child("secretRef"), cfg.SecretRef)...)
+	errs = append(errs, validateTtlPolicy(configPath, cfg)...)
+
+	if cfg.Ownership != "" && cfg.Ownership != ownershipMarker && cfg.Ownership != ownershipRegistry {
+		errs = append(errs, field.NotSupported(configPath.Child("ownership"), cfg.Ownership, []string{ownershipMarker, ownershipRegistry}))
+	}
+	errs = append(errs, validateAccounts(configPath.Child("accounts"), cfg)...)
+	errs = append(errs, validateMirrors(configPath.Child("mirrors"), cfg.Mirrors)...)
+	errs = append(errs, validateMirrorWrites(configPath, cfg)...)
+	errs = append(errs, validatePropagationCheck(configPath.Child("propagationCheck"), cfg.PropagationCheck)...)
+	return errs
+}
+
+// cpanelUrls is one or more URLs of the same CPanel account in order of preference, given in config as a string or
+// a list. Requests fail over to the next when one can't be reached.
+type cpanelUrls []string
+
+func (u *cpanelUrls) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*u = nil
+		if single != "" {
+			*u = cpanelUrls{single}
+		}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(u))
+}
+
+// The URL to use before any failover, or empty if none are given.
+func (u cpanelUrls) primary() string {
+	if len(u) == 0 {
+		return ""
+	}
+	return u[0]
+}
+
+// A Failover across the URLs, or nil if there's only one and so nothing to fail over to.
+func newFailover(urls cpanelUrls) *cpanel.Failover {
+	if len(urls) < 2 {
+		return nil
+	}
+	return cpanel.NewFailover(urls)
+}
+
+// A secretRef needs a cpanelUrl to send its credentials to. Without one ambient credentials are used, which give
+// their own URL, so one in the config is refused rather than being sent the webhook's credentials.
+func validateCredentialsUrl(path *field.Path, urls cpanelUrls, ref secretReference) field.ErrorList {
+	var errs field.ErrorList
+	if len(urls) == 0 && ref.Name != "" {
+		errs = append(errs, field.Required(path.Child("cpanelUrl"), ""))
+	}
+	if len(urls) > 0 && ref.Name == "" {
+		errs = append(errs, field.Forbidden(path.Child("cpanelUrl"), "must not be set without secretRef, as ambient credentials give their own"))
+	}
+	return errs
+}
+
+// Validate the URLs, trimming any trailing slashes.
+func validateCpanelUrls(path *field.Path, urls cpanelUrls) field.ErrorList {
+	var errs field.ErrorList
+	seen := map[string]bool{}
+	for i := range urls {
+		urlPath := path
+		if len(urls) > 1 {
+			urlPath = path.Index(i)
+		}
+		urls[i] = strings.TrimSuffix(urls[i], "/")
+		errs = append(errs, validateCpanelUrl(urlPath, urls[i])...)
+		if seen[urls[i]] {
+			errs = append(errs, field.Duplicate(urlPath, urls[i]))
+		}
+		seen[urls[i]] = true
+	}
+	return errs
+}
+
+func validateCpanelUrl(path *field.Path, cpanelUrl string) field.ErrorList {
+	var errs field.ErrorList
+
+	parsed, err := url.Parse(cpanelUrl)
+	if err != nil {
+		return append(errs, field.Invalid(path, cpanelUrl, err.Error()))
+	}
+	if parsed.Scheme != "https" {
+		errs = append(errs, field.Invalid(path, cpanelUrl, "must use https"))
+	}
+	if parsed.Hostname() == "" {
+		errs = append(errs, field.Invalid(path, cpanelUrl, "must include a host"))
+	}
+	if port := parsed.Port(); port != "" {
+		portNumber, err := strconv.Atoi(port)
+		if err != nil || portNumber < 1 || portNumber > 65535 {
+			errs = append(errs, field.Invalid(path, cpanelUrl, "must have a port between 1 and 65535"))
+		}
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		errs = append(errs, field.Invalid(path, cpanelUrl, "must not have a query or fragment"))
+	}
+	return errs
+}
+
+func validateSecretRef(path *field.Path, ref secretReference) field.ErrorList {
+	var errs field.ErrorList
+
+	if ref.Name != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(ref.Name) {
+			errs = append(errs, field.Invalid(path.Child("name"), ref.Name, msg))
+		}
+	} else if ref.Namespace != "" || ref.UsernameKey != "" || ref.PasswordKey != "" || ref.ApiTokenKey != "" {
+		errs = append(errs, field.Required(path.Child("name"), ""))
+	}
+	if ref.Namespace != "" {
+		for _, msg := range validation.IsDNS1123Label(ref.Namespace) {
+			errs = append(errs, field.Invalid(path.Child("namespace"), ref.Namespace, msg))
+		}
+	}
+
+	keys := []struct {
+		name  string
+		value string
+	}{
+		{name: "usernameKey", value: ref.UsernameKey},
+		{name: "passwordKey", value: ref.PasswordKey},
+		{name: "apiTokenKey", value: ref.ApiTokenKey},
+	}
+	for _, key := range keys {
+		if key.value == "" {
+			continue
+		}
+		for _, msg := range validation.IsConfigMapKey(key.value) {
+			errs = append(errs, field.Invalid(path.Child(key.name), key.value, msg))
+		}
+	}
+	return errs
+}
+
+var ttlConflictPolicies = []string{
+	string(cpanel.TtlConflictAdopt),
+	string(cpanel.TtlConflictRewrite),
+	string(cpanel.TtlConflictFail),
+}
+
+func validateTtlPolicy(path *field.Path, cfg *customDNSProviderConfig) field.ErrorList {
+	var errs field.ErrorList
+
+	ttls := []struct {
+		name  string
+		value int
+	}{
+		{name: "ttl", value: cfg.Ttl},
+		{name: "minTtl", value: cfg.MinTtl},
+		{name: "maxTtl", value: cfg.MaxTtl},
+	}
+	for _, ttl := range ttls {
+		if ttl.value < 0 {
+			errs = append(errs, field.Invalid(path.Child(ttl.name), ttl.value, "must not be negative"))
+		}
+	}
+
+	if cfg.MinTtl > 0 && cfg.MaxTtl > 0 && cfg.MinTtl > cfg.MaxTtl {
+		errs = append(errs, field.Invalid(path.Child("minTtl"), cfg.MinTtl, "must not be greater than maxTtl"))
+	}
+	if cfg.Ttl > 0 && cfg.MinTtl > 0 && cfg.Ttl < cfg.MinTtl {
+		errs = append(errs, field.Invalid(path.Child("ttl"), cfg.Ttl, "must not be less than minTtl"))
+	}
+	if cfg.Ttl > 0 && cfg.MaxTtl > 0 && cfg.Ttl > cfg.MaxTtl {
+		errs = append(errs, field.Invalid(path.Child("ttl"), cfg.Ttl, "must not be greater than maxTtl"))
+	}
+
+	if cfg.TtlConflictPolicy != "" && !slices.Contains(ttlConflictPolicies, string(cfg.TtlConflictPolicy)) {
+		errs = append(errs, field.NotSupported(path.Child("ttlConflictPolicy"), cfg.TtlConflictPolicy, ttlConflictPolicies))
+	}
+	return errs
+}
+
+// unknownFields walks the raw JSON alongside the type it's decoded into, returning every field that the type doesn't
+// have. This catches typos such as 'cpanelURL' which would otherwise be silently ignored.
+// Values that don't have the shape of their type (e.g. the string form of secretRef) are left to the decoder.
+func unknownFields(path *field.Path, raw interface{}, t reflect.Type) field.ErrorList {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var errs field.ErrorList
+	switch value := raw.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := jsonFields(t)
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fieldType, ok := fields[name]
+			if !ok {
+				errs = append(errs, field.Forbidden(path.Child(name), unknownFieldMessage(name, fields)))
+				continue
+			}
+			errs = append(errs, unknownFields(path.Child(name), value[name], fieldType)...)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, item := range value {
+			errs = append(errs, unknownFields(path.Index(i), item, t.Elem())...)
+		}
+	}
+	return errs
+}
+
+// The JSON field names of a struct, including those of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		name, _, _ := strings.Cut(structField.Tag.Get("json"), ",")
+		if structField.Anonymous && name == "" {
+			for embeddedName, embeddedType := range jsonFields(structField.Type) {
+				fields[embeddedName] = embeddedType
+			}
+			continue
+		}
+		if !structField.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = structField.Name
+		}
+		fields[name] = structField.Type
+	}
+	return fields
+}
+
+func unknownFieldMessage(name string, fields map[string]reflect.Type) string {
+	for known := range fields {
+		if strings.EqualFold(name, known) {
+			return fmt.Sprintf("unknown field, did you mean %q?", known)
+		}
+	}
+	return "unknown field"
+}
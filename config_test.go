@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+func TestLoadConfigNormalisesUrl(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"cpanelUrl": "https://cpanel.test-domain.com:2083/", "secretRef": {"name": "cpanel-credentials"}}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, cpanelUrls{"https://cpanel.test-domain.com:2083"}, cfg.CpanelUrl)
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	_, err := loadConfig(&extapi.JSON{Raw: []byte(`{
+		"cpanelURL": "https://cpanel.test-domain.com",
+		"cpanelUrl": "http://cpanel.test-domain.com:99999",
+		"secretRef": {"name": "Not_Valid", "usernameKey": "user name", "extra": true}
+	}`)})
+	assert.EqualError(t, err, `invalid solver config: [`+
+		`config.cpanelURL: Forbidden: unknown field, did you mean "cpanelUrl"?, `+
+		`config.secretRef.extra: Forbidden: unknown field, `+
+		`config.cpanelUrl: Invalid value: "http://cpanel.test-domain.com:99999": must use https, `+
+		`config.cpanelUrl: Invalid value: "http://cpanel.test-domain.com:99999": must have a port between 1 and 65535, `+
+		`config.secretRef.name: Invalid value: "Not_Valid": a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*'), `+
+		`config.secretRef.usernameKey: Invalid value: "user name": a valid config key must consist of alphanumeric characters, '-', '_' or '.' (e.g. 'key.name',  or 'KEY_NAME',  or 'key-name', regex used for validation is '[-._a-zA-Z0-9]+')]`)
+}
+
+func TestLoadConfigRequiresUrlWithSecret(t *testing.T) {
+	_, err := loadConfig(&extapi.JSON{Raw: []byte(`{"secretRef": "cert-manager/cpanel-credentials"}`)})
+	assert.EqualError(t, err, "invalid solver config: config.cpanelUrl: Required value")
+
+	// Ambient credentials may provide the URL
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{}`)})
+	assert.NoError(t, err)
+}
+
+func TestLoadConfigRefusesUrlWithAmbientCredentials(t *testing.T) {
+	// Otherwise the webhook's own credentials would be sent to the Issuer's choice of host
+	_, err := loadConfig(&extapi.JSON{Raw: []byte(`{"cpanelUrl": "https://attacker.test"}`)})
+	assert.EqualError(t, err, "invalid solver config: config.cpanelUrl: Forbidden: must not be set without secretRef, as ambient credentials give their own")
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"accounts": [{"cpanelUrl": "https://attacker.test", "zones": ["test-domain.com"]}]}`)})
+	assert.EqualError(t, err, "invalid solver config: config.accounts[0].cpanelUrl: Forbidden: must not be set without secretRef, as ambient credentials give their own")
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"mirrors": [{"cpanelUrl": "https://attacker.test"}]}`)})
+	assert.EqualError(t, err, "invalid solver config: config.mirrors[0].secretRef.name: Required value")
+}
+
+func TestLoadConfigTtlPolicy(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"ttl": 60, "minTtl": 30, "maxTtl": 300, "ttlConflictPolicy": "rewrite"}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, cpanel.TtlPolicy{Ttl: 60, MinTtl: 30, MaxTtl: 300, Conflict: cpanel.TtlConflictRewrite}, cfg.ttlPolicy())
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"ttl": 600, "minTtl": 30, "maxTtl": 300, "ttlConflictPolicy": "ignore"}`)})
+	assert.EqualError(t, err, `invalid solver config: [`+
+		`config.ttl: Invalid value: 600: must not be greater than maxTtl, `+
+		`config.ttlConflictPolicy: Unsupported value: "ignore": supported values: "adopt", "rewrite", "fail"]`)
+}
+
+func TestLoadConfigPropagationCheck(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"propagationCheck": {"timeout": "20s"}}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Second, cfg.PropagationCheck.Timeout.Duration)
+
+	// Present has to finish within the API server's request timeout
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"propagationCheck": {"timeout": "2m"}}`)})
+	assert.EqualError(t, err, `invalid solver config: config.propagationCheck.timeout: Invalid value: "2m0s": must not be greater than 30s, as Present must finish within the API server's 60s request timeout`)
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"propagationCheck": {"timeout": "10s", "interval": "1m", "retries": 3}}`)})
+	assert.EqualError(t, err, `invalid solver config: [`+
+		`config.propagationCheck.retries: Forbidden: unknown field, `+
+		`config.propagationCheck.interval: Invalid value: "1m0s": must not be greater than timeout]`)
+}
+
+func TestLoadConfigUrlList(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"cpanelUrl": ["https://cpanel.test-domain.com/", "https://server123.host.test:2083"], "secretRef": {"name": "cpanel-credentials"}}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, cpanelUrls{"https://cpanel.test-domain.com", "https://server123.host.test:2083"}, cfg.CpanelUrl)
+	assert.Equal(t, "https://cpanel.test-domain.com", newFailover(cfg.CpanelUrl).Current())
+	assert.Nil(t, newFailover(cfg.CpanelUrl[:1]))
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"cpanelUrl": ["https://cpanel.test-domain.com", "http://server123.host.test", "https://cpanel.test-domain.com/"], "secretRef": {"name": "cpanel-credentials"}}`)})
+	assert.EqualError(t, err, `invalid solver config: [`+
+		`config.cpanelUrl[1]: Invalid value: "http://server123.host.test": must use https, `+
+		`config.cpanelUrl[2]: Duplicate value: "https://cpanel.test-domain.com"]`)
+}
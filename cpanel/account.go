@@ -0,0 +1,70 @@
+package cpanel
+
+import (
+	"net/url"
+)
+
+// Domains are those of the CPanel account, whichever zone the client is for.
+type Domains struct {
+	Main   string
+	Addon  []string
+	Parked []string
+
+	// Subdomains are served from the zone of the domain they belong to, so don't have zones of their own
+	Sub []string
+}
+
+// Zones are the domains that have a zone of their own.
+func (d *Domains) Zones() []string {
+	zones := []string{d.Main}
+	zones = append(zones, d.Addon...)
+	return append(zones, d.Parked...)
+}
+
+// ListDomains returns the domains of the account. It doesn't depend on any zone, so is a good first check that the
+// credentials are accepted.
+func (c *CpanelClient) ListDomains() (*Domains, error) {
+	var response cpanelDomainsResponse
+	err := c.doRequest("/execute/DomainInfo/list_domains", "domains", &response)
+	if err != nil {
+		return nil, err
+	}
+	return &Domains{
+		Main:   response.Data.MainDomain,
+		Addon:  response.Data.AddonDomains,
+		Parked: response.Data.ParkedDomains,
+		Sub:    response.Data.SubDomains,
+	}, nil
+}
+
+// HasFeature returns whether the account has a CPanel feature enabled, e.g. "zoneedit" for the Zone Editor that
+// the webhook needs.
+func (c *CpanelClient) HasFeature(name string) (bool, error) {
+	var response cpanelFeatureResponse
+	err := c.doRequest("/execute/Features/has_feature?name="+url.QueryEscape(name), "feature", &response)
+	if err != nil {
+		return false, err
+	}
+	return response.Status == 1, nil
+}
+
+// https://api.docs.cpanel.net/openapi/cpanel/operation/list_domains/
+type cpanelDomainsResponse struct {
+	cpanelResponse
+	Data struct {
+		MainDomain    string   `json:"main_domain"`
+		AddonDomains  []string `json:"addon_domains"`
+		ParkedDomains []string `json:"parked_domains"`
+		SubDomains    []string `json:"sub_domains"`
+	} `json:"data"`
+}
+
+// https://api.docs.cpanel.net/openapi/cpanel/operation/has_feature/
+// A missing feature is reported as an error with a status of 0, which isn't an error for us.
+type cpanelFeatureResponse struct {
+	cpanelResponse
+}
+
+func (r *cpanelFeatureResponse) errors() []string {
+	return nil
+}
@@ -0,0 +1,109 @@
+package cpanel
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditEntry records a change the client made (or tried to make) to a zone, one for each mass_edit_zone request.
+// Values are only recorded as hashes, as they're credentials of a sort until the challenge is over.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Account string    `json:"account"`
+	Zone    string    `json:"zone"`
+	Action  string    `json:"action"`
+
+	Changes []AuditChange `json:"changes"`
+
+	// The zone serial the change was made against, and the one CPanel gave the zone afterwards
+	SerialBefore string `json:"serialBefore"`
+	SerialAfter  string `json:"serialAfter,omitempty"`
+
+	// What the change was made for, if known
+	Trigger *AuditTrigger `json:"trigger,omitempty"`
+
+	// "success" or "failure", with the error for the latter
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AuditChange is a single record added, edited or removed by a change.
+type AuditChange struct {
+	Change      string `json:"change"`
+	Name        string `json:"name"`
+	ValueSha256 string `json:"valueSha256"`
+}
+
+// AuditTrigger identifies the Challenge a change was made for.
+type AuditTrigger struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	UID       string `json:"uid,omitempty"`
+}
+
+// AuditSink receives an entry for every change made by a client.
+type AuditSink interface {
+	Write(entry AuditEntry) error
+}
+
+// JSONLinesSink writes audit entries as JSON lines, e.g. to an append-only file or stdout.
+type JSONLinesSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewJSONLinesSink(writer io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{writer: writer}
+}
+
+func (s *JSONLinesSink) Write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.writer.Write(append(line, '\n'))
+	return err
+}
+
+// Record a change in the client's AuditSink, if it has one. A sink that fails is logged rather than failing the
+// change, as by then it's been made.
+func (c *CpanelClient) audit(action string, changes []AuditChange, serialBefore string, serialAfter string, err error) {
+	if c.AuditSink == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:         time.Now().UTC(),
+		Host:         urlHost(c.serverUrl()),
+		Account:      c.Username,
+		Zone:         c.getDnsZoneNoDot(),
+		Action:       action,
+		Changes:      changes,
+		SerialBefore: serialBefore,
+		SerialAfter:  serialAfter,
+		Result:       "success",
+	}
+	if c.AuditTrigger != nil {
+		entry.Trigger = c.AuditTrigger()
+	}
+	if err != nil {
+		entry.Result = "failure"
+		entry.Error = err.Error()
+	}
+
+	if writeErr := c.AuditSink.Write(entry); writeErr != nil {
+		log.Errorf("Could not write audit entry for %s of zone %s: %s", action, entry.Zone, writeErr)
+	}
+}
+
+func auditChange(change string, name string, value string) AuditChange {
+	return AuditChange{Change: change, Name: name, ValueSha256: HashValue(value)}
+}
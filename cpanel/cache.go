@@ -0,0 +1,194 @@
+package cpanel
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Events a ZoneCache reports to its Observe function.
+const (
+	CacheHit        = "hit"
+	CacheMiss       = "miss"
+	CacheUpdate     = "update"
+	CacheInvalidate = "invalidate"
+)
+
+// ZoneCache keeps a short-lived snapshot of each zone, so that a run of changes to the same zone (such as the
+// challenges for a certificate with many names) doesn't download and decode the whole zone for every one.
+// Snapshots are only used to make changes, which CPanel rejects if the zone's serial has moved on since, and are
+// updated in place after each of our own changes. Anything else, such as deciding there's nothing to change, is
+// checked against the live zone. A ZoneCache is safe to share between clients, snapshots being kept per CPanel host,
+// account and zone.
+type ZoneCache struct {
+	// How long a snapshot is used for after it's downloaded
+	TTL time.Duration
+
+	// Observe, if set, is called with the zone for every CacheHit, CacheMiss, CacheUpdate and CacheInvalidate
+	Observe func(zone string, event string)
+
+	now func() time.Time
+
+	mutex     sync.Mutex
+	snapshots map[string]*zoneSnapshot
+}
+
+type zoneSnapshot struct {
+	zone    *cpanelZoneResponse
+	fetched time.Time
+}
+
+func NewZoneCache(ttl time.Duration) *ZoneCache {
+	return &ZoneCache{
+		TTL:       ttl,
+		now:       time.Now,
+		snapshots: map[string]*zoneSnapshot{},
+	}
+}
+
+// get returns a copy of the zone's snapshot if there's a fresh one.
+func (z *ZoneCache) get(key string, zoneName string) *cpanelZoneResponse {
+	z.mutex.Lock()
+	snapshot, ok := z.snapshots[key]
+	if ok && z.now().Sub(snapshot.fetched) >= z.TTL {
+		delete(z.snapshots, key)
+		ok = false
+	}
+	var zone *cpanelZoneResponse
+	if ok {
+		zone = copyZone(snapshot.zone)
+	}
+	z.mutex.Unlock()
+
+	if zone == nil {
+		z.observe(zoneName, CacheMiss)
+		return nil
+	}
+	log.Debugf("Using snapshot of zone %s from %s", zoneName, snapshot.fetched)
+	z.observe(zoneName, CacheHit)
+	return zone
+}
+
+// put stores a freshly downloaded zone.
+func (z *ZoneCache) put(key string, zone *cpanelZoneResponse) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.snapshots[key] = &zoneSnapshot{zone: copyZone(zone), fetched: z.now()}
+}
+
+// update applies a change we made from the given serial, which left the zone at newSerial, to the zone's snapshot.
+// If the snapshot has already moved on from the serial, or the new one isn't known, it's dropped instead.
+func (z *ZoneCache) update(key string, zoneName string, serial string, newSerial string, apply func(records []cpanelZoneRecord) []cpanelZoneRecord) {
+	z.mutex.Lock()
+	snapshot, ok := z.snapshots[key]
+	if !ok {
+		z.mutex.Unlock()
+		return
+	}
+	if current, err := getZoneSerial(snapshot.zone); newSerial == "" || err != nil || current != serial {
+		delete(z.snapshots, key)
+		z.mutex.Unlock()
+		log.Debugf("Dropped snapshot of zone %s, as it can't be brought up to date", zoneName)
+		z.observe(zoneName, CacheInvalidate)
+		return
+	}
+	snapshot.zone.Data = apply(snapshot.zone.Data)
+	setZoneSerial(snapshot.zone, newSerial)
+	z.mutex.Unlock()
+
+	log.Debugf("Updated snapshot of zone %s to serial %s", zoneName, newSerial)
+	z.observe(zoneName, CacheUpdate)
+}
+
+// invalidate drops the zone's snapshot, e.g. once it's known to be out of date.
+func (z *ZoneCache) invalidate(key string, zoneName string, why string) {
+	z.mutex.Lock()
+	_, ok := z.snapshots[key]
+	delete(z.snapshots, key)
+	z.mutex.Unlock()
+
+	if ok {
+		log.Debugf("Dropped snapshot of zone %s: %s", zoneName, why)
+		z.observe(zoneName, CacheInvalidate)
+	}
+}
+
+func (z *ZoneCache) observe(zone string, event string) {
+	if z.Observe != nil {
+		z.Observe(zone, event)
+	}
+}
+
+// Copy the records, so that callers can't change the snapshot (or the snapshot them).
+func copyZone(zone *cpanelZoneResponse) *cpanelZoneResponse {
+	copied := *zone
+	copied.Data = make([]cpanelZoneRecord, len(zone.Data))
+	for i, record := range zone.Data {
+		record.Data = append([]string(nil), record.Data...)
+		copied.Data[i] = record
+	}
+	return &copied
+}
+
+// Snapshots are kept per host, account and zone, as the zone is locked.
+func (c *CpanelClient) cacheKey() string {
+	return urlHost(c.CpanelUrl) + "|" + c.Username + "|" + c.getDnsZoneNoDot()
+}
+
+// getZoneSnapshot returns the zone to make a change with, from the Cache if there's a fresh snapshot and otherwise
+// downloaded, along with whether it was cached.
+func (c *CpanelClient) getZoneSnapshot() (*cpanelZoneResponse, bool, error) {
+	if c.Cache != nil {
+		if zone := c.Cache.get(c.cacheKey(), c.getDnsZoneNoDot()); zone != nil {
+			return zone, true, nil
+		}
+	}
+	zone, err := c.getZoneDetails()
+	return zone, false, err
+}
+
+// Bring the snapshot up to date after a successful change, see ZoneCache.update.
+func (c *CpanelClient) updateSnapshot(serial string, newSerial string, apply func(records []cpanelZoneRecord) []cpanelZoneRecord) {
+	if c.Cache != nil {
+		c.Cache.update(c.cacheKey(), c.getDnsZoneNoDot(), serial, newSerial, apply)
+	}
+}
+
+func (c *CpanelClient) invalidateSnapshot(why string) {
+	if c.Cache != nil {
+		c.Cache.invalidate(c.cacheKey(), c.getDnsZoneNoDot(), why)
+	}
+}
+
+// Line indexes of records we've added aren't known until the zone is downloaded again, nor are those after a line
+// we've removed, in case it spanned several. A snapshot with these can't be used to edit or remove them.
+const unknownLineIndex = -1
+
+func hasUnknownLines(records []cpanelZoneRecord) bool {
+	for _, record := range records {
+		if record.LineIndex == unknownLineIndex {
+			return true
+		}
+	}
+	return false
+}
+
+func hasUnknownTxtLines(records []TxtRecord) bool {
+	for _, record := range records {
+		if record.LineIndex == unknownLineIndex {
+			return true
+		}
+	}
+	return false
+}
+
+func setZoneSerial(zone *cpanelZoneResponse, serial string) {
+	for i := range zone.Data {
+		record := &zone.Data[i]
+		if record.RecordType == typeSoa && len(record.Data) > soaSerialIndex {
+			record.Data[soaSerialIndex] = serial
+			return
+		}
+	}
+}
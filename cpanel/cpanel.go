@@ -1,15 +1,19 @@
 package cpanel
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,146 +25,249 @@ type CpanelClient struct {
 	Username   string
 	Password   string
 	ApiToken   string // An alternative to a password and takes precedence
-}
 
-func (c *CpanelClient) SetDnsTxt(recordName string, value string) error {
-	log.Infof("Setting TXT record for '%s' to '%s'", recordName, value)
-	recordNameSub := c.getDnsSubdomainOnly(recordName)
+	// The TTL of created records, see TtlPolicy
+	TtlPolicy TtlPolicy
 
-	zone, err := c.getZoneDetails()
-	if err != nil {
-		return err
+	// Ownership, if set, keeps track of the records created by the client so that only those are ever deleted
+	Ownership Ownership
+
+	// AuditSink, if set, is given an entry for every change made to a zone
+	AuditSink AuditSink
+
+	// AuditTrigger, if set, identifies what changes are made for in audit entries. It's only called once there's
+	// an entry to write.
+	AuditTrigger func() *AuditTrigger
+
+	// Locker, if set, locks the zone while changing it
+	Locker ZoneLocker
+
+	// Cache, if set, keeps a short-lived snapshot of the zone between changes rather than downloading it for each
+	Cache *ZoneCache
+
+	// Failover, if set, sends requests to several URLs of the account in place of CpanelUrl
+	Failover *Failover
+
+	// Notify, if set, is called for noteworthy events that didn't end in an error, e.g. a retried serial conflict.
+	Notify func(reason string, message string)
+}
+
+// How long a request to CPanel may take, including reading the response, before it's given up on as unreachable.
+// Large zones are streamed so this is generous, it's there so that a hung endpoint can't hold a zone's lock forever.
+const requestTimeout = 2 * time.Minute
+
+// NewCpanelClient creates a client with its own HTTP connection pool, not yet bound to a DNS zone.
+// Use ForZone to share the client (and its connections) across zones of the same account.
+func NewCpanelClient(cpanelUrl string, username string, password string, apiToken string) *CpanelClient {
+	return &CpanelClient{
+		httpClient: http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			Timeout:   requestTimeout,
+		},
+		CpanelUrl: cpanelUrl,
+		Username:  username,
+		Password:  password,
+		ApiToken:  apiToken,
 	}
-	log.Infof("Got zone, record count: %d", len(zone.Data))
+}
 
-	// Get the zone serial as it's needed for mutation
-	serial := getZoneSerial(zone)
-	log.Infof("Got SOA serial %s", serial)
+// ForZone returns a copy of the client for the given zone, sharing the same connection pool.
+func (c *CpanelClient) ForZone(dnsZone string) *CpanelClient {
+	zoneClient := *c
+	zoneClient.DnsZone = dnsZone
+	zoneClient.Notify = nil
+	zoneClient.AuditTrigger = nil
+	zoneClient.Ownership = nil
+	return &zoneClient
+}
 
-	// Does the requested record already exist?
-	var existingRecord *cpanelZoneRecord
+// CloseIdleConnections drops any pooled connections, e.g. once the client's credentials are no longer valid.
+func (c *CpanelClient) CloseIdleConnections() {
+	c.httpClient.CloseIdleConnections()
+}
 
-	// All records of a given key must have the same TTL.
-	// If other ACME clients have set DNS records we need to grab the TTL and use that, else we default to 300.
-	existingRecordTtl := 300
-	for _, record := range zone.Data {
-		if record.RecordType == typeTxt && record.Dname == recordNameSub {
-			existingRecordTtl = record.TTL
-			// Found a record, but does it have the right value? (there could be multiple TXTs)
-			if len(record.Data) > 0 && record.Data[0] == value {
-				existingRecord = &record
-				break
-			} else {
-				log.Debugf("Found an existing record but had different value. TTL: %d", existingRecordTtl)
-			}
-		}
+// Close releases what the client holds in the background, its pooled connections and any Failover's probing, once
+// it's no longer going to be used. Copies from ForZone share these, so must not be used afterwards either.
+func (c *CpanelClient) Close() {
+	c.CloseIdleConnections()
+	if c.Failover != nil {
+		c.Failover.Close()
 	}
+}
 
-	if existingRecord != nil {
-		log.Info("Existing record with matching value found, not doing anything")
-	} else {
-		log.Info("No existing record with value exists, creating it")
-		err := c.createZoneRecord(serial, recordNameSub, value, existingRecordTtl)
-		if err == nil {
-			log.Info("Record created")
-		} else {
-			log.Error("Could not create record", err)
-		}
-		return err
+// Retire stops what the client does in the background once it's been replaced, while requests may still be made
+// with it: any Failover stops probing, and pooled connections are left to close once they've been idle for the
+// transport's timeout rather than dropped.
+func (c *CpanelClient) Retire() {
+	if c.Failover != nil {
+		c.Failover.Close()
 	}
+}
 
-	return nil
+// The number of times a mutation is attempted when the zone serial changes underneath us.
+const maxSerialAttempts = 3
+
+func (c *CpanelClient) SetDnsTxt(recordName string, value string) error {
+	_, err := c.presentDnsTxt(recordName, value)
+	return err
+}
+
+// Set the TXT record, returning whether it had to be created rather than already existing.
+func (c *CpanelClient) presentDnsTxt(recordName string, value string) (bool, error) {
+	log.Infof("Setting TXT record for '%s' to '%s'", recordName, value)
+	created := false
+	err := c.retryOnSerialConflict(func(ctx context.Context) error {
+		var err error
+		created, err = c.setDnsTxt(ctx, recordName, value)
+		return err
+	})
+	return created, err
 }
 
+// ClearDnsTxt deletes every TXT record with the name and value, as retries or past races may have left duplicates.
 func (c *CpanelClient) ClearDnsTxt(recordName string, value string) error {
 	log.Infof("Deleting TXT record for '%s' and value '%s'", recordName, value)
-	recordNameSub := c.getDnsSubdomainOnly(recordName)
-
-	log.Debug("Getting zone")
-	zone, err := c.getZoneDetails()
+	removed, err := c.RemoveTxtRecords([]TxtRecord{{Name: c.getDnsSubdomainOnly(recordName), Value: value}})
 	if err != nil {
 		return err
 	}
-	log.Debug("Got zone")
 
-	// Get the zone serial as it's needed for mutation
-	serial := getZoneSerial(zone)
-	log.Infof("Got SOA serial %s", serial)
-
-	var existingRecord *cpanelZoneRecord
-	for _, record := range zone.Data {
-		if record.RecordType == typeTxt && record.Dname == recordNameSub {
-			if len(record.Data) > 0 && record.Data[0] == value {
-				existingRecord = &record
-			}
-		}
+	switch {
+	case removed == 0:
+		log.Warn("Record not found (or not created by this webhook) - has it already been deleted? Pretending it was successful")
+	case removed > 1:
+		log.Infof("Deleted %d duplicate TXT records for '%s'", removed, recordName)
+		c.notify(ReasonDuplicatesRemoved, fmt.Sprintf("Deleted %d duplicate TXT records for %s", removed, recordName))
 	}
+	return nil
+}
 
-	if existingRecord == nil {
-		log.Warn("Record not found - has it already been deleted? Pretending it was successful")
-		return nil
-	} else {
-		log.Debugf("Record found with line no %d", existingRecord.LineIndex)
-		err := c.deleteZoneRecord(serial, existingRecord.LineIndex)
+// The zone serial could change between reading it and sending our mutation (e.g. something else edited the zone).
+// CPanel rejects these, so re-read the zone and try again. The zone is locked throughout, if there's a Locker, so
+// that other replicas wait rather than conflict, and mutate is given the lock's context to abandon the change should
+// the lock be lost.
+func (c *CpanelClient) retryOnSerialConflict(mutate func(ctx context.Context) error) error {
+	ctx, unlock, err := c.lockZone()
+	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	for attempt := 1; attempt <= maxSerialAttempts; attempt++ {
+		err = mutate(ctx)
+		if err != nil {
+			// Whether or not the change was made, the snapshot can't be trusted any more
+			c.invalidateSnapshot(err.Error())
+		}
+		if ErrorReason(err) != ReasonSerialConflict {
+			return err
+		}
+		log.Warnf("Zone serial changed during mutation (attempt %d): %s", attempt, err)
+		c.notify(ReasonSerialConflictRetried, fmt.Sprintf("Zone serial of %s changed during mutation, retrying: %s", c.getDnsZoneNoDot(), err))
+	}
+	return err
 }
 
-func (c *CpanelClient) getZoneDetails() (*cpanelZoneResponse, error) {
-	req, err := http.NewRequest("GET", c.CpanelUrl+"/execute/DNS/parse_zone?zone="+url.QueryEscape(c.getDnsZoneNoDot()), nil)
-	if err != nil {
-		log.Error("zone info HTTP request error", err)
-		return nil, err
+func (c *CpanelClient) notify(reason string, message string) {
+	if c.Notify != nil {
+		c.Notify(reason, message)
 	}
+}
 
-	c.addRequestAuth(req)
+func (c *CpanelClient) setDnsTxt(ctx context.Context, recordName string, value string) (bool, error) {
+	recordNameSub := c.getDnsSubdomainOnly(recordName)
 
-	resp, err := c.httpClient.Do(req)
+	zone, cached, err := c.getZoneSnapshot()
 	if err != nil {
-		log.Error("zone info HTTP response error", err)
-		return nil, err
+		return false, err
 	}
-	defer resp.Body.Close()
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error("zone info HTTP response read error", err)
-		return nil, err
+	// Does the requested record already exist?
+	var existingRecord *cpanelZoneRecord
+
+	// All records of a given key must have the same TTL.
+	// If other ACME clients have set DNS records we need to take them into account, see TtlPolicy.
+	var otherRecords []cpanelZoneRecord
+	for {
+		log.Infof("Got zone, record count: %d", len(zone.Data))
+		existingRecord, otherRecords = findTxtRecord(zone, c.DnsZone, recordNameSub, value)
+
+		// Doing nothing, or changing records whose lines aren't known, is only done from the live zone
+		if !cached || (existingRecord == nil && !hasUnknownLines(otherRecords)) {
+			break
+		}
+		log.Debug("Checking the live zone rather than its snapshot")
+		zone, err = c.getZoneDetails()
+		if err != nil {
+			return false, err
+		}
+		cached = false
 	}
 
-	var zoneResponse cpanelZoneResponse
-	err = json.Unmarshal(bodyBytes, &zoneResponse)
+	// Get the zone serial as it's needed for mutation
+	serial, err := getZoneSerial(zone)
 	if err != nil {
-		log.Error("could not decode zone JSON", err)
-		return nil, err
+		return false, err
 	}
+	log.Infof("Got SOA serial %s", serial)
 
-	if len(zoneResponse.Errors) > 0 {
-		log.Errorf("zone JSON reported errors: %+v", zoneResponse.Errors)
-		return &zoneResponse, errors.New("zone JSON reported errors")
+	if existingRecord != nil {
+		log.Info("Existing record with matching value found, not doing anything")
+	} else {
+		log.Info("No existing record with value exists, creating it")
+		ttl, rewrites, err := c.TtlPolicy.resolve(otherRecords)
+		if err != nil {
+			log.Error("Could not create record", err)
+			return false, err
+		}
+		var companions []TxtRecord
+		if c.Ownership != nil {
+			companions, err = c.Ownership.Claim(c.getDnsZoneNoDot(), TxtRecord{Name: recordNameSub, Value: value})
+			if err != nil {
+				log.Error("Could not claim ownership of record", err)
+				return false, err
+			}
+			for i := range companions {
+				if companions[i].TTL == 0 {
+					companions[i].TTL = ttl
+				}
+			}
+		}
+		err = c.createZoneRecord(ctx, serial, recordNameSub, value, ttl, rewrites, companions)
+		if err == nil {
+			log.Info("Record created")
+		} else {
+			log.Error("Could not create record", err)
+		}
+		return err == nil, err
 	}
 
-	// The CPanel API unhelpfully base64 encodes values
-	dataRecords := zoneResponse.Data
-	for i := range dataRecords {
-		record := &dataRecords[i]
-		record.Dname = decode(record.DnameB64)
-		record.Text = decode(record.TextB64)
+	return false, nil
+}
 
-		for _, data := range record.DataB64 {
-			dataValue := decode(data)
-			record.Data = append(record.Data, dataValue)
+// Find the TXT record with the name and value, along with any others of the same name.
+func findTxtRecord(zone *cpanelZoneResponse, dnsZone string, name string, value string) (*cpanelZoneRecord, []cpanelZoneRecord) {
+	var otherRecords []cpanelZoneRecord
+	for _, record := range zone.Data {
+		if record.RecordType == typeTxt && relativeName(record.Dname, dnsZone) == name {
+			// Found a record, but does it have the right value? (there could be multiple TXTs)
+			if len(record.Data) > 0 && txtValue(record.Data) == value {
+				return &record, nil
+			}
+			log.Debugf("Found an existing record but had different value. TTL: %d", record.TTL)
+			otherRecords = append(otherRecords, record)
 		}
 	}
-
-	return &zoneResponse, nil
+	return nil, otherRecords
 }
 
-func (c *CpanelClient) createZoneRecord(serial string, recordName string, value string, ttl int) error {
+// Create a TXT record along with any companion records, also changing the TTL of any given existing records to
+// match it.
+func (c *CpanelClient) createZoneRecord(ctx context.Context, serial string, recordName string, value string, ttl int, rewrites []cpanelZoneRecord, companions []TxtRecord) error {
 	// TODO: URL encode
 	createObj := &cpanelZoneRecordAdd{
-		Data:       []string{value},
-		Dname:      recordName,
+		Data:       splitTxtValue(value),
+		Dname:      c.cpanelName(recordName),
 		TTL:        ttl,
 		RecordType: typeTxt,
 	}
@@ -171,81 +278,187 @@ func (c *CpanelClient) createZoneRecord(serial string, recordName string, value
 		log.Error("could not marshal JSON for create", err)
 		return err
 	}
+	changes := []AuditChange{auditChange("add", recordName, value)}
+
+	var edits strings.Builder
+	for _, companion := range companions {
+		companionJson, err := json.Marshal(&cpanelZoneRecordAdd{
+			Data:       splitTxtValue(companion.Value),
+			Dname:      c.cpanelName(companion.Name),
+			TTL:        companion.TTL,
+			RecordType: typeTxt,
+		})
+		if err != nil {
+			log.Error("could not marshal JSON for create", err)
+			return err
+		}
+		edits.WriteString("&add=" + url.QueryEscape(string(companionJson)))
+		changes = append(changes, auditChange("add", companion.Name, companion.Value))
+	}
+	for _, record := range rewrites {
+		editJson, err := json.Marshal(&cpanelZoneRecordEdit{
+			LineIndex: record.LineIndex,
+			cpanelZoneRecordAdd: cpanelZoneRecordAdd{
+				Data:       record.Data,
+				Dname:      record.Dname,
+				TTL:        ttl,
+				RecordType: record.RecordType,
+			},
+		})
+		if err != nil {
+			log.Error("could not marshal JSON for edit", err)
+			return err
+		}
+		edits.WriteString("&edit=" + url.QueryEscape(string(editJson)))
+		changes = append(changes, auditChange("edit", relativeName(record.Dname, c.DnsZone), txtValue(record.Data)))
+	}
 
-	url := c.CpanelUrl + "/execute/DNS/mass_edit_zone?zone=" + c.getDnsZoneNoDot() + "&serial=" + serial + "&add=" + createJsonEncoded
-	log.Debugf("Using URL to create: %s", url)
-
-	req, err := http.NewRequest("GET", url, nil)
+	newSerial, err := c.massEditZone(ctx, serial, "&add="+createJsonEncoded+edits.String(), "create", changes)
 	if err != nil {
-		log.Error("zone cretae HTTP request error", err)
 		return err
 	}
 
-	c.addRequestAuth(req)
+	// CPanel adds records at the end of the zone, leaving the lines of the others as they were
+	c.updateSnapshot(serial, newSerial, func(records []cpanelZoneRecord) []cpanelZoneRecord {
+		for i := range records {
+			for _, rewrite := range rewrites {
+				if records[i].LineIndex == rewrite.LineIndex {
+					records[i].TTL = ttl
+				}
+			}
+		}
+		for _, added := range append([]TxtRecord{{Name: recordName, Value: value, TTL: ttl}}, companions...) {
+			records = append(records, cpanelZoneRecord{
+				LineIndex:  unknownLineIndex,
+				Type:       "record",
+				RecordType: typeTxt,
+				TTL:        added.TTL,
+				Dname:      c.cpanelName(added.Name),
+				Data:       splitTxtValue(added.Value),
+			})
+		}
+		return records
+	})
+	return nil
+}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		log.Error("zone create HTTP response error", err)
-		return err
+// Delete the records by their line indexes.
+func (c *CpanelClient) deleteZoneRecord(ctx context.Context, serial string, records []TxtRecord) error {
+	var edits strings.Builder
+	var changes []AuditChange
+	for _, record := range records {
+		edits.WriteString("&remove=" + strconv.Itoa(record.LineIndex))
+		changes = append(changes, auditChange("remove", record.Name, record.Value))
 	}
-	defer resp.Body.Close()
-
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	newSerial, err := c.massEditZone(ctx, serial, edits.String(), "delete", changes)
 	if err != nil {
-		log.Error("zone create HTTP response read error", err)
 		return err
 	}
 
-	var createResponse cpanelResponse
-	err = json.Unmarshal(bodyBytes, &createResponse)
-	if err != nil {
-		log.Error("could not decode create JSON", err)
-		return err
+	// Lines after the first removed one move up by however many lines the removed records spanned
+	firstRemoved := records[0].LineIndex
+	removed := map[int]bool{}
+	for _, record := range records {
+		removed[record.LineIndex] = true
+		if record.LineIndex < firstRemoved {
+			firstRemoved = record.LineIndex
+		}
 	}
+	c.updateSnapshot(serial, newSerial, func(zoneRecords []cpanelZoneRecord) []cpanelZoneRecord {
+		var kept []cpanelZoneRecord
+		for _, record := range zoneRecords {
+			if removed[record.LineIndex] {
+				continue
+			}
+			if record.LineIndex > firstRemoved {
+				record.LineIndex = unknownLineIndex
+			}
+			kept = append(kept, record)
+		}
+		return kept
+	})
+	return nil
+}
 
-	if len(createResponse.Errors) > 0 {
-		log.Errorf("create JSON reported errors: %+v", createResponse.Errors)
-		return errors.New("create JSON reported errors")
+// Send the edits (as query parameters) to mass_edit_zone, recording the changes in the audit log whatever happens.
+// It returns the zone's new serial, if CPanel gave it. Nothing is sent once ctx, the zone lock's, is cancelled.
+func (c *CpanelClient) massEditZone(ctx context.Context, serial string, edits string, action string, changes []AuditChange) (string, error) {
+	if ctx.Err() != nil {
+		return "", newError(ReasonZoneLockFailed, fmt.Sprintf("lost the lock on zone %s before changing it: %s", c.getDnsZoneNoDot(), context.Cause(ctx)))
 	}
+	path := "/execute/DNS/mass_edit_zone?zone=" + c.getDnsZoneNoDot() + "&serial=" + serial + edits
+	log.Debugf("Using path to %s: %s", action, path)
 
-	return nil
+	var response cpanelMassEditResponse
+	err := c.doRequestContext(ctx, path, action, &response)
+	c.audit(action, changes, serial, response.Data.NewSerial.String(), err)
+	return response.Data.NewSerial.String(), err
 }
 
-func (c *CpanelClient) deleteZoneRecord(serial string, recordLineNo int) error {
-	url := c.CpanelUrl + "/execute/DNS/mass_edit_zone?zone=" + c.getDnsZoneNoDot() + "&serial=" + serial + "&remove=" + strconv.Itoa(recordLineNo)
-	log.Debugf("Using URL to delete: %s", url)
+// Send an authenticated request for the path (and query) to CPanel and decode the JSON response into the given
+// response, failing over between endpoints if the client has several.
+// The action is used to give context in logs and errors, e.g. "zone" or "create".
+func (c *CpanelClient) doRequest(path string, action string, response cpanelErrorer) error {
+	return c.doRequestContext(context.Background(), path, action, response)
+}
 
-	req, err := http.NewRequest("GET", url, nil)
+// As doRequest, abandoning the request once ctx is cancelled.
+func (c *CpanelClient) doRequestContext(ctx context.Context, path string, action string, response cpanelErrorer) error {
+	if c.Failover == nil {
+		return c.doRequestTo(ctx, c.CpanelUrl, path, action, response)
+	}
+	return c.Failover.try(func(baseUrl string) error {
+		return c.doRequestTo(ctx, baseUrl, path, action, response)
+	})
+}
+
+func (c *CpanelClient) doRequestTo(ctx context.Context, baseUrl string, path string, action string, response cpanelErrorer) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseUrl+path, nil)
 	if err != nil {
-		log.Error("zone delete HTTP request error", err)
+		log.Errorf("%s HTTP request error: %s", action, err)
 		return err
 	}
-
 	c.addRequestAuth(req)
 
 	resp, err := c.httpClient.Do(req)
+	if err != nil && ctx.Err() != nil {
+		// Abandoned rather than unreachable, so not to be tried elsewhere
+		log.Errorf("%s HTTP request abandoned: %s", action, context.Cause(ctx))
+		return fmt.Errorf("%s request abandoned: %w", action, context.Cause(ctx))
+	}
 	if err != nil {
-		log.Error("zone delete HTTP response error", err)
-		return err
+		log.Errorf("%s HTTP response error: %s", action, err)
+		return &unreachableError{err: err}
 	}
 	defer resp.Body.Close()
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error("zone delete HTTP response read error", err)
-		return err
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		log.Errorf("%s HTTP response had status %d", action, resp.StatusCode)
+		return newError(ReasonAuthenticationFailed, fmt.Sprintf("cPanel rejected credentials with HTTP status %d", resp.StatusCode))
 	}
 
-	var createResponse cpanelResponse
-	err = json.Unmarshal(bodyBytes, &createResponse)
+	// Bad credentials don't always give an error status, CPanel may instead send us its HTML login page
+	body := bufio.NewReader(resp.Body)
+	if isHtml(resp, body) {
+		log.Errorf("%s HTTP response was HTML rather than JSON, assuming a login page", action)
+		return newError(ReasonAuthenticationFailed, "cPanel returned login page")
+	}
+
+	// Decode from the body as it's read rather than reading it all first, as zones can be large
+	decoder := json.NewDecoder(body)
+	if streamed, ok := response.(streamDecoder); ok {
+		err = streamed.decodeFrom(decoder)
+	} else {
+		err = decoder.Decode(response)
+	}
 	if err != nil {
-		log.Error("could not decode delete JSON", err)
+		log.Errorf("could not decode %s JSON: %s", action, err)
 		return err
 	}
 
-	if len(createResponse.Errors) > 0 {
-		log.Errorf("delete JSON reported errors: %+v", createResponse.Errors)
-		return errors.New("delete JSON reported errors")
+	if errs := response.errors(); len(errs) > 0 {
+		log.Errorf("%s JSON reported errors: %+v", action, errs)
+		return classifyErrors(action, errs)
 	}
 
 	return nil
@@ -254,14 +467,17 @@ func (c *CpanelClient) deleteZoneRecord(serial string, recordLineNo int) error {
 func (c *CpanelClient) getDnsSubdomainOnly(recordName string) string {
 	// recordName will be in the form 'my-subdomain.my-domain.com.'
 	// We need to strip out the zone ('.my-domain.com.') from it.
-	recordNameSub := strings.TrimSuffix(recordName, "."+c.DnsZone)
+	if !strings.HasSuffix(recordName, ".") {
+		recordName += "."
+	}
+	recordNameSub := relativeName(recordName, c.DnsZone)
 	log.Debugf("Calculated record name '%s' for zone '%s'", recordNameSub, c.DnsZone)
 	return recordNameSub
 }
 
 func (c *CpanelClient) getDnsZoneNoDot() string {
 	// CPanel API expects zone of 'my-domain.com', not 'my-domain.com.'
-	return strings.TrimSuffix(c.DnsZone, ".")
+	return strings.TrimSuffix(CanonicalName(c.DnsZone), ".")
 }
 
 // Add either Basic auth for username/password or CPanel's own API Token mechanism
@@ -279,15 +495,26 @@ func (c *CpanelClient) addRequestAuth(req *http.Request) {
 // Utils
 // ----
 
-// Get the SOA serial needed for mutating DNS zones.
-func getZoneSerial(zone *cpanelZoneResponse) string {
+// Get the SOA serial needed for mutating DNS zones, which a zone without one (however unlikely) can't be.
+func getZoneSerial(zone *cpanelZoneResponse) (string, error) {
 	for _, record := range zone.Data {
 		if record.RecordType == typeSoa {
-			return record.Data[soaSerialIndex]
+			if len(record.Data) <= soaSerialIndex {
+				return "", fmt.Errorf("SOA record has only %d fields, so no serial", len(record.Data))
+			}
+			return record.Data[soaSerialIndex], nil
 		}
 	}
+	return "", errors.New("zone has no SOA record")
+}
 
-	return "" // Not found!
+// Whether the response is HTML, from its Content-Type or else by peeking at the start of the body.
+func isHtml(resp *http.Response, body *bufio.Reader) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return true
+	}
+	start, _ := body.Peek(htmlPeekSize)
+	return bytes.HasPrefix(bytes.TrimSpace(start), []byte("<"))
 }
 
 func decode(b64 string) string {
@@ -310,11 +537,23 @@ const typeTxt recordType = "TXT"
 
 const soaSerialIndex = 2
 
+// How much of a response is looked at to tell whether it's HTML
+const htmlPeekSize = 512
+
 type cpanelResponse struct {
 	Errors []string `json:"errors"`
 	Status int      `json:"status"`
 }
 
+func (r *cpanelResponse) errors() []string {
+	return r.Errors
+}
+
+// Implemented by all responses via the embedded cpanelResponse
+type cpanelErrorer interface {
+	errors() []string
+}
+
 // https://api.docs.cpanel.net/openapi/cpanel/operation/dns-parse_zone/
 type cpanelZoneResponse struct {
 	cpanelResponse
@@ -337,9 +576,21 @@ type cpanelZoneRecord struct {
 }
 
 // https://api.docs.cpanel.net/openapi/cpanel/operation/dns-mass_edit_zone/
+type cpanelMassEditResponse struct {
+	cpanelResponse
+	Data struct {
+		NewSerial json.Number `json:"new_serial"`
+	} `json:"data"`
+}
+
 type cpanelZoneRecordAdd struct {
 	Dname      string     `json:"dname"`
 	TTL        int        `json:"ttl"`
 	RecordType recordType `json:"record_type"`
 	Data       []string   `json:"data"`
 }
+
+type cpanelZoneRecordEdit struct {
+	LineIndex int `json:"line_index"`
+	cpanelZoneRecordAdd
+}
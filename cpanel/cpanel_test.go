@@ -2,9 +2,17 @@ package cpanel
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -270,3 +278,985 @@ func TestCleanupNoDelete(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, expectedApiTokenAuthorization, mockClient.requests[0].Header["Authorization"][0])
 }
+
+const soaOnlyZone = `{
+	"data": [
+		{
+			"line_index": 3,
+			"type": "record",
+			"data_b64": [
+				"bnMxLnN0YWJsZWhvc3QuY29tLg==",
+				"YWxlcnRzLnN0YWJsZWhvc3QuY29tLg==",
+				"MjAyMjA0MDUwNQ==",
+				"ODY0MDA=",
+				"NzIwMA==",
+				"MzYwMDAwMA==",
+				"MTgwMA=="
+			],
+			"dname_b64": "amFtZXNsYWtpbi5jby51ay4=",
+			"record_type": "SOA",
+			"ttl": 86400
+		}
+	]
+}`
+
+func TestPresentLoginPage(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			`<!DOCTYPE html><html><head><title>cPanel Login</title></head></html>`,
+		},
+	}
+	client := NewClientWithMock(&mockClient, false)
+
+	err := client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.EqualError(t, err, "cPanel returned login page")
+	assert.Equal(t, ReasonAuthenticationFailed, ErrorReason(err))
+}
+
+func TestPresentZoneNotFound(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			`{"errors": ["You do not have access to a domain named “test-domain.com”."], "status": 0}`,
+		},
+	}
+	client := NewClientWithMock(&mockClient, false)
+
+	err := client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.Error(t, err)
+	assert.Equal(t, ReasonZoneNotFound, ErrorReason(err))
+}
+
+func TestPresentTruncatedSoa(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{`{
+			"data": [
+				{
+					"line_index": 3,
+					"type": "record",
+					"data_b64": ["bnMxLnN0YWJsZWhvc3QuY29tLg==", "YWxlcnRzLnN0YWJsZWhvc3QuY29tLg=="],
+					"dname_b64": "amFtZXNsYWtpbi5jby51ay4=",
+					"record_type": "SOA",
+					"ttl": 86400
+				}
+			]
+		}`},
+	}
+	client := NewClientWithMock(&mockClient, false)
+
+	// Rather than panicking, or sending the change without a serial
+	err := client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.EqualError(t, err, "SOA record has only 2 fields, so no serial")
+	assert.Len(t, mockClient.requests, 1)
+}
+
+func TestClassifyErrors(t *testing.T) {
+	for message, reason := range map[string]string{
+		"The given serial number (2022040505) does not match the DNS zone’s serial number (2022040506).": ReasonSerialConflict,
+		"The given serial number (2022040505) does not match the DNS zone's serial number (2022040506)":  ReasonSerialConflict,
+		"You do not have access to a domain named “test-domain.com”.":                                    ReasonZoneNotFound,
+		// Mentioning the serial isn't enough to be retried
+		"Invalid serial number: abc":                                     ReasonRequestFailed,
+		"The zone file could not be saved, its SOA serial is unchanged.": ReasonRequestFailed,
+	} {
+		assert.Equal(t, reason, classifyErrors("create", []string{message}).Reason, message)
+	}
+}
+
+func TestPresentRetriesSerialConflict(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			soaOnlyZone,
+			`{"errors": ["The given serial number (2022040505) does not match the DNS zone’s serial number (2022040506)."], "status": 0}`,
+			soaOnlyZone,
+			`{}`,
+		},
+	}
+	client := NewClientWithMock(&mockClient, false)
+	var notified []string
+	client.Notify = func(reason string, message string) {
+		notified = append(notified, reason)
+	}
+
+	err := client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+
+	// Zone and create, twice over
+	assert.Len(t, mockClient.requests, 4)
+	assert.Equal(t, []string{ReasonSerialConflictRetried}, notified)
+}
+
+// SOA serial of 2022040505.
+// TXT record of dummy/test-value-other, line 17, TTL 14400
+const otherTxtZone = `{
+	"data": [
+		{
+			"line_index": 3,
+			"type": "record",
+			"data_b64": [
+				"bnMxLnN0YWJsZWhvc3QuY29tLg==",
+				"YWxlcnRzLnN0YWJsZWhvc3QuY29tLg==",
+				"MjAyMjA0MDUwNQ==",
+				"ODY0MDA=",
+				"NzIwMA==",
+				"MzYwMDAwMA==",
+				"MTgwMA=="
+			],
+			"dname_b64": "amFtZXNsYWtpbi5jby51ay4=",
+			"record_type": "SOA",
+			"ttl": 86400
+		},
+		{
+			"line_index": 17,
+			"type": "record",
+			"data_b64": [
+				"dGVzdC12YWx1ZS1vdGhlcg=="
+			],
+			"dname_b64": "ZHVtbXk=",
+			"record_type": "TXT",
+			"ttl": 14400
+		}
+	]
+}`
+
+func TestPresentTtlPolicy(t *testing.T) {
+	// Adopting the existing TTL is the default
+	mockClient := DummyHttp{responseBodies: []string{otherTxtZone, `{}`}}
+	client := NewClientWithMock(&mockClient, false)
+	client.TtlPolicy = TtlPolicy{Ttl: 60, MaxTtl: 300}
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.Contains(t, mockClient.requests[1].URL.RawQuery, "%22ttl%22%3A14400")
+
+	// Rewriting changes the existing record in the same request
+	mockClient = DummyHttp{responseBodies: []string{otherTxtZone, `{}`}}
+	client = NewClientWithMock(&mockClient, false)
+	client.TtlPolicy = TtlPolicy{Ttl: 60, MaxTtl: 300, Conflict: TtlConflictRewrite}
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	expectedCreateUrl := `https://cpanel.test-domain.com/execute/DNS/mass_edit_zone?zone=test-domain.com&serial=2022040505` +
+		`&add=%7B%22dname%22%3A%22dummy%22%2C%22ttl%22%3A60%2C%22record_type%22%3A%22TXT%22%2C%22data%22%3A%5B%22test-value%22%5D%7D` +
+		`&edit=%7B%22line_index%22%3A17%2C%22dname%22%3A%22dummy%22%2C%22ttl%22%3A60%2C%22record_type%22%3A%22TXT%22%2C%22data%22%3A%5B%22test-value-other%22%5D%7D`
+	assert.Equal(t, expectedCreateUrl, mockClient.requests[1].URL.String())
+
+	// Failing doesn't touch the zone
+	mockClient = DummyHttp{responseBodies: []string{otherTxtZone}}
+	client = NewClientWithMock(&mockClient, false)
+	client.TtlPolicy = TtlPolicy{MinTtl: 30, MaxTtl: 300, Conflict: TtlConflictFail}
+	err := client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.EqualError(t, err, "existing records have TTL 14400, outside of the allowed 30 to 300")
+	assert.Equal(t, ReasonTtlConflict, ErrorReason(err))
+	assert.Len(t, mockClient.requests, 1)
+
+	// A new name gets the policy's TTL
+	mockClient = DummyHttp{responseBodies: []string{soaOnlyZone, `{}`}}
+	client = NewClientWithMock(&mockClient, false)
+	client.TtlPolicy = TtlPolicy{Ttl: 60}
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.Contains(t, mockClient.requests[1].URL.RawQuery, "%22ttl%22%3A60")
+}
+
+func TestMarkerOwnership(t *testing.T) {
+	ownership := &MarkerOwnership{Owner: "test-owner"}
+
+	// Creating a record also creates its marker, which has the same TTL whatever the record's
+	mockClient := DummyHttp{responseBodies: []string{soaOnlyZone, `{}`}}
+	client := NewClientWithMock(&mockClient, false)
+	client.TtlPolicy = TtlPolicy{Ttl: 60}
+	client.Ownership = ownership
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	query := mockClient.requests[1].URL.Query()
+	assert.Equal(t, []string{
+		`{"dname":"dummy","ttl":60,"record_type":"TXT","data":["test-value"]}`,
+		`{"dname":"_cpanel-webhook-owner.dummy","ttl":300,"record_type":"TXT","data":["owner=test-owner;value-sha256=` + HashValue("test-value") + `"]}`,
+	}, query["add"])
+
+	// Only the marked record (and its marker) is deleted
+	zoneRecords := []TxtRecord{
+		{Name: "dummy", Value: "test-value", LineIndex: 17},
+		{Name: "dummy", Value: "test-value-other", LineIndex: 18},
+		{Name: "_cpanel-webhook-owner.dummy", Value: "owner=test-owner;value-sha256=" + HashValue("test-value"), LineIndex: 19},
+	}
+	owned, err := ownership.Owned("test-domain.com", zoneRecords, zoneRecords[:2])
+	assert.NoError(t, err)
+	assert.Equal(t, []TxtRecord{zoneRecords[0], zoneRecords[2]}, owned)
+
+	// Another owner's markers don't count
+	other := &MarkerOwnership{Owner: "other-owner"}
+	owned, err = other.Owned("test-domain.com", zoneRecords, zoneRecords[:2])
+	assert.NoError(t, err)
+	assert.Empty(t, owned)
+}
+
+// SOA serial of 2022040505, with the TXT record dummy/test-value duplicated at the given line and the one after it,
+// then dummy/test-value-other.
+func duplicateTxtZone(firstLine int) string {
+	return fmt.Sprintf(`{
+	"data": [
+		{
+			"line_index": 3,
+			"type": "record",
+			"data_b64": [
+				"bnMxLnN0YWJsZWhvc3QuY29tLg==",
+				"YWxlcnRzLnN0YWJsZWhvc3QuY29tLg==",
+				"MjAyMjA0MDUwNQ==",
+				"ODY0MDA=",
+				"NzIwMA==",
+				"MzYwMDAwMA==",
+				"MTgwMA=="
+			],
+			"dname_b64": "amFtZXNsYWtpbi5jby51ay4=",
+			"record_type": "SOA",
+			"ttl": 86400
+		},
+		{"line_index": %d, "type": "record", "data_b64": ["dGVzdC12YWx1ZQ=="], "dname_b64": "ZHVtbXk=", "record_type": "TXT", "ttl": 300},
+		{"line_index": %d, "type": "record", "data_b64": ["dGVzdC12YWx1ZQ=="], "dname_b64": "ZHVtbXk=", "record_type": "TXT", "ttl": 300},
+		{"line_index": %d, "type": "record", "data_b64": ["dGVzdC12YWx1ZS1vdGhlcg=="], "dname_b64": "ZHVtbXk=", "record_type": "TXT", "ttl": 300}
+	]
+}`, firstLine, firstLine+1, firstLine+2)
+}
+
+func TestCleanupDeletesDuplicates(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			duplicateTxtZone(17),
+			`{"errors": ["The given serial number (2022040505) does not match the DNS zone’s serial number (2022040506)."], "status": 0}`,
+			// Something else removed a record in between, shifting the line indexes
+			duplicateTxtZone(16),
+			`{}`,
+		},
+	}
+	client := NewClientWithMock(&mockClient, false)
+	var notified []string
+	client.Notify = func(reason string, message string) {
+		notified = append(notified, reason)
+	}
+
+	err := client.ClearDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+
+	assert.Len(t, mockClient.requests, 4)
+	assert.Equal(t, `https://cpanel.test-domain.com/execute/DNS/mass_edit_zone?zone=test-domain.com&serial=2022040505&remove=17&remove=18`, mockClient.requests[1].URL.String())
+	assert.Equal(t, `https://cpanel.test-domain.com/execute/DNS/mass_edit_zone?zone=test-domain.com&serial=2022040505&remove=16&remove=17`, mockClient.requests[3].URL.String())
+	assert.Equal(t, []string{ReasonSerialConflictRetried, ReasonDuplicatesRemoved}, notified)
+}
+
+func TestCleanupDeletesMarkedDuplicates(t *testing.T) {
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	marker := encode("owner=test-owner;value-sha256=" + HashValue("test-value"))
+	zone := fmt.Sprintf(`{"data": [
+		{"line_index": 3, "type": "record", "data_b64": ["bnMxLnN0YWJsZWhvc3QuY29tLg==", "YWxlcnRzLnN0YWJsZWhvc3QuY29tLg==", "MjAyMjA0MDUwNQ==", "ODY0MDA=", "NzIwMA==", "MzYwMDAwMA==", "MTgwMA=="], "dname_b64": "amFtZXNsYWtpbi5jby51ay4=", "record_type": "SOA", "ttl": 86400},
+		{"line_index": 17, "type": "record", "data_b64": ["dGVzdC12YWx1ZQ=="], "dname_b64": "ZHVtbXk=", "record_type": "TXT", "ttl": 300},
+		{"line_index": 18, "type": "record", "data_b64": [%[1]q], "dname_b64": %[2]q, "record_type": "TXT", "ttl": 300},
+		{"line_index": 19, "type": "record", "data_b64": ["dGVzdC12YWx1ZQ=="], "dname_b64": "ZHVtbXk=", "record_type": "TXT", "ttl": 300},
+		{"line_index": 20, "type": "record", "data_b64": [%[1]q], "dname_b64": %[2]q, "record_type": "TXT", "ttl": 300}
+	]}`, marker, encode("_cpanel-webhook-owner.dummy"))
+	mockClient := DummyHttp{responseBodies: []string{zone, `{}`}}
+	client := NewClientWithMock(&mockClient, false)
+	client.Ownership = &MarkerOwnership{Owner: "test-owner"}
+	var notified []string
+	client.Notify = func(reason string, message string) {
+		notified = append(notified, message)
+	}
+
+	// Each duplicate is deleted along with a marker of its own
+	assert.NoError(t, client.ClearDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.Equal(t, []string{"17", "18", "19", "20"}, mockClient.requests[1].URL.Query()["remove"])
+	assert.Equal(t, []string{"Deleted 2 duplicate TXT records for dummy.test-domain.com."}, notified)
+}
+
+func TestPlan(t *testing.T) {
+	// Adding goes by the TTL policy and ownership, as creating the record would
+	mockClient := DummyHttp{responseBodies: []string{otherTxtZone}}
+	client := NewClientWithMock(&mockClient, false)
+	client.TtlPolicy = TtlPolicy{Ttl: 60, MaxTtl: 300, Conflict: TtlConflictRewrite}
+	client.Ownership = &MarkerOwnership{Owner: "test-owner"}
+	changes, err := client.PlanSetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+	assert.Equal(t, []PlannedChange{
+		{Change: "add", Name: "dummy", Value: "test-value", TTL: 60},
+		{Change: "add", Name: "_cpanel-webhook-owner.dummy", Value: "owner=test-owner;value-sha256=" + HashValue("test-value"), TTL: MarkerTtl},
+		{Change: "edit", Name: "dummy", Value: "test-value-other", TTL: 60},
+	}, changes)
+	assert.Len(t, mockClient.requests, 1)
+
+	// A record that's already there needs nothing
+	mockClient = DummyHttp{responseBodies: []string{txtZone("dGVzdC12YWx1ZQ==")}}
+	client = NewClientWithMock(&mockClient, false)
+	changes, err = client.PlanSetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	mockClient = DummyHttp{responseBodies: []string{txtZone("dGVzdC12YWx1ZQ==")}}
+	client = NewClientWithMock(&mockClient, false)
+	changes, err = client.PlanClearDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+	assert.Equal(t, []PlannedChange{{Change: "remove", Name: "dummy", Value: "test-value", TTL: 300}}, changes)
+	assert.Len(t, mockClient.requests, 1)
+
+	// Records without an ownership marker are left alone
+	mockClient = DummyHttp{responseBodies: []string{txtZone("dGVzdC12YWx1ZQ==")}}
+	client = NewClientWithMock(&mockClient, false)
+	client.Ownership = &MarkerOwnership{Owner: "test-owner"}
+	changes, err = client.PlanClearDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// Planning only reads the zone, so neither locks it nor keeps a snapshot for changes to be made from
+	mockClient = DummyHttp{responseBodies: []string{otherTxtZone, otherTxtZone}}
+	client = NewClientWithMock(&mockClient, false)
+	locker := &recordingLocker{}
+	client.Locker = locker
+	client.Cache = NewZoneCache(time.Minute)
+	_, err = client.PlanSetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+	_, err = client.PlanClearDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+	assert.Empty(t, locker.calls)
+	assert.Empty(t, client.Cache.snapshots)
+}
+
+// A parse_zone payload with the SOA of soaOnlyZone and a TXT record 'dummy' at line 17 with the given data_b64.
+func txtZone(dataB64 ...string) string {
+	data, _ := json.Marshal(dataB64)
+	return fmt.Sprintf(`{
+	"data": [
+		{
+			"line_index": 3,
+			"type": "record",
+			"data_b64": ["bnMxLnN0YWJsZWhvc3QuY29tLg==", "YWxlcnRzLnN0YWJsZWhvc3QuY29tLg==", "MjAyMjA0MDUwNQ==", "ODY0MDA=", "NzIwMA==", "MzYwMDAwMA==", "MTgwMA=="],
+			"dname_b64": "amFtZXNsYWtpbi5jby51ay4=",
+			"record_type": "SOA",
+			"ttl": 86400
+		},
+		{"line_index": 17, "type": "record", "data_b64": %s, "dname_b64": "ZHVtbXk=", "record_type": "TXT", "ttl": 300}
+	]
+}`, data)
+}
+
+func TestTxtRecordData(t *testing.T) {
+	longValue := strings.Repeat("a", 255) + strings.Repeat("b", 45)
+	tests := []struct {
+		name     string
+		dataB64  []string
+		expected string
+	}{
+		{
+			name:     "single string",
+			dataB64:  []string{"dGVzdC12YWx1ZQ=="}, // test-value
+			expected: "test-value",
+		},
+		{
+			name:     "several strings",
+			dataB64:  []string{base64.StdEncoding.EncodeToString([]byte(longValue[:255])), base64.StdEncoding.EncodeToString([]byte(longValue[255:]))},
+			expected: longValue,
+		},
+		{
+			name:     "quoted strings",
+			dataB64:  []string{"InRlc3QtIiAgInZhbHVlIg=="}, // "test-"  "value"
+			expected: "test-value",
+		},
+		{
+			name:     "escaped quote and byte",
+			dataB64:  []string{"InY9REtJTTE7IHA9XCJhXDA1OWIi"}, // "v=DKIM1; p=\"a\059b"
+			expected: `v=DKIM1; p="a;b`,
+		},
+		{
+			name:     "unterminated quote taken as it is",
+			dataB64:  []string{"InRlc3QtdmFsdWU="}, // "test-value
+			expected: `"test-value`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockClient := DummyHttp{responseBodies: []string{txtZone(test.dataB64...)}}
+			client := NewClientWithMock(&mockClient, false)
+
+			records, err := client.ListTxtRecords()
+			assert.NoError(t, err)
+			assert.Equal(t, []TxtRecord{{Name: "dummy", Value: test.expected, TTL: 300, LineIndex: 17}}, records)
+		})
+	}
+}
+
+func TestLongTxtValue(t *testing.T) {
+	longValue := strings.Repeat("a", 255) + strings.Repeat("é", 30)
+	mockClient := DummyHttp{responseBodies: []string{soaOnlyZone, `{}`}}
+	client := NewClientWithMock(&mockClient, false)
+
+	err := client.SetDnsTxt("dummy.test-domain.com.", longValue)
+	assert.NoError(t, err)
+	add := mockClient.requests[1].URL.Query().Get("add")
+	assert.JSONEq(t, fmt.Sprintf(`{"dname": "dummy", "ttl": 300, "record_type": "TXT", "data": [%q, %q]}`, strings.Repeat("a", 255), strings.Repeat("é", 30)), add)
+
+	// Once split the record is still found, both to not create it again and to clean it up
+	chunks := []string{base64.StdEncoding.EncodeToString([]byte(longValue[:255])), base64.StdEncoding.EncodeToString([]byte(longValue[255:]))}
+	mockClient = DummyHttp{responseBodies: []string{txtZone(chunks...)}}
+	client = NewClientWithMock(&mockClient, false)
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", longValue))
+	assert.Len(t, mockClient.requests, 1)
+
+	mockClient = DummyHttp{responseBodies: []string{txtZone(chunks...), `{}`}}
+	client = NewClientWithMock(&mockClient, false)
+	assert.NoError(t, client.ClearDnsTxt("dummy.test-domain.com.", longValue))
+	assert.Equal(t, "17", mockClient.requests[1].URL.Query().Get("remove"))
+}
+
+func TestSplitTxtValue(t *testing.T) {
+	assert.Equal(t, []string{""}, splitTxtValue(""))
+	assert.Equal(t, []string{strings.Repeat("a", 255)}, splitTxtValue(strings.Repeat("a", 255)))
+
+	// A two byte character straddling the limit moves to the next string
+	chunks := splitTxtValue(strings.Repeat("a", 254) + "é")
+	assert.Equal(t, []string{strings.Repeat("a", 254), "é"}, chunks)
+}
+
+// parse_zone.json is a parse_zone response in the form cPanel returns it, with comment and control lines, a value
+// split over character-strings, values in zone file quoted form and multi-byte values split mid-character.
+func TestParseZonePayload(t *testing.T) {
+	payload, err := os.ReadFile("testdata/parse_zone.json")
+	assert.NoError(t, err)
+	dkim := "v=DKIM1; k=rsa; p=" + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA", 7)
+	unicode := strings.Repeat("défi-✓-", 40)
+
+	mockClient := DummyHttp{responseBodies: []string{string(payload)}}
+	client := NewClientWithMock(&mockClient, false)
+	records, err := client.ListTxtRecords()
+	assert.NoError(t, err)
+	assert.Equal(t, []TxtRecord{
+		{Name: "@", Value: "v=spf1 +a +mx +ip4:192.0.2.10 ~all", TTL: 14400, LineIndex: 9},
+		{Name: "_acme-challenge", Value: "test-value", TTL: 300, LineIndex: 10},
+		{Name: "default._domainkey", Value: dkim, TTL: 14400, LineIndex: 11},
+		{Name: "_dmarc", Value: "v=DMARC1; p=none; rua=mailto:dmarc@test-domain.com", TTL: 14400, LineIndex: 12},
+		{Name: "quoted", Value: `semi;colon "quoted" back\slash`, TTL: 14400, LineIndex: 13},
+		{Name: "_acme-challenge.unicode", Value: unicode, TTL: 300, LineIndex: 14},
+		{Name: "_acme-challenge.www", Value: "ünïcödé ✓", TTL: 300, LineIndex: 15},
+	}, records)
+
+	tests := []struct {
+		name      string
+		value     string
+		lineIndex string
+	}{
+		{name: "_acme-challenge.test-domain.com.", value: "test-value", lineIndex: "10"},
+		{name: "default._domainkey.test-domain.com.", value: dkim, lineIndex: "11"},
+		{name: "_dmarc.test-domain.com.", value: "v=DMARC1; p=none; rua=mailto:dmarc@test-domain.com", lineIndex: "12"},
+		{name: "_acme-challenge.unicode.test-domain.com.", value: unicode, lineIndex: "14"},
+		{name: "_acme-challenge.www.test-domain.com.", value: "ünïcödé ✓", lineIndex: "15"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Already there, so not created again
+			mockClient := DummyHttp{responseBodies: []string{string(payload)}}
+			client := NewClientWithMock(&mockClient, false)
+			assert.NoError(t, client.SetDnsTxt(test.name, test.value))
+			assert.Len(t, mockClient.requests, 1)
+
+			// And removed by its own line only
+			mockClient = DummyHttp{responseBodies: []string{string(payload), `{}`}}
+			client = NewClientWithMock(&mockClient, false)
+			assert.NoError(t, client.ClearDnsTxt(test.name, test.value))
+			assert.Len(t, mockClient.requests, 2)
+			assert.Equal(t, test.lineIndex, mockClient.requests[1].URL.Query().Get("remove"))
+			assert.Equal(t, "2022040505", mockClient.requests[1].URL.Query().Get("serial"))
+		})
+	}
+}
+
+func TestRelativeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		zone     string
+		expected string
+	}{
+		{name: "_acme-challenge.www.test-domain.com.", zone: "test-domain.com.", expected: "_acme-challenge.www"},
+		{name: "_ACME-Challenge.Test-Domain.COM.", zone: "test-domain.com.", expected: "_acme-challenge"},
+		{name: "_acme-challenge.www", zone: "test-domain.com.", expected: "_acme-challenge.www"},
+		{name: "test-domain.com.", zone: "Test-Domain.com", expected: "@"},
+		{name: "@", zone: "test-domain.com.", expected: "@"},
+		{name: "*.test-domain.com.", zone: "test-domain.com.", expected: "*"},
+		{name: "_acme-challenge.bücher.test-domain.com.", zone: "test-domain.com.", expected: "_acme-challenge.xn--bcher-kva"},
+		{name: "_acme-challenge.xn--bcher-kva.de.", zone: "Bücher.de.", expected: "_acme-challenge"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, relativeName(test.name, test.zone))
+		})
+	}
+}
+
+func TestPresentMatchesNormalisedNames(t *testing.T) {
+	// parse_zone gives the apex as an absolute name, which must be matched to the challenge for the apex itself
+	apexZone := strings.Replace(txtZone("dGVzdC12YWx1ZQ=="), `"dname_b64": "ZHVtbXk="`, `"dname_b64": "VGVzdC1Eb21haW4uY29tLg=="`, 1) // Test-Domain.com.
+	mockClient := DummyHttp{responseBodies: []string{apexZone}}
+	client := NewClientWithMock(&mockClient, false)
+	assert.NoError(t, client.SetDnsTxt("TEST-DOMAIN.COM.", "test-value"))
+	assert.Len(t, mockClient.requests, 1)
+
+	// New apex records are created with the absolute name, and IDNs in punycode
+	mockClient = DummyHttp{responseBodies: []string{soaOnlyZone, `{}`}}
+	client = NewClientWithMock(&mockClient, false)
+	client.DnsZone = "bücher.de."
+	assert.NoError(t, client.SetDnsTxt("Bücher.de.", "test-value"))
+	assert.Equal(t, "https://cpanel.test-domain.com/execute/DNS/parse_zone?zone=xn--bcher-kva.de", mockClient.requests[0].URL.String())
+	assert.JSONEq(t, `{"dname": "xn--bcher-kva.de.", "ttl": 300, "record_type": "TXT", "data": ["test-value"]}`, mockClient.requests[1].URL.Query().Get("add"))
+}
+
+// Fails to connect to the hosts that are down, otherwise answering with the mock.
+type unreachableHosts struct {
+	mock *DummyHttp
+	down map[string]bool
+	hits []string
+}
+
+func (u *unreachableHosts) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.hits = append(u.hits, req.URL.Host)
+	if u.down[req.URL.Host] {
+		return nil, errors.New("connection refused")
+	}
+	return u.mock.RoundTrip(req)
+}
+
+func TestFailover(t *testing.T) {
+	mockClient := DummyHttp{responseBodies: []string{soaOnlyZone, `{}`, soaOnlyZone, `{}`}}
+	transport := &unreachableHosts{mock: &mockClient, down: map[string]bool{"cpanel.test-domain.com": true}}
+	client := NewClientWithMock(&mockClient, false)
+	client.httpClient.Transport = transport
+
+	probed := make(chan string, 10)
+	failover := NewFailover([]string{"https://cpanel.test-domain.com", "https://server123.host.test:2083"})
+	failover.ProbeInterval = time.Millisecond
+	failover.probe = func(url string) error {
+		probed <- url
+		return errors.New("still down")
+	}
+	client.Failover = failover
+
+	err := client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpanel.test-domain.com", "server123.host.test:2083", "server123.host.test:2083"}, transport.hits)
+	assert.Equal(t, "https://server123.host.test:2083", failover.Current())
+	assert.Equal(t, "https://cpanel.test-domain.com", <-probed)
+
+	// Once the preferred endpoint is back it's used again
+	failover.mutex.Lock()
+	failover.probe = func(url string) error {
+		return nil
+	}
+	failover.mutex.Unlock()
+	assert.Eventually(t, func() bool {
+		return failover.Current() == "https://cpanel.test-domain.com"
+	}, time.Second, time.Millisecond)
+
+	transport.hits = nil
+	delete(transport.down, "cpanel.test-domain.com")
+	err = client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpanel.test-domain.com", "cpanel.test-domain.com"}, transport.hits)
+}
+
+func TestFailoverOnlyOnUnreachable(t *testing.T) {
+	mockClient := DummyHttp{responseBodies: []string{`<html>Login</html>`}}
+	client := NewClientWithMock(&mockClient, false)
+	client.Failover = NewFailover([]string{"https://cpanel.test-domain.com", "https://server123.host.test:2083"})
+
+	// Rejected credentials would be rejected by every endpoint
+	err := client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.Equal(t, ReasonAuthenticationFailed, ErrorReason(err))
+	assert.Len(t, mockClient.requests, 1)
+	assert.Equal(t, "https://cpanel.test-domain.com", client.Failover.Current())
+}
+
+func TestFailoverClose(t *testing.T) {
+	mockClient := DummyHttp{responseBodies: []string{soaOnlyZone, `{}`}}
+	transport := &unreachableHosts{mock: &mockClient, down: map[string]bool{"cpanel.test-domain.com": true}}
+	client := NewClientWithMock(&mockClient, false)
+	client.httpClient.Transport = transport
+	client.Failover = NewFailover([]string{"https://cpanel.test-domain.com", "https://server123.host.test:2083"})
+	client.Failover.ProbeInterval = time.Hour
+
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	client.Failover.mutex.Lock()
+	assert.True(t, client.Failover.probing)
+	client.Failover.mutex.Unlock()
+
+	// Closing the client stops the probe, rather than it waiting out the interval and carrying on
+	client.Close()
+	assert.Eventually(t, func() bool {
+		client.Failover.mutex.Lock()
+		defer client.Failover.mutex.Unlock()
+		return !client.Failover.probing
+	}, time.Second, time.Millisecond)
+
+	client.Failover.markUnhealthy(0)
+	client.Failover.mutex.Lock()
+	assert.False(t, client.Failover.probing)
+	client.Failover.mutex.Unlock()
+}
+
+func TestClientRetire(t *testing.T) {
+	mockClient := DummyHttp{responseBodies: []string{soaOnlyZone, `{}`, soaOnlyZone, `{}`}}
+	transport := &unreachableHosts{mock: &mockClient, down: map[string]bool{"cpanel.test-domain.com": true}}
+	client := NewClientWithMock(&mockClient, false)
+	client.httpClient.Transport = transport
+	client.Failover = NewFailover([]string{"https://cpanel.test-domain.com", "https://server123.host.test:2083"})
+	client.Failover.ProbeInterval = time.Hour
+
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	client.Retire()
+	assert.Eventually(t, func() bool {
+		client.Failover.mutex.Lock()
+		defer client.Failover.mutex.Unlock()
+		return !client.Failover.probing
+	}, time.Second, time.Millisecond)
+
+	// A retired client can still finish what it's doing
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+}
+
+type recordingSink struct {
+	entries []AuditEntry
+}
+
+func (s *recordingSink) Write(entry AuditEntry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func TestAuditLog(t *testing.T) {
+	mockClient := DummyHttp{responseBodies: []string{
+		otherTxtZone,
+		`{"data": {"new_serial": "2022040506"}, "errors": null, "status": 1}`,
+		duplicateTxtZone(17),
+		`{"data": null, "errors": ["You do not have access to a domain named test-domain.com."], "status": 0}`,
+	}}
+	client := NewClientWithMock(&mockClient, false)
+	sink := &recordingSink{}
+	client.AuditSink = sink
+	client.AuditTrigger = func() *AuditTrigger {
+		return &AuditTrigger{Namespace: "default", Name: "test-challenge", UID: "1234"}
+	}
+	client.TtlPolicy = TtlPolicy{MaxTtl: 600, Conflict: TtlConflictRewrite}
+
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.Error(t, client.ClearDnsTxt("dummy.test-domain.com.", "test-value"))
+
+	if assert.Len(t, sink.entries, 2) {
+		created := sink.entries[0]
+		assert.False(t, created.Time.IsZero())
+		created.Time = time.Time{}
+		assert.Equal(t, AuditEntry{
+			Host:    "cpanel.test-domain.com",
+			Account: "user",
+			Zone:    "test-domain.com",
+			Action:  "create",
+			Changes: []AuditChange{
+				{Change: "add", Name: "dummy", ValueSha256: HashValue("test-value")},
+				{Change: "edit", Name: "dummy", ValueSha256: HashValue("test-value-other")},
+			},
+			SerialBefore: "2022040505",
+			SerialAfter:  "2022040506",
+			Trigger:      &AuditTrigger{Namespace: "default", Name: "test-challenge", UID: "1234"},
+			Result:       "success",
+		}, created)
+
+		deleted := sink.entries[1]
+		assert.Equal(t, "delete", deleted.Action)
+		assert.Equal(t, []AuditChange{
+			{Change: "remove", Name: "dummy", ValueSha256: HashValue("test-value")},
+			{Change: "remove", Name: "dummy", ValueSha256: HashValue("test-value")},
+		}, deleted.Changes)
+		assert.Equal(t, "", deleted.SerialAfter)
+		assert.Equal(t, "failure", deleted.Result)
+		assert.Equal(t, "delete JSON reported errors: You do not have access to a domain named test-domain.com.", deleted.Error)
+	}
+}
+
+func TestListDomains(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			`{"data": {"main_domain": "test-domain.com", "addon_domains": ["other-domain.com"], "parked_domains": [], "sub_domains": ["www.test-domain.com"]}, "errors": null, "status": 1}`,
+		},
+	}
+	client := NewClientWithMock(&mockClient, true)
+
+	domains, err := client.ListDomains()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test-domain.com", "other-domain.com"}, domains.Zones())
+	assert.Equal(t, []string{"www.test-domain.com"}, domains.Sub)
+	assert.Equal(t, "/execute/DomainInfo/list_domains", mockClient.requests[0].URL.Path)
+	assert.Equal(t, expectedApiTokenAuthorization, mockClient.requests[0].Header.Get("Authorization"))
+}
+
+func TestHasFeature(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			`{"data": null, "errors": null, "messages": ["The feature “zoneedit” exists and the user has access to it."], "status": 1}`,
+			`{"data": null, "errors": ["The user does not have access to the feature “zoneedit”."], "status": 0}`,
+			`<!DOCTYPE html><html><head><title>cPanel Login</title></head></html>`,
+		},
+	}
+	client := NewClientWithMock(&mockClient, false)
+
+	enabled, err := client.HasFeature("zoneedit")
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+	assert.Equal(t, "zoneedit", mockClient.requests[0].URL.Query().Get("name"))
+
+	enabled, err = client.HasFeature("zoneedit")
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	_, err = client.HasFeature("zoneedit")
+	assert.Equal(t, ReasonAuthenticationFailed, ErrorReason(err))
+}
+
+// recordingLocker records locking and unlocking zones, failing if told to and otherwise handing out ctx.
+type recordingLocker struct {
+	calls []string
+	err   error
+	ctx   context.Context
+}
+
+func (l *recordingLocker) LockZone(host string, account string, zone string) (context.Context, func(), error) {
+	if l.err != nil {
+		return nil, nil, l.err
+	}
+	key := host + "/" + account + "/" + zone
+	l.calls = append(l.calls, "lock "+key)
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return ctx, func() { l.calls = append(l.calls, "unlock "+key) }, nil
+}
+
+func TestZoneLocker(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			soaOnlyZone,
+			`{"data": {"new_serial": "2022040506"}, "errors": null, "status": 1}`,
+			`{"data": [{"line_index": 1, "type": "record", "record_type": "SOA", "dname_b64": "dGVzdC1kb21haW4uY29tLg==", "data_b64": ["bnMxLnRlc3QtZG9tYWluLmNvbS4=", "YWRtaW4udGVzdC1kb21haW4uY29tLg==", "MjAyMjA0MDUwNg==", "ODY0MDA=", "NzIwMA==", "MzYwMDAwMA==", "MTgwMA=="], "ttl": 86400}], "errors": null, "status": 1}`,
+		},
+	}
+	client := NewClientWithMock(&mockClient, false)
+	locker := &recordingLocker{}
+	client.Locker = locker
+
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.NoError(t, client.ClearDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.Equal(t, []string{
+		"lock cpanel.test-domain.com/user/test-domain.com", "unlock cpanel.test-domain.com/user/test-domain.com",
+		"lock cpanel.test-domain.com/user/test-domain.com", "unlock cpanel.test-domain.com/user/test-domain.com",
+	}, locker.calls)
+
+	// Nothing is changed without the lock
+	locker.err = errors.New("timed out")
+	err := client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.EqualError(t, err, "could not lock zone test-domain.com: timed out")
+	assert.Equal(t, ReasonZoneLockFailed, ErrorReason(err))
+	assert.Len(t, mockClient.requests, 3)
+
+	// Nor once the lock is lost
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errors.New("held by another replica"))
+	mockClient = DummyHttp{responseBodies: []string{soaOnlyZone}}
+	client = NewClientWithMock(&mockClient, false)
+	client.Locker = &recordingLocker{ctx: ctx}
+	err = client.SetDnsTxt("dummy.test-domain.com.", "test-value")
+	assert.EqualError(t, err, "lost the lock on zone test-domain.com before changing it: held by another replica")
+	assert.Equal(t, ReasonZoneLockFailed, ErrorReason(err))
+	assert.Len(t, mockClient.requests, 1)
+}
+
+func TestZoneCache(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			soaOnlyZone,
+			`{"data": {"new_serial": 2022040506}}`,
+			`{"data": {"new_serial": 2022040507}}`,
+			// The record was removed behind our back, so presenting it again has to create it
+			soaOnlyZone,
+			`{"errors": ["The given serial number (2022040505) does not match the DNS zone’s serial number (2022040507)."], "status": 0}`,
+			soaOnlyZone,
+			`{}`,
+		},
+	}
+	client := NewClientWithMock(&mockClient, false)
+	client.Cache = NewZoneCache(time.Minute)
+	var events []string
+	client.Cache.Observe = func(zone string, event string) {
+		assert.Equal(t, "test-domain.com", zone)
+		events = append(events, event)
+	}
+
+	// The second record is made from the snapshot, brought up to date with the first
+	assert.NoError(t, client.SetDnsTxt("first.test-domain.com.", "test-value"))
+	assert.NoError(t, client.SetDnsTxt("second.test-domain.com.", "test-value"))
+	assert.Len(t, mockClient.requests, 3)
+	assert.Contains(t, mockClient.requests[2].URL.RawQuery, "serial=2022040506&add=")
+	assert.Equal(t, []string{CacheMiss, CacheUpdate, CacheHit, CacheUpdate}, events)
+
+	// Finding the record already there is checked against the live zone, and a serial conflict drops the snapshot
+	events = nil
+	assert.NoError(t, client.SetDnsTxt("second.test-domain.com.", "test-value"))
+	assert.Len(t, mockClient.requests, 7)
+	assert.Equal(t, "/execute/DNS/parse_zone", mockClient.requests[3].URL.Path)
+	assert.Equal(t, "/execute/DNS/parse_zone", mockClient.requests[5].URL.Path)
+	// Without the new serial the snapshot can't be updated either
+	assert.Equal(t, []string{CacheHit, CacheInvalidate, CacheMiss, CacheInvalidate}, events)
+}
+
+func TestZoneCacheCleanUp(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{
+			soaOnlyZone,
+			`{"data": {"new_serial": 2022040506}}`,
+			// The line of the record we added isn't known from the snapshot
+			txtZone(base64.StdEncoding.EncodeToString([]byte("test-value"))),
+			`{"data": {"new_serial": 2022040507}}`,
+			// Nor is finding nothing left to delete trusted
+			soaOnlyZone,
+		},
+	}
+	client := NewClientWithMock(&mockClient, false)
+	client.Cache = NewZoneCache(time.Minute)
+
+	assert.NoError(t, client.SetDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.NoError(t, client.ClearDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.Len(t, mockClient.requests, 4)
+	assert.Equal(t, "/execute/DNS/parse_zone", mockClient.requests[2].URL.Path)
+	assert.Equal(t, "zone=test-domain.com&serial=2022040505&remove=17", mockClient.requests[3].URL.RawQuery)
+
+	assert.NoError(t, client.ClearDnsTxt("dummy.test-domain.com.", "test-value"))
+	assert.Len(t, mockClient.requests, 5)
+}
+
+func TestZoneCacheExpires(t *testing.T) {
+	mockClient := DummyHttp{
+		responseBodies: []string{soaOnlyZone, `{"data": {"new_serial": 2022040506}}`, soaOnlyZone, `{}`},
+	}
+	now := time.Now()
+	client := NewClientWithMock(&mockClient, false)
+	client.Cache = NewZoneCache(30 * time.Second)
+	client.Cache.now = func() time.Time { return now }
+
+	assert.NoError(t, client.SetDnsTxt("first.test-domain.com.", "test-value"))
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, client.SetDnsTxt("second.test-domain.com.", "test-value"))
+	assert.Len(t, mockClient.requests, 4)
+	assert.Equal(t, "/execute/DNS/parse_zone", mockClient.requests[2].URL.Path)
+}
+
+func TestParseZoneKeepsChangeableRecords(t *testing.T) {
+	zone := syntheticZone(6)
+	mockClient := DummyHttp{responseBodies: []string{zone, zone}}
+	client := NewClientWithMock(&mockClient, false)
+
+	details, err := client.getZoneDetails()
+	assert.NoError(t, err)
+	// Only the SOA and TXT records are kept
+	if assert.Len(t, details.Data, 2) {
+		serial, err := getZoneSerial(details)
+		assert.NoError(t, err)
+		assert.Equal(t, "2022040505", serial)
+		assert.Equal(t, []TxtRecord{{Name: "record-4", Value: "value-4", TTL: 300, LineIndex: 5}}, client.getTxtRecords(details))
+		assert.Empty(t, details.Data[1].DataB64)
+	}
+
+	records, err := client.ListZoneRecords()
+	assert.NoError(t, err)
+	if assert.Len(t, records, 7) {
+		assert.Equal(t, ZoneRecord{LineIndex: 2, Type: "record", RecordType: "A", Name: "record-1", TTL: 300, Data: []string{"value-1"}}, records[1])
+		assert.Equal(t, ZoneRecord{LineIndex: 6, Type: "comment", Text: "; value-5"}, records[5])
+	}
+}
+
+// A parse_zone payload with the SOA of soaOnlyZone followed by the given number of records of various types.
+func syntheticZone(records int) string {
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	var zone strings.Builder
+	zone.WriteString(`{"data": [{"line_index": 1, "type": "record", "data_b64": ["bnMxLnN0YWJsZWhvc3QuY29tLg==", "YWxlcnRzLnN0YWJsZWhvc3QuY29tLg==", "MjAyMjA0MDUwNQ==", "ODY0MDA=", "NzIwMA==", "MzYwMDAwMA==", "MTgwMA=="], "dname_b64": "dGVzdC1kb21haW4uY29tLg==", "record_type": "SOA", "ttl": 86400}`)
+	types := []string{"A", "CNAME", "MX", "TXT", "comment"}
+	for i := 1; i <= records; i++ {
+		name, value := fmt.Sprintf("record-%d", i), fmt.Sprintf("value-%d", i)
+		recordType := types[(i-1)%len(types)]
+		if recordType == "comment" {
+			fmt.Fprintf(&zone, `, {"line_index": %d, "type": "comment", "text_b64": %q}`, i+1, encode("; "+value))
+		} else {
+			fmt.Fprintf(&zone, `, {"line_index": %d, "type": "record", "data_b64": [%q], "dname_b64": %q, "record_type": %q, "ttl": 300}`, i+1, encode(value), encode(name), recordType)
+		}
+	}
+	zone.WriteString(`], "errors": null, "messages": null, "metadata": {}, "status": 1}`)
+	return zone.String()
+}
+
+// Serves the same body to every request.
+type repeatHttp struct {
+	body string
+}
+
+func (r *repeatHttp) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(strings.NewReader(r.body)),
+		Header:     make(http.Header),
+	}, nil
+}
+
+const benchmarkZoneRecords = 10000
+
+func BenchmarkGetZoneDetails(b *testing.B) {
+	client := NewClientWithMock(nil, false)
+	client.httpClient.Transport = &repeatHttp{body: syntheticZone(benchmarkZoneRecords)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.getZoneDetails(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListZoneRecords(b *testing.B) {
+	client := NewClientWithMock(nil, false)
+	client.httpClient.Transport = &repeatHttp{body: syntheticZone(benchmarkZoneRecords)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.ListZoneRecords(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// How the zone used to be decoded, reading the whole body and then decoding every record, for comparison.
+func BenchmarkGetZoneDetailsEagerly(b *testing.B) {
+	client := NewClientWithMock(nil, false)
+	client.httpClient.Transport = &repeatHttp{body: syntheticZone(benchmarkZoneRecords)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		resp, err := client.httpClient.Get(client.CpanelUrl + "/execute/DNS/parse_zone?zone=test-domain.com")
+		if err != nil {
+			b.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var zone cpanelZoneResponse
+		if err := json.Unmarshal(body, &zone); err != nil {
+			b.Fatal(err)
+		}
+		for i := range zone.Data {
+			record := &zone.Data[i]
+			record.Dname = decode(record.DnameB64)
+			record.Text = decode(record.TextB64)
+			for _, data := range record.DataB64 {
+				record.Data = append(record.Data, decode(data))
+			}
+		}
+	}
+}
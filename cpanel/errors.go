@@ -0,0 +1,66 @@
+package cpanel
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Reasons attached to errors (and notifications) from the client. These are short CamelCase strings so that
+// they can be used directly as the reason of a Kubernetes Event.
+const (
+	ReasonAuthenticationFailed  = "AuthenticationFailed"
+	ReasonZoneNotFound          = "ZoneNotFound"
+	ReasonSerialConflict        = "SerialConflict"
+	ReasonSerialConflictRetried = "SerialConflictRetried"
+	ReasonDuplicatesRemoved     = "DuplicatesRemoved"
+	ReasonRequestFailed         = "RequestFailed"
+)
+
+// Error is returned by the client when CPanel rejects a request, carrying a reason for why it happened.
+type Error struct {
+	Reason  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorReason returns the reason of a CPanel error, or ReasonRequestFailed for anything else.
+func ErrorReason(err error) string {
+	var cpanelErr *Error
+	if errors.As(err, &cpanelErr) {
+		return cpanelErr.Reason
+	}
+	return ReasonRequestFailed
+}
+
+func newError(reason string, message string) *Error {
+	return &Error{Reason: reason, Message: message}
+}
+
+// The error mass_edit_zone gives when the zone has changed since the serial we sent, e.g. "The given serial number
+// (2022040505) does not match the DNS zone’s serial number (2022040506)." Only this is retried, so it's matched
+// exactly rather than on any mention of the serial.
+var serialConflictError = regexp.MustCompile(`^The given serial number \(\d+\) does not match the DNS zone.s serial number \(\d+\)\.?$`)
+
+// CPanel reports errors as free text (UAPI gives no codes), so we have to guess at what went wrong.
+func classifyErrors(action string, cpanelErrors []string) *Error {
+	message := action + " JSON reported errors: " + strings.Join(cpanelErrors, "; ")
+	joined := strings.ToLower(strings.Join(cpanelErrors, " "))
+
+	for _, cpanelError := range cpanelErrors {
+		if serialConflictError.MatchString(strings.TrimSpace(cpanelError)) {
+			return newError(ReasonSerialConflict, message)
+		}
+	}
+	switch {
+	case strings.Contains(joined, "does not exist"),
+		strings.Contains(joined, "do not have access"),
+		strings.Contains(joined, "not have a zone"),
+		strings.Contains(joined, "no zone"):
+		return newError(ReasonZoneNotFound, message)
+	}
+	return newError(ReasonRequestFailed, message)
+}
@@ -0,0 +1,201 @@
+package cpanel
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often endpoints marked unhealthy are probed, and how long a probe may take.
+const (
+	defaultProbeInterval = 30 * time.Second
+	probeTimeout         = 10 * time.Second
+)
+
+// Failover spreads requests over several URLs of the same CPanel account (e.g. the hosting provider's shared host
+// and a proxy subdomain), in order of preference. It's shared by copies of the client from ForZone.
+//
+// Requests go to the endpoint that last worked, moving to the next when it can't be reached at all (e.g. a
+// connection or TLS error). Other errors, such as rejected credentials, would be the same on every endpoint so are
+// returned straight away. Unreachable endpoints are probed in the background, and once an endpoint earlier in the
+// list is back it's preferred again.
+type Failover struct {
+	urls []string
+
+	// How often unhealthy endpoints are probed, defaulting to 30 seconds
+	ProbeInterval time.Duration
+
+	// Checks that an endpoint can be reached, replaceable for testing
+	probe func(url string) error
+
+	mutex     sync.Mutex
+	preferred int
+	unhealthy map[int]bool
+	probing   bool
+
+	// Closed by Close to stop probing once the client using the Failover has been thrown away
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFailover creates a Failover across the URLs, the first being preferred.
+func NewFailover(urls []string) *Failover {
+	f := &Failover{
+		urls:          urls,
+		ProbeInterval: defaultProbeInterval,
+		unhealthy:     map[int]bool{},
+		stopCh:        make(chan struct{}),
+	}
+	f.probe = f.probeUrl
+	return f
+}
+
+// unreachableError is an error where the endpoint couldn't be reached, so another may be tried.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unreachableError) Unwrap() error {
+	return e.err
+}
+
+// Current returns the URL requests are sent to first.
+func (f *Failover) Current() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.urls[f.preferred]
+}
+
+// Call the request with each endpoint in turn until one can be reached.
+func (f *Failover) try(request func(baseUrl string) error) error {
+	var err error
+	for _, i := range f.order() {
+		err = request(f.urls[i])
+
+		var unreachable *unreachableError
+		if !errors.As(err, &unreachable) {
+			f.markHealthy(i, true)
+			return err
+		}
+		log.Warnf("CPanel endpoint %s couldn't be reached, trying the next: %s", f.urls[i], err)
+		f.markUnhealthy(i)
+	}
+	return err
+}
+
+// The order to try endpoints in: the preferred one, then others that are healthy, then unhealthy ones as a last
+// resort in case the probe hasn't caught up.
+func (f *Failover) order() []int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	order := []int{f.preferred}
+	var unhealthy []int
+	for i := range f.urls {
+		switch {
+		case i == f.preferred:
+		case f.unhealthy[i]:
+			unhealthy = append(unhealthy, i)
+		default:
+			order = append(order, i)
+		}
+	}
+	return append(order, unhealthy...)
+}
+
+// Mark an endpoint as working. It becomes preferred if it's been used for a request, or is earlier in the list
+// than the current one.
+func (f *Failover) markHealthy(i int, used bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.unhealthy[i] {
+		log.Infof("CPanel endpoint %s is reachable again", f.urls[i])
+		delete(f.unhealthy, i)
+	}
+	if used || i < f.preferred {
+		if i != f.preferred {
+			log.Infof("Switching to CPanel endpoint %s", f.urls[i])
+		}
+		f.preferred = i
+	}
+}
+
+func (f *Failover) markUnhealthy(i int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.unhealthy[i] = true
+	if !f.probing && !f.closed() {
+		f.probing = true
+		go f.probeUnhealthy()
+	}
+}
+
+// Probe unhealthy endpoints until they've all recovered.
+func (f *Failover) probeUnhealthy() {
+	for {
+		select {
+		case <-time.After(f.ProbeInterval):
+		case <-f.stopCh:
+			f.mutex.Lock()
+			f.probing = false
+			f.mutex.Unlock()
+			return
+		}
+
+		f.mutex.Lock()
+		var unhealthy []int
+		for i := range f.unhealthy {
+			unhealthy = append(unhealthy, i)
+		}
+		if len(unhealthy) == 0 {
+			f.probing = false
+			f.mutex.Unlock()
+			return
+		}
+		probe := f.probe
+		f.mutex.Unlock()
+
+		for _, i := range unhealthy {
+			err := probe(f.urls[i])
+			if err != nil {
+				log.Debugf("CPanel endpoint %s is still unreachable: %s", f.urls[i], err)
+				continue
+			}
+			f.markHealthy(i, false)
+		}
+	}
+}
+
+// Close stops probing unhealthy endpoints. Requests can still be made, but endpoints are no longer brought back
+// into use in the background.
+func (f *Failover) Close() {
+	f.closeOnce.Do(func() { close(f.stopCh) })
+}
+
+func (f *Failover) closed() bool {
+	select {
+	case <-f.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Any HTTP response at all (even a login page) means the endpoint can be reached.
+func (f *Failover) probeUrl(url string) error {
+	client := http.Client{Timeout: probeTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
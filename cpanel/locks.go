@@ -0,0 +1,39 @@
+package cpanel
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Reason for errors where the zone couldn't be locked to change it.
+const ReasonZoneLockFailed = "ZoneLockFailed"
+
+// ZoneLocker serialises changes to a zone between everything that could make them at once, such as several
+// replicas of the webhook, as CPanel silently drops all but one of the changes made against the same zone serial.
+type ZoneLocker interface {
+	// LockZone waits until the zone of the account on the host is locked, returning the function to unlock it. The
+	// context is cancelled should the lock be lost while it's held, so that changes not yet made can be abandoned.
+	LockZone(host string, account string, zone string) (ctx context.Context, unlock func(), err error)
+}
+
+// Lock the client's zone with its Locker, if it has one. The lock is for the account's own URL rather than the one
+// failed over to, as they're the same account.
+func (c *CpanelClient) lockZone() (context.Context, func(), error) {
+	if c.Locker == nil {
+		return context.Background(), func() {}, nil
+	}
+	ctx, unlock, err := c.Locker.LockZone(urlHost(c.CpanelUrl), c.Username, c.getDnsZoneNoDot())
+	if err != nil {
+		return nil, nil, newError(ReasonZoneLockFailed, fmt.Sprintf("could not lock zone %s: %s", c.getDnsZoneNoDot(), err))
+	}
+	return ctx, unlock, nil
+}
+
+// The host of a URL, or the URL itself if it has none.
+func urlHost(rawUrl string) string {
+	if parsed, err := url.Parse(rawUrl); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return rawUrl
+}
@@ -0,0 +1,113 @@
+package cpanel
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reason for notifications of a mirror that couldn't be written to, though enough others were.
+const ReasonMirrorWriteFailed = "MirrorWriteFailed"
+
+// MirroredClient applies every change to several CPanel servers that serve the same zone independently (e.g. a
+// primary and secondary without a DNS cluster link), as the ACME server may ask either of them.
+type MirroredClient struct {
+	// The client for each server, the first being the Issuer's own cpanelUrl
+	Clients []*CpanelClient
+
+	// How many servers must be written to for a change to succeed, defaulting to all of them
+	Required int
+
+	// Notify, if set, is called for noteworthy events on any of the servers
+	Notify func(reason string, message string)
+
+	// AuditTrigger is given to each of the clients, see CpanelClient
+	AuditTrigger func() *AuditTrigger
+}
+
+// SetDnsTxt sets the record on every server, failing if fewer than Required succeed. In that case the record is
+// removed again from those servers it was created on, so that a later retry starts afresh.
+func (m *MirroredClient) SetDnsTxt(recordName string, value string) error {
+	var created []*CpanelClient
+	var failures []string
+	for _, client := range m.clients() {
+		wasCreated, err := client.presentDnsTxt(recordName, value)
+		if err != nil {
+			log.Errorf("Could not set TXT record on CPanel server %s: %s", client.serverUrl(), err)
+			failures = append(failures, fmt.Sprintf("%s: %s", client.serverUrl(), err))
+			continue
+		}
+		if wasCreated {
+			created = append(created, client)
+		}
+	}
+
+	err := m.checkRequired("set on", failures)
+	if err == nil {
+		return nil
+	}
+
+	for _, client := range created {
+		log.Infof("Rolling back TXT record on CPanel server %s", client.serverUrl())
+		if rollbackErr := client.ClearDnsTxt(recordName, value); rollbackErr != nil {
+			log.Errorf("Could not roll back TXT record on CPanel server %s: %s", client.serverUrl(), rollbackErr)
+		}
+	}
+	return err
+}
+
+// ClearDnsTxt deletes the record from every server, failing if fewer than Required succeed.
+func (m *MirroredClient) ClearDnsTxt(recordName string, value string) error {
+	var failures []string
+	for _, client := range m.clients() {
+		err := client.ClearDnsTxt(recordName, value)
+		if err != nil {
+			log.Errorf("Could not delete TXT record on CPanel server %s: %s", client.serverUrl(), err)
+			failures = append(failures, fmt.Sprintf("%s: %s", client.serverUrl(), err))
+		}
+	}
+	return m.checkRequired("deleted from", failures)
+}
+
+// The clients, with Notify and AuditTrigger passed on to them.
+func (m *MirroredClient) clients() []*CpanelClient {
+	for _, client := range m.Clients {
+		client.Notify = m.Notify
+		client.AuditTrigger = m.AuditTrigger
+	}
+	return m.Clients
+}
+
+func (m *MirroredClient) required() int {
+	if m.Required <= 0 || m.Required > len(m.Clients) {
+		return len(m.Clients)
+	}
+	return m.Required
+}
+
+// Error if too many servers failed, otherwise just let it be known that some did.
+func (m *MirroredClient) checkRequired(action string, failures []string) error {
+	succeeded := len(m.Clients) - len(failures)
+	if len(failures) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("TXT record %s %d of %d CPanel servers", action, succeeded, len(m.Clients))
+	if succeeded < m.required() {
+		return fmt.Errorf("%s, %d needed: %s", message, m.required(), strings.Join(failures, "; "))
+	}
+	log.Warn(message)
+	if m.Notify != nil {
+		m.Notify(ReasonMirrorWriteFailed, fmt.Sprintf("%s: %s", message, strings.Join(failures, "; ")))
+	}
+	return nil
+}
+
+// The URL of the server the client talks to, to tell servers apart in logs and errors.
+func (c *CpanelClient) serverUrl() string {
+	if c.Failover != nil {
+		return c.Failover.Current()
+	}
+	return c.CpanelUrl
+}
@@ -0,0 +1,56 @@
+package cpanel
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
+)
+
+// Names are compared in canonical form: case folded, with internationalised labels in punycode as CPanel stores them.
+// Underscores and wildcards aren't valid in host names, but are in record names, so aren't rejected.
+var nameProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.Transitional(false))
+
+// The relative name of a record at the apex of its zone.
+const apexName = "@"
+
+// CanonicalName returns the name in the form it's compared in, e.g. "xn--bcher-kva.de." for "Bücher.DE.".
+func CanonicalName(name string) string {
+	ascii, err := nameProfile.ToASCII(name)
+	if err != nil {
+		log.Warnf("Could not convert '%s' to punycode, using it as it is: %s", name, err)
+		return strings.ToLower(name)
+	}
+	return ascii
+}
+
+// relativeName returns the canonical name of a record relative to the zone, or "@" for the apex.
+// Names with a trailing dot are absolute (as parse_zone returns apex records), anything else is already relative.
+func relativeName(name string, zone string) string {
+	name = CanonicalName(name)
+	zone = strings.TrimSuffix(CanonicalName(zone), ".")
+	if !strings.HasSuffix(name, ".") {
+		if name == "" {
+			return apexName
+		}
+		return name
+	}
+
+	name = strings.TrimSuffix(name, ".")
+	if name == zone {
+		return apexName
+	}
+	relative := strings.TrimSuffix(name, "."+zone)
+	if relative == name {
+		log.Warnf("Record name '%s' isn't within zone '%s'", name, zone)
+	}
+	return relative
+}
+
+// The name to give CPanel for a relative record name, which wants the apex as an absolute name.
+func (c *CpanelClient) cpanelName(name string) string {
+	if name == apexName {
+		return c.getDnsZoneNoDot() + "."
+	}
+	return name
+}
@@ -0,0 +1,98 @@
+package cpanel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ownership keeps track of which TXT records were created by this webhook, so that deleting records (whether
+// cleaning up or garbage collecting) never touches those made by other ACME clients sharing the zone.
+type Ownership interface {
+	// Claim is called before a record is created, returning any companion records to create alongside it. Those
+	// without a TTL are given the record's.
+	Claim(zone string, record TxtRecord) ([]TxtRecord, error)
+
+	// Owned filters the candidates for deletion down to those created by this webhook, adding any companion records
+	// that should be deleted alongside them. zoneRecords are every TXT record currently in the zone.
+	Owned(zone string, zoneRecords []TxtRecord, candidates []TxtRecord) ([]TxtRecord, error)
+
+	// Released is called once records have been deleted.
+	Released(zone string, records []TxtRecord) error
+}
+
+// Marker records are named with this prefix before the name of the record they mark.
+const MarkerPrefix = "_cpanel-webhook-owner."
+
+// The TTL of every marker record. Markers for duplicates of a record share a name, so giving each the TTL of the
+// record it marks could leave records of differing TTLs under one name.
+const MarkerTtl = 300
+
+// MarkerOwnership marks each record the webhook creates with a companion TXT record in the zone itself, holding the
+// owner and a hash of the marked record's value. This needs nothing beyond the zone, but does double the records.
+type MarkerOwnership struct {
+	// Identifies this deployment of the webhook, so that several can share a zone
+	Owner string
+}
+
+func (m *MarkerOwnership) Claim(zone string, record TxtRecord) ([]TxtRecord, error) {
+	return []TxtRecord{m.marker(record)}, nil
+}
+
+// Owned pairs each candidate with a marker of its own, so that of several duplicates only as many are owned as there
+// are markers for them, and each of those markers is deleted.
+func (m *MarkerOwnership) Owned(zone string, zoneRecords []TxtRecord, candidates []TxtRecord) ([]TxtRecord, error) {
+	markers := map[TxtRecord][]TxtRecord{}
+	for _, record := range zoneRecords {
+		if strings.HasPrefix(record.Name+".", MarkerPrefix) {
+			key := TxtRecord{Name: record.Name, Value: record.Value}
+			markers[key] = append(markers[key], record)
+		}
+	}
+
+	var owned []TxtRecord
+	for _, candidate := range candidates {
+		wanted := m.marker(candidate)
+		key := TxtRecord{Name: wanted.Name, Value: wanted.Value}
+		if len(markers[key]) == 0 {
+			log.Infof("Record %s has no ownership marker, leaving it alone", candidate.Name)
+			continue
+		}
+		owned = append(owned, candidate, markers[key][0])
+		markers[key] = markers[key][1:]
+	}
+	return owned, nil
+}
+
+func (m *MarkerOwnership) Released(zone string, records []TxtRecord) error {
+	return nil
+}
+
+func (m *MarkerOwnership) marker(record TxtRecord) TxtRecord {
+	name := MarkerPrefix + record.Name
+	if record.Name == apexName {
+		name = strings.TrimSuffix(MarkerPrefix, ".")
+	}
+	return TxtRecord{
+		Name:  name,
+		Value: fmt.Sprintf("owner=%s;value-sha256=%s", m.Owner, HashValue(record.Value)),
+		TTL:   MarkerTtl,
+	}
+}
+
+// HashValue is the hex SHA-256 hash of a record's value, for keeping track of records without storing their values.
+func HashValue(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+// Filter deletion candidates through the client's Ownership, if it has one.
+func (c *CpanelClient) ownedRecords(zone *cpanelZoneResponse, candidates []TxtRecord) ([]TxtRecord, error) {
+	if c.Ownership == nil {
+		return candidates, nil
+	}
+	return c.Ownership.Owned(c.getDnsZoneNoDot(), c.getTxtRecords(zone), candidates)
+}
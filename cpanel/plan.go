@@ -0,0 +1,69 @@
+package cpanel
+
+// PlannedChange is a record that a change to the zone would add, edit or remove.
+type PlannedChange struct {
+	// "add", "edit" or "remove", as in AuditChange
+	Change string
+	Name   string
+	Value  string
+	TTL    int
+}
+
+// PlanSetDnsTxt works out what SetDnsTxt would change in the zone without changing it: nothing if the record is
+// already there, otherwise the record and any ownership marker to add along with existing records whose TTL the
+// TtlPolicy would rewrite. Ownership kept outside the zone isn't claimed, as that would change it.
+func (c *CpanelClient) PlanSetDnsTxt(recordName string, value string) ([]PlannedChange, error) {
+	zone, err := c.readZone()
+	if err != nil {
+		return nil, err
+	}
+	name := c.getDnsSubdomainOnly(recordName)
+	existingRecord, otherRecords := findTxtRecord(zone, c.DnsZone, name, value)
+	if existingRecord != nil {
+		return nil, nil
+	}
+	ttl, rewrites, err := c.TtlPolicy.resolve(otherRecords)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []PlannedChange{{Change: "add", Name: name, Value: value, TTL: ttl}}
+	if marker, ok := c.Ownership.(*MarkerOwnership); ok {
+		companion := marker.marker(TxtRecord{Name: name, Value: value})
+		changes = append(changes, PlannedChange{Change: "add", Name: companion.Name, Value: companion.Value, TTL: companion.TTL})
+	}
+	for _, record := range rewrites {
+		changes = append(changes, PlannedChange{Change: "edit", Name: relativeName(record.Dname, c.DnsZone), Value: txtValue(record.Data), TTL: ttl})
+	}
+	return changes, nil
+}
+
+// PlanClearDnsTxt works out what ClearDnsTxt would remove from the zone without changing it: every record with the
+// name and value that Ownership allows to be deleted, along with their companions.
+func (c *CpanelClient) PlanClearDnsTxt(recordName string, value string) ([]PlannedChange, error) {
+	zone, err := c.readZone()
+	if err != nil {
+		return nil, err
+	}
+	wanted := []TxtRecord{{Name: c.getDnsSubdomainOnly(recordName), Value: value}}
+	owned, err := c.findOwnedRecords(zone, wanted)
+	if err != nil {
+		return nil, err
+	}
+	if c.countMatching(owned, wanted) == 0 {
+		return nil, nil
+	}
+
+	var changes []PlannedChange
+	for _, record := range owned {
+		changes = append(changes, PlannedChange{Change: "remove", Name: record.Name, Value: record.Value, TTL: record.TTL})
+	}
+	return changes, nil
+}
+
+// Plans only read the zone, so don't lock it or keep a snapshot of it, which changes would then be made from. A
+// change under way at the time may show up in the plan or not, as it would've been had the plan been made just
+// before or after.
+func (c *CpanelClient) readZone() (*cpanelZoneResponse, error) {
+	return c.parseZone(isChangeable)
+}
@@ -0,0 +1,185 @@
+package cpanel
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TxtRecord is a TXT record within the client's zone.
+type TxtRecord struct {
+	// The name of the record relative to the zone in canonical form, e.g. '_acme-challenge.www', or '@' for the apex
+	Name      string
+	Value     string
+	TTL       int
+	LineIndex int
+}
+
+// ZoneRecord is a line of the zone file as CPanel parses it, with values decoded.
+type ZoneRecord struct {
+	LineIndex int `json:"lineIndex"`
+
+	// "record" for resource records, otherwise "comment" or "control" for other lines
+	Type string `json:"type"`
+
+	// The record's type, name as given in the zone file, TTL and data
+	RecordType string   `json:"recordType,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	TTL        int      `json:"ttl,omitempty"`
+	Data       []string `json:"data,omitempty"`
+
+	// The text of comment and control lines
+	Text string `json:"text,omitempty"`
+}
+
+// ListZoneRecords returns every line of the zone, for inspecting it when something goes wrong.
+func (c *CpanelClient) ListZoneRecords() ([]ZoneRecord, error) {
+	zone, err := c.parseZone(isAnyRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]ZoneRecord, 0, len(zone.Data))
+	for _, record := range zone.Data {
+		records = append(records, ZoneRecord{
+			LineIndex:  record.LineIndex,
+			Type:       record.Type,
+			RecordType: string(record.RecordType),
+			Name:       record.Dname,
+			TTL:        record.TTL,
+			Data:       record.Data,
+			Text:       record.Text,
+		})
+	}
+	return records, nil
+}
+
+// ListTxtRecords returns every TXT record in the zone.
+func (c *CpanelClient) ListTxtRecords() ([]TxtRecord, error) {
+	zone, err := c.getZoneDetails()
+	if err != nil {
+		return nil, err
+	}
+	return c.getTxtRecords(zone), nil
+}
+
+func (c *CpanelClient) getTxtRecords(zone *cpanelZoneResponse) []TxtRecord {
+	var records []TxtRecord
+	for _, record := range zone.Data {
+		if record.RecordType != typeTxt || len(record.Data) == 0 {
+			continue
+		}
+		records = append(records, TxtRecord{
+			Name:      relativeName(record.Dname, c.DnsZone),
+			Value:     txtValue(record.Data),
+			TTL:       record.TTL,
+			LineIndex: record.LineIndex,
+		})
+	}
+	return records
+}
+
+// RemoveTxtRecords deletes every TXT record matching the name and value of one of the given records in a single
+// request, returning how many were deleted (not counting companions such as ownership markers). With Ownership set
+// only records created by the webhook are deleted.
+// Line indexes are looked up in the zone (or a snapshot of it that knows them) rather than trusted, as they shift
+// whenever the zone is changed.
+func (c *CpanelClient) RemoveTxtRecords(records []TxtRecord) (int, error) {
+	removed := 0
+	err := c.retryOnSerialConflict(func(ctx context.Context) error {
+		zone, cached, err := c.getZoneSnapshot()
+		if err != nil {
+			return err
+		}
+		owned, err := c.findOwnedRecords(zone, records)
+		if err != nil {
+			return err
+		}
+
+		// Finding nothing to remove, or lines that aren't known, is only trusted from the live zone
+		if cached && (len(owned) == 0 || hasUnknownTxtLines(owned)) {
+			log.Debug("Checking the live zone rather than its snapshot")
+			zone, err = c.getZoneDetails()
+			if err != nil {
+				return err
+			}
+			owned, err = c.findOwnedRecords(zone, records)
+			if err != nil {
+				return err
+			}
+		}
+		matching := c.countMatching(owned, records)
+		if matching == 0 {
+			log.Info("No matching records left to remove")
+			removed = 0
+			return nil
+		}
+		serial, err := getZoneSerial(zone)
+		if err != nil {
+			return err
+		}
+		log.Infof("Removing %d TXT records from zone %s", len(owned), c.getDnsZoneNoDot())
+		err = c.deleteTxtRecords(ctx, serial, owned)
+		if err == nil {
+			removed = matching
+		}
+		return err
+	})
+	return removed, err
+}
+
+// The TXT records of the zone matching the name and value of one of the given records that may be deleted, along
+// with their companions, each line only once.
+func (c *CpanelClient) findOwnedRecords(zone *cpanelZoneResponse, records []TxtRecord) ([]TxtRecord, error) {
+	wanted := map[TxtRecord]bool{}
+	for _, record := range records {
+		wanted[TxtRecord{Name: relativeName(record.Name, c.DnsZone), Value: record.Value}] = true
+	}
+
+	var matching []TxtRecord
+	for _, record := range c.getTxtRecords(zone) {
+		if wanted[TxtRecord{Name: record.Name, Value: record.Value}] {
+			matching = append(matching, record)
+		}
+	}
+	owned, err := c.ownedRecords(zone, matching)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lines not yet known can't be told apart, and are checked against the live zone before anything is deleted
+	seen := map[int]bool{}
+	var unique []TxtRecord
+	for _, record := range owned {
+		if record.LineIndex != unknownLineIndex && seen[record.LineIndex] {
+			continue
+		}
+		seen[record.LineIndex] = true
+		unique = append(unique, record)
+	}
+	return unique, nil
+}
+
+// How many of the zone's records match the name and value of one of those wanted.
+func (c *CpanelClient) countMatching(records []TxtRecord, wanted []TxtRecord) int {
+	wantedSet := map[TxtRecord]bool{}
+	for _, record := range wanted {
+		wantedSet[TxtRecord{Name: relativeName(record.Name, c.DnsZone), Value: record.Value}] = true
+	}
+	count := 0
+	for _, record := range records {
+		if wantedSet[TxtRecord{Name: record.Name, Value: record.Value}] {
+			count++
+		}
+	}
+	return count
+}
+
+// Delete the records and let Ownership know that they're gone.
+func (c *CpanelClient) deleteTxtRecords(ctx context.Context, serial string, records []TxtRecord) error {
+	err := c.deleteZoneRecord(ctx, serial, records)
+	if err != nil || c.Ownership == nil {
+		return err
+	}
+	return c.Ownership.Released(c.getDnsZoneNoDot(), records)
+}
@@ -0,0 +1,85 @@
+package cpanel
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The TTL of new TXT records when the policy doesn't give one.
+const defaultTtl = 300
+
+// TtlConflictStrategy decides what happens when a TXT record is added alongside existing records (i.e. the same
+// name) whose TTL is outside of the policy. All records of a name must share the same TTL.
+type TtlConflictStrategy string
+
+const (
+	// Use the TTL of the existing records, as if there were no policy
+	TtlConflictAdopt TtlConflictStrategy = "adopt"
+	// Change the TTL of the existing records to that of the policy, in the same request as adding the new record
+	TtlConflictRewrite TtlConflictStrategy = "rewrite"
+	// Refuse to add the record
+	TtlConflictFail TtlConflictStrategy = "fail"
+)
+
+// ReasonTtlConflict is given when a record can't be added due to the TtlConflictFail strategy.
+const ReasonTtlConflict = "TtlConflict"
+
+// TtlPolicy decides the TTL of TXT records created by the client. The zero value uses a TTL of 300, or that of any
+// existing records.
+type TtlPolicy struct {
+	// The TTL of new records, defaulting to 300 (or the nearest bound if that's outside of them)
+	Ttl int
+	// Bounds for the TTL of existing records. Zero means no bound.
+	MinTtl int
+	MaxTtl int
+	// What to do when existing records have a TTL outside of the bounds, defaulting to adopt
+	Conflict TtlConflictStrategy
+}
+
+func (p TtlPolicy) ttl() int {
+	if p.Ttl > 0 {
+		return p.Ttl
+	}
+	if p.MinTtl > 0 && defaultTtl < p.MinTtl {
+		return p.MinTtl
+	}
+	if p.MaxTtl > 0 && defaultTtl > p.MaxTtl {
+		return p.MaxTtl
+	}
+	return defaultTtl
+}
+
+func (p TtlPolicy) allows(ttl int) bool {
+	if p.MinTtl > 0 && ttl < p.MinTtl {
+		return false
+	}
+	if p.MaxTtl > 0 && ttl > p.MaxTtl {
+		return false
+	}
+	return true
+}
+
+// resolve works out the TTL for a new record given the existing records of the same name, along with any of those
+// records that need rewriting to the new TTL.
+func (p TtlPolicy) resolve(existing []cpanelZoneRecord) (int, []cpanelZoneRecord, error) {
+	if len(existing) == 0 {
+		return p.ttl(), nil, nil
+	}
+
+	existingTtl := existing[0].TTL
+	if p.allows(existingTtl) {
+		return existingTtl, nil, nil
+	}
+
+	switch p.Conflict {
+	case TtlConflictRewrite:
+		log.Infof("Existing records have TTL %d outside of policy, rewriting %d of them to %d", existingTtl, len(existing), p.ttl())
+		return p.ttl(), existing, nil
+	case TtlConflictFail:
+		return 0, nil, newError(ReasonTtlConflict, fmt.Sprintf("existing records have TTL %d, outside of the allowed %d to %d", existingTtl, p.MinTtl, p.MaxTtl))
+	default:
+		log.Warnf("Existing records have TTL %d outside of policy, using it anyway", existingTtl)
+		return existingTtl, nil, nil
+	}
+}
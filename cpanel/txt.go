@@ -0,0 +1,87 @@
+package cpanel
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// A TXT record's data is a list of character-strings of at most 255 bytes each, which together make up its value.
+const maxTxtStringLength = 255
+
+// txtValue joins the character-strings of a TXT record into its value.
+// parse_zone usually returns each character-string unquoted, but records written by other tools can come back as a
+// single string in zone file form (e.g. `"first" "second"`), which is unquoted and unescaped here.
+func txtValue(data []string) string {
+	var value strings.Builder
+	for _, chunk := range data {
+		if unquoted, ok := unquoteTxt(chunk); ok {
+			chunk = unquoted
+		}
+		value.WriteString(chunk)
+	}
+	return value.String()
+}
+
+// splitTxtValue splits a value into character-strings short enough for a TXT record, without splitting a UTF-8
+// sequence across two of them.
+func splitTxtValue(value string) []string {
+	chunks := []string{}
+	for len(value) > maxTxtStringLength {
+		end := maxTxtStringLength
+		for end > 0 && !utf8.RuneStart(value[end]) {
+			end--
+		}
+		chunks = append(chunks, value[:end])
+		value = value[end:]
+	}
+	return append(chunks, value)
+}
+
+// unquoteTxt parses zone file quoted strings separated by whitespace, joining their contents. Within them a
+// backslash escapes the next character, or gives a byte as three decimal digits (e.g. \059 for ';').
+// It returns false if s isn't entirely quoted strings, in which case it should be taken as it is.
+func unquoteTxt(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, `"`) {
+		return "", false
+	}
+
+	var value strings.Builder
+	for len(s) > 0 {
+		if s[0] != '"' {
+			return "", false
+		}
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				value.WriteByte(s[i])
+				continue
+			}
+			if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+				b := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+				if b > 255 {
+					return "", false
+				}
+				value.WriteByte(byte(b))
+				i += 3
+			} else if i+1 < len(s) {
+				value.WriteByte(s[i+1])
+				i++
+			}
+		}
+		if i >= len(s) {
+			return "", false // Unterminated
+		}
+		s = strings.TrimLeft(s[i+1:], " \t")
+	}
+	return value.String(), true
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
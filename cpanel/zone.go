@@ -0,0 +1,126 @@
+package cpanel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// Implemented by responses that decode themselves from the body as it's read, rather than once it's all in memory
+type streamDecoder interface {
+	decodeFrom(dec *json.Decoder) error
+}
+
+// zoneReader decodes a parse_zone response a record at a time, keeping (and decoding the values of) only the records
+// it's asked to. Zones can have many thousands of records, when changing TXT records all but a few are of no interest.
+type zoneReader struct {
+	zone *cpanelZoneResponse
+	keep func(record *cpanelZoneRecord) bool
+}
+
+func (r *zoneReader) errors() []string {
+	return r.zone.Errors
+}
+
+func (r *zoneReader) decodeFrom(dec *json.Decoder) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "data":
+			err = r.decodeRecords(dec)
+		case "errors":
+			err = dec.Decode(&r.zone.Errors)
+		case "status":
+			err = dec.Decode(&r.zone.Status)
+		default:
+			// Such as messages and metadata, which are small
+			err = dec.Decode(&json.RawMessage{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func (r *zoneReader) decodeRecords(dec *json.Decoder) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil // No data along with errors
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("expected an array of zone records, got %v", token)
+	}
+	for dec.More() {
+		var record cpanelZoneRecord
+		if err := dec.Decode(&record); err != nil {
+			return err
+		}
+		if r.keep(&record) {
+			record.decode()
+			r.zone.Data = append(r.zone.Data, record)
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v in zone JSON, got %v", delim, token)
+	}
+	return nil
+}
+
+// The records we change, and the SOA for the serial needed to change them
+func isChangeable(record *cpanelZoneRecord) bool {
+	return record.RecordType == typeSoa || record.RecordType == typeTxt
+}
+
+func isAnyRecord(record *cpanelZoneRecord) bool {
+	return true
+}
+
+// The CPanel API unhelpfully base64 encodes values, the encoded ones are dropped once decoded.
+func (r *cpanelZoneRecord) decode() {
+	r.Dname = decode(r.DnameB64)
+	r.Text = decode(r.TextB64)
+	for _, data := range r.DataB64 {
+		r.Data = append(r.Data, decode(data))
+	}
+	r.DnameB64, r.TextB64, r.DataB64 = "", "", nil
+}
+
+// getZoneDetails downloads the zone's SOA and TXT records, which is all that's needed to change it, keeping a
+// snapshot of them if the client has a Cache.
+func (c *CpanelClient) getZoneDetails() (*cpanelZoneResponse, error) {
+	zoneResponse, err := c.parseZone(isChangeable)
+	if err != nil {
+		c.invalidateSnapshot(err.Error())
+		return zoneResponse, err
+	}
+
+	if c.Cache != nil {
+		c.Cache.put(c.cacheKey(), zoneResponse)
+	}
+	return zoneResponse, nil
+}
+
+// parseZone downloads the records of the zone that keep returns true for.
+func (c *CpanelClient) parseZone(keep func(record *cpanelZoneRecord) bool) (*cpanelZoneResponse, error) {
+	var zoneResponse cpanelZoneResponse
+	err := c.doRequest("/execute/DNS/parse_zone?zone="+url.QueryEscape(c.getDnsZoneNoDot()), "zone", &zoneReader{zone: &zoneResponse, keep: keep})
+	return &zoneResponse, err
+}
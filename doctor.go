@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/propagation"
+)
+
+// The record doctor adds and removes again to check that the zone can be changed.
+const doctorRecordName = "_cpanel-webhook-doctor"
+
+// The CPanel feature for the Zone Editor, which the DNS API needs.
+const zoneEditorFeature = "zoneedit"
+
+// doctor checks each zone of each of the Issuer's solvers for this webhook, going through the config and secret as
+// the webhook would for a Challenge and then on to CPanel itself. Checks against CPanel are made on the Issuer's own
+// cpanelUrl, while the test record is added to mirrors too.
+func (c *cli) doctor(args []string) error {
+	if err := expectArgs(args, 1); err != nil {
+		return err
+	}
+	kubeClient, cmClient, namespace, err := c.kubeClients(c.kubeconfig)
+	if err != nil {
+		return err
+	}
+	if c.namespace != "" {
+		namespace = c.namespace
+	}
+
+	// Requests from a ClusterIssuer have the cluster resource namespace, and by default allow ambient credentials
+	var issuer cmapi.GenericIssuer
+	kind := "Issuer"
+	resourceNamespace := namespace
+	if c.clusterIssuer {
+		kind = "ClusterIssuer"
+		resourceNamespace = clusterResourceNamespace
+		issuer, err = cmClient.CertmanagerV1().ClusterIssuers().Get(context.Background(), args[0], metav1.GetOptions{})
+	} else {
+		issuer, err = cmClient.CertmanagerV1().Issuers(namespace).Get(context.Background(), args[0], metav1.GetOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("could not get %s %s: %w", kind, args[0], err)
+	}
+	if issuer.GetSpec().ACME == nil {
+		return fmt.Errorf("%s %s isn't an ACME issuer", kind, args[0])
+	}
+
+	audit, err := c.auditSink()
+	if err != nil {
+		return err
+	}
+	locker, err := newZoneLocker(os.Getenv(zoneLocksEnv), kubeClient)
+	if err != nil {
+		return err
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	solver := &customDNSProviderSolver{
+		name:     getEnvOrDefault(solverNameEnv, defaultSolverName),
+		client:   kubeClient,
+		secrets:  newSecretCache(kubeClient, stopCh),
+		ambient:  newAmbientCredentials(os.Getenv(ambientCredentialsDirEnv)),
+		registry: newConfigMapOwnership(kubeClient, podNamespace, ownershipConfigMapName),
+		audit:    audit,
+		locker:   locker,
+		resolver: c.resolver,
+	}
+	if solver.resolver == nil {
+		solver.resolver = &propagation.NetResolver{}
+	}
+
+	report := &doctorReport{w: c.stdout}
+	found := false
+	for i, acmeSolver := range issuer.GetSpec().ACME.Solvers {
+		if acmeSolver.DNS01 == nil || acmeSolver.DNS01.Webhook == nil {
+			continue
+		}
+		webhook := acmeSolver.DNS01.Webhook
+		if webhook.SolverName != solver.Name() || (GroupName != "" && webhook.GroupName != GroupName) {
+			continue
+		}
+		found = true
+
+		zones, err := c.doctorZones(acmeSolver.Selector, webhook.Config)
+		if err != nil {
+			return fmt.Errorf("solver %d: %w", i, err)
+		}
+		for _, zone := range zones {
+			report.start(fmt.Sprintf("%s %s, solver %d, zone %s", kind, args[0], i, zone))
+			ch := &v1alpha1.ChallengeRequest{
+				UID:                     "cpanel-webhook-doctor",
+				ResourceNamespace:       resourceNamespace,
+				ResolvedZone:            zone + ".",
+				ResolvedFQDN:            doctorRecordName + "." + zone + ".",
+				Key:                     doctorRecordValue(),
+				Config:                  webhook.Config,
+				AllowAmbientCredentials: c.clusterIssuer,
+			}
+			c.doctorZone(report, solver, ch)
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s %s has no solver with solverName %s", kind, args[0], solver.Name())
+	}
+	if report.failed {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
+
+// The zones to check for a solver: the one given by -zone, otherwise those in its selector or config.
+func (c *cli) doctorZones(selector *acmev1.CertificateDNSNameSelector, config *extapi.JSON) ([]string, error) {
+	if c.zone != "" {
+		return []string{strings.TrimSuffix(c.zone, ".")}, nil
+	}
+
+	var zones []string
+	if selector != nil {
+		zones = append(zones, selector.DNSZones...)
+	}
+	if len(zones) == 0 {
+		// A broken config is reported by the checks, so needn't stop us here
+		cfg, _ := loadConfig(config)
+		for _, account := range cfg.Accounts {
+			zones = append(zones, account.Zones...)
+		}
+	}
+	if len(zones) == 0 {
+		return nil, errors.New("the zone to check can't be told from the Issuer, give it with -zone")
+	}
+	for i := range zones {
+		zones[i] = strings.TrimSuffix(zones[i], ".")
+	}
+	return zones, nil
+}
+
+func (c *cli) doctorZone(report *doctorReport, solver *customDNSProviderSolver, ch *v1alpha1.ChallengeRequest) {
+	zone := strings.TrimSuffix(ch.ResolvedZone, ".")
+	var cfg customDNSProviderConfig
+	report.check("Solver config is valid", func() error {
+		loaded, err := loadConfig(ch.Config)
+		if err != nil {
+			return err
+		}
+		cfg, err = loaded.forName(ch.ResolvedFQDN)
+		if err != nil {
+			return withHint(err, "Add the zone to one of the accounts in the solver config")
+		}
+		return nil
+	})
+
+	var client *cpanel.CpanelClient
+	credentialsCheck := "Secret is present"
+	ambient := cfg.SecretRef.Name == "" && ch.AllowAmbientCredentials
+	if ambient {
+		credentialsCheck = "Ambient credentials are available"
+	} else if namespace, name, err := solver.resolveSecretRef(ch, cfg.SecretRef); err == nil {
+		credentialsCheck = fmt.Sprintf("Secret %s/%s is present", namespace, name)
+	}
+	report.check(credentialsCheck, func() error {
+		var err error
+		client, err = solver.getZoneClient(ch, cfg, ch.ResolvedZone)
+		switch {
+		case err == nil:
+			return nil
+		case ambient:
+			return withHint(err, "Ambient credentials are read from the webhook's own environment, set CPANEL_USERNAME and CPANEL_PASSWORD (or CPANEL_API_TOKEN) to the same to check them from here")
+		case apierrors.IsNotFound(err):
+			return withHint(err, "Create the secret with the keys username and password (or apiToken), or fix the solver config's secretRef")
+		case apierrors.IsForbidden(err):
+			return withHint(err, "Your kubeconfig can't read the secret, try again with one that can")
+		}
+		return withHint(err, "Check the solver config's secretRef, including any usernameKey, passwordKey or apiTokenKey")
+	})
+
+	var domains *cpanel.Domains
+	report.check("Credentials are accepted", func() error {
+		var err error
+		domains, err = client.ListDomains()
+		var urlErr *url.Error
+		switch {
+		case err == nil:
+			return nil
+		case cpanel.ErrorReason(err) == cpanel.ReasonAuthenticationFailed:
+			return withHint(err, "Check the username and password or API token, and that the token hasn't expired or been revoked. Accounts with two-factor authentication need an API token.")
+		case errors.As(err, &urlErr):
+			return withHint(err, "Check that cpanelUrl is right and reachable from the cluster, usually on port 2083")
+		}
+		return err
+	})
+
+	report.check(fmt.Sprintf("Zone %s is in the account", zone), func() error {
+		for _, accountZone := range domains.Zones() {
+			if cpanel.CanonicalName(accountZone) == cpanel.CanonicalName(zone) {
+				return nil
+			}
+		}
+		for _, sub := range domains.Sub {
+			if cpanel.CanonicalName(sub) == cpanel.CanonicalName(zone) {
+				return withHint(fmt.Errorf("%s is a subdomain of the account rather than a zone", zone),
+					"Subdomains are served from the zone of the domain they belong to, so use that zone instead")
+			}
+		}
+		return withHint(fmt.Errorf("the account %s has the zones %s", client.Username, strings.Join(domains.Zones(), ", ")),
+			"Check that the credentials are for the account the domain is in")
+	})
+
+	report.check("Zone Editor feature is enabled", func() error {
+		enabled, err := client.HasFeature(zoneEditorFeature)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return withHint(fmt.Errorf("the account doesn't have the %s feature", zoneEditorFeature),
+				"Ask the hosting provider to enable the Zone Editor for the account's package")
+		}
+		return nil
+	})
+
+	report.check("Public NS records point at this CPanel server", func() error {
+		records, err := client.ListZoneRecords()
+		if err != nil {
+			return err
+		}
+		expected := map[string]bool{}
+		for _, record := range records {
+			if record.RecordType == "NS" && len(record.Data) > 0 && isZoneApex(record.Name, zone) {
+				expected[strings.TrimSuffix(cpanel.CanonicalName(record.Data[0]), ".")] = true
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		public, err := solver.resolver.LookupNS(ctx, zone)
+		if err != nil {
+			return withHint(err, "Check that the domain is registered and delegated")
+		}
+		var wrong []string
+		for _, nameserver := range public {
+			if !expected[strings.TrimSuffix(cpanel.CanonicalName(nameserver), ".")] {
+				wrong = append(wrong, nameserver)
+			}
+		}
+		if len(wrong) > 0 {
+			return withHint(fmt.Errorf("the zone is publicly served by %s, which aren't among the zone's NS records %s",
+				strings.Join(wrong, ", "), strings.Join(sortedKeys(expected), ", ")),
+				"Change the domain's nameservers at the registrar to those of the CPanel server, otherwise the ACME server won't see the records the webhook creates")
+		}
+		return nil
+	})
+
+	if c.skipWrite {
+		report.skip("A test TXT record can be added and removed", "-skip-write given")
+		return
+	}
+	report.check("A test TXT record can be added and removed", func() error {
+		txt, _, err := solver.getDnsClient(ch, &challengeEvents{request: ch})
+		if err != nil {
+			return err
+		}
+		if err := txt.SetDnsTxt(ch.ResolvedFQDN, ch.Key); err != nil {
+			return withHint(err, "Check the Zone Editor works for the account in the CPanel web interface")
+		}
+		if err := txt.ClearDnsTxt(ch.ResolvedFQDN, ch.Key); err != nil {
+			return withHint(err, fmt.Sprintf("Delete the %s TXT record from the zone by hand", ch.ResolvedFQDN))
+		}
+		return nil
+	})
+}
+
+func isZoneApex(name string, zone string) bool {
+	name = strings.TrimSuffix(cpanel.CanonicalName(name), ".")
+	return name == "" || name == "@" || name == strings.TrimSuffix(cpanel.CanonicalName(zone), ".")
+}
+
+func doctorRecordValue() string {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hintError is a failed check with a suggestion of how to fix it.
+type hintError struct {
+	err  error
+	hint string
+}
+
+func withHint(err error, hint string) error {
+	return &hintError{err: err, hint: hint}
+}
+
+func (e *hintError) Error() string {
+	return e.err.Error()
+}
+
+func (e *hintError) Unwrap() error {
+	return e.err
+}
+
+// doctorReport prints the outcome of each check. Checks build on those before them, so once one fails the rest
+// are skipped.
+type doctorReport struct {
+	w        io.Writer
+	failed   bool
+	skipping bool
+}
+
+// Start the checks of another zone.
+func (r *doctorReport) start(title string) {
+	fmt.Fprintf(r.w, "%s:\n", title)
+	r.skipping = false
+}
+
+func (r *doctorReport) check(name string, check func() error) {
+	if r.skipping {
+		r.skip(name, "an earlier check failed")
+		return
+	}
+
+	err := check()
+	if err == nil {
+		fmt.Fprintf(r.w, "  PASS  %s\n", name)
+		return
+	}
+	r.failed = true
+	r.skipping = true
+	fmt.Fprintf(r.w, "  FAIL  %s\n        %s\n", name, err)
+	var hinted *hintError
+	if errors.As(err, &hinted) {
+		fmt.Fprintf(r.w, "        Fix: %s\n", hinted.hint)
+	}
+}
+
+func (r *doctorReport) skip(name string, reason string) {
+	fmt.Fprintf(r.w, "  SKIP  %s (%s)\n", name, reason)
+}
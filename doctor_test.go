@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	cmfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// nsResolver serves fixed nameservers for every zone.
+type nsResolver []string
+
+func (r nsResolver) LookupNS(ctx context.Context, zone string) ([]string, error) {
+	return r, nil
+}
+
+func (r nsResolver) LookupTXTAt(ctx context.Context, nameserver string, name string) ([]string, error) {
+	return nil, nil
+}
+
+func newTestIssuer(server *httptest.Server, secretName string) *cmapi.Issuer {
+	return &cmapi.Issuer{
+		ObjectMeta: metav1.ObjectMeta{Name: "letsencrypt", Namespace: "cert-manager"},
+		Spec: cmapi.IssuerSpec{IssuerConfig: cmapi.IssuerConfig{ACME: &acmev1.ACMEIssuer{
+			Solvers: []acmev1.ACMEChallengeSolver{
+				{HTTP01: &acmev1.ACMEChallengeSolverHTTP01{}},
+				{
+					Selector: &acmev1.CertificateDNSNameSelector{DNSZones: []string{"test-domain.com"}},
+					DNS01: &acmev1.ACMEChallengeSolverDNS01{Webhook: &acmev1.ACMEIssuerDNS01ProviderWebhook{
+						SolverName: "cpanel-solver",
+						Config:     &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"cpanelUrl": %q, "secretRef": {"name": %q}}`, server.URL, secretName))},
+					}},
+				},
+			},
+		}}},
+	}
+}
+
+func runTestDoctor(issuer *cmapi.Issuer, resolver nsResolver, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	c := &cli{
+		stdout: &stdout,
+		kubeClients: func(kubeconfig string) (kubernetes.Interface, cmclient.Interface, string, error) {
+			return fake.NewSimpleClientset(newTestSecret("1", "password")), cmfake.NewSimpleClientset(issuer), "cert-manager", nil
+		},
+		resolver: resolver,
+	}
+	code := c.run(append([]string{"doctor"}, args...), &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestDoctorPasses(t *testing.T) {
+	fake, server := newFakeCpanelTLS(t, fakeRecord{Name: "_dmarc", TTL: 300, Data: []string{"v=DMARC1; p=none"}})
+	fake.nameservers = []string{"ns1.host.test.", "ns2.host.test."}
+
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	code, stdout, stderr := runTestDoctor(newTestIssuer(server, "cpanel-credentials"), nsResolver{"NS2.host.test.", "ns1.host.test."}, "-audit-log", "file:"+auditLog, "letsencrypt")
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, `Issuer letsencrypt, solver 1, zone test-domain.com:
+  PASS  Solver config is valid
+  PASS  Secret cert-manager/cpanel-credentials is present
+  PASS  Credentials are accepted
+  PASS  Zone test-domain.com is in the account
+  PASS  Zone Editor feature is enabled
+  PASS  Public NS records point at this CPanel server
+  PASS  A test TXT record can be added and removed
+`, stdout)
+	assert.Equal(t, 2, fake.mutations)
+	assert.Equal(t, []string{"_dmarc=v=DMARC1; p=none"}, fake.txtValues())
+
+	// The test record's changes are audited like any other
+	entries, err := os.ReadFile(auditLog)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(entries)), "\n")
+	assert.Len(t, lines, 2)
+	var entry cpanel.AuditEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "create", entry.Action)
+	assert.Equal(t, &cpanel.AuditTrigger{UID: "cpanel-webhook-doctor"}, entry.Trigger)
+}
+
+func TestDoctorReportsFailures(t *testing.T) {
+	fake, server := newFakeCpanelTLS(t)
+	fake.nameservers = []string{"ns1.host.test."}
+
+	code, stdout, _ := runTestDoctor(newTestIssuer(server, "missing"), nsResolver{"ns1.host.test."}, "letsencrypt")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, `Issuer letsencrypt, solver 1, zone test-domain.com:
+  PASS  Solver config is valid
+  FAIL  Secret cert-manager/missing is present
+        secrets "missing" not found
+        Fix: Create the secret with the keys username and password (or apiToken), or fix the solver config's secretRef
+  SKIP  Credentials are accepted (an earlier check failed)
+  SKIP  Zone test-domain.com is in the account (an earlier check failed)
+  SKIP  Zone Editor feature is enabled (an earlier check failed)
+  SKIP  Public NS records point at this CPanel server (an earlier check failed)
+  SKIP  A test TXT record can be added and removed (an earlier check failed)
+`, stdout)
+
+	fake.noZoneEditor = true
+	code, stdout, _ = runTestDoctor(newTestIssuer(server, "cpanel-credentials"), nsResolver{"ns1.host.test."}, "letsencrypt")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout, "  FAIL  Zone Editor feature is enabled\n        the account doesn't have the zoneedit feature\n")
+
+	fake.noZoneEditor = false
+	code, stdout, _ = runTestDoctor(newTestIssuer(server, "cpanel-credentials"), nsResolver{"ns1.other-host.test."}, "-skip-write", "letsencrypt")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout, "        the zone is publicly served by ns1.other-host.test., which aren't among the zone's NS records ns1.host.test\n")
+	assert.Contains(t, stdout, "  SKIP  A test TXT record can be added and removed (-skip-write given)\n")
+
+	code, stdout, _ = runTestDoctor(newTestIssuer(server, "cpanel-credentials"), nsResolver{"ns1.host.test."}, "-skip-write", "-zone", "www.test-domain.com", "letsencrypt")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout, "  FAIL  Zone www.test-domain.com is in the account\n        www.test-domain.com is a subdomain of the account rather than a zone\n")
+	assert.Equal(t, 0, fake.mutations)
+}
+
+func TestDoctorIssuerErrors(t *testing.T) {
+	_, server := newFakeCpanelTLS(t)
+
+	code, _, stderr := runTestDoctor(newTestIssuer(server, "cpanel-credentials"), nil, "other")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "Error: could not get Issuer other: issuers.cert-manager.io \"other\" not found\n", stderr)
+
+	code, _, stderr = runTestDoctor(newTestIssuer(server, "cpanel-credentials"), nil, "-cluster-issuer", "letsencrypt")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "could not get ClusterIssuer letsencrypt")
+
+	issuer := newTestIssuer(server, "cpanel-credentials")
+	issuer.Spec.ACME.Solvers = issuer.Spec.ACME.Solvers[:1]
+	code, _, stderr = runTestDoctor(issuer, nil, "letsencrypt")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "Error: Issuer letsencrypt has no solver with solverName cpanel-solver\n", stderr)
+
+	// Zones are locked as ZONE_LOCKS says, as for the webhook
+	t.Setenv(zoneLocksEnv, "shared")
+	code, _, stderr = runTestDoctor(newTestIssuer(server, "cpanel-credentials"), nil, "letsencrypt")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "Error: unknown ZONE_LOCKS \"shared\", expected lease or local\n", stderr)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	cminformers "github.com/cert-manager/cert-manager/pkg/client/informers/externalversions"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// Event reason for failures that happen before CPanel is even contacted.
+const reasonInvalidConfig = "InvalidConfig"
+
+// challengeEvents records Kubernetes Events against the Challenge (and its Issuer) behind a ChallengeRequest,
+// so that users can see why CPanel failed without digging through the webhook's logs.
+// The Challenge is only looked up once an Event actually needs to be recorded.
+type challengeEvents struct {
+	recorder   record.EventRecorder
+	challenges *challengeIndex
+	request    *v1alpha1.ChallengeRequest
+
+	looked    bool
+	challenge *acmev1.Challenge
+}
+
+func (c *customDNSProviderSolver) eventsFor(ch *v1alpha1.ChallengeRequest) *challengeEvents {
+	return &challengeEvents{
+		recorder:   c.recorder,
+		challenges: c.challenges,
+		request:    ch,
+	}
+}
+
+// Normal records an informational Event, its signature matching cpanel.CpanelClient's Notify.
+func (e *challengeEvents) Normal(reason string, message string) {
+	if e.recorder == nil {
+		return
+	}
+	challenge := e.getChallenge()
+	if challenge == nil {
+		return
+	}
+	e.recorder.Event(challenge, corev1.EventTypeNormal, reason, message)
+}
+
+// Failure records a warning Event for the error on both the Challenge and the Issuer it came from.
+// Errors from CPanel carry their own reason, anything else falls back to the given one.
+func (e *challengeEvents) Failure(fallbackReason string, err error) {
+	if e.recorder == nil {
+		return
+	}
+	challenge := e.getChallenge()
+	if challenge == nil {
+		return
+	}
+
+	reason := cpanel.ErrorReason(err)
+	if reason == cpanel.ReasonRequestFailed && fallbackReason != "" {
+		reason = fallbackReason
+	}
+	message := fmt.Sprintf("%s: %s", reason, err)
+	e.recorder.Event(challenge, corev1.EventTypeWarning, reason, message)
+
+	issuerRef := challenge.Spec.IssuerRef
+	issuer := &corev1.ObjectReference{
+		APIVersion: "cert-manager.io/v1",
+		Kind:       issuerRef.Kind,
+		Name:       issuerRef.Name,
+	}
+	if issuer.Kind == "" {
+		issuer.Kind = "Issuer"
+	}
+	if issuer.Kind == "Issuer" {
+		issuer.Namespace = challenge.Namespace
+	}
+	e.recorder.Eventf(issuer, corev1.EventTypeWarning, reason, "Challenge %s/%s: %s", challenge.Namespace, challenge.Name, message)
+}
+
+// AuditTrigger identifies the Challenge in audit entries, with just the request's UID if it can't be found.
+func (e *challengeEvents) AuditTrigger() *cpanel.AuditTrigger {
+	trigger := &cpanel.AuditTrigger{UID: string(e.request.UID)}
+	if challenge := e.getChallenge(); challenge != nil {
+		trigger.Namespace = challenge.Namespace
+		trigger.Name = challenge.Name
+		trigger.UID = string(challenge.UID)
+	}
+	return trigger
+}
+
+func (e *challengeEvents) getChallenge() *acmev1.Challenge {
+	if e.challenges == nil {
+		return nil
+	}
+	if !e.looked {
+		e.looked = true
+		challenge, err := e.challenges.find(e.request)
+		if err != nil {
+			log.Warnf("Could not find Challenge to record events (or audit changes) against: %s", err)
+		}
+		e.challenge = challenge
+	}
+	return e.challenge
+}
+
+// Indexes Challenges by the key they present, which (along with the DNS name) is all a request has to go on.
+const challengeKeyIndex = "spec.key"
+
+// challengeIndex finds the Challenge behind a request from an informer, rather than listing Challenges for every
+// request. ClusterIssuer Challenges can live in any namespace, so all of them are watched.
+type challengeIndex struct {
+	cmClient cmclient.Interface
+	informer cache.SharedIndexInformer
+}
+
+// newChallengeIndex starts watching Challenges until stopCh is closed. It syncs in the background, requests that
+// come before then only searching their own namespace.
+func newChallengeIndex(cmClient cmclient.Interface, stopCh <-chan struct{}) *challengeIndex {
+	factory := cminformers.NewSharedInformerFactory(cmClient, 0)
+	informer := factory.Acme().V1().Challenges().Informer()
+	err := informer.AddIndexers(cache.Indexers{
+		challengeKeyIndex: func(obj interface{}) ([]string, error) {
+			return []string{obj.(*acmev1.Challenge).Spec.Key}, nil
+		},
+	})
+	if err != nil {
+		// Only possible once the informer has started
+		log.Panic(err)
+	}
+	factory.Start(stopCh)
+	return &challengeIndex{cmClient: cmClient, informer: informer}
+}
+
+// hasKey returns whether any Challenge presents the key. It's only meaningful once the informer has synced.
+func (i *challengeIndex) hasKey(key string) bool {
+	objs, err := i.informer.GetIndexer().ByIndex(challengeKeyIndex, key)
+	return err == nil && len(objs) > 0
+}
+
+// find looks up the Challenge resource behind a request. The request doesn't name the Challenge, so we match on the
+// request's UID or otherwise the key and DNS name being presented.
+func (i *challengeIndex) find(ch *v1alpha1.ChallengeRequest) (*acmev1.Challenge, error) {
+	var challenges []*acmev1.Challenge
+	if i.informer.HasSynced() {
+		objs, err := i.informer.GetIndexer().ByIndex(challengeKeyIndex, ch.Key)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			challenges = append(challenges, obj.(*acmev1.Challenge))
+		}
+	} else {
+		log.Debugf("Challenges haven't synced yet, only searching namespace %s", ch.ResourceNamespace)
+		list, err := i.cmClient.AcmeV1().Challenges(ch.ResourceNamespace).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for j := range list.Items {
+			challenges = append(challenges, &list.Items[j])
+		}
+	}
+
+	var match *acmev1.Challenge
+	for _, challenge := range challenges {
+		if ch.UID != "" && challenge.UID == ch.UID {
+			return challenge, nil
+		}
+		if challenge.Spec.Key == ch.Key && challenge.Spec.DNSName == ch.DNSName {
+			match = challenge
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no Challenge found for %s", ch.DNSName)
+	}
+	return match, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	cmfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+func newTestChallenge(namespace string, issuerKind string) *acmev1.Challenge {
+	return &acmev1.Challenge{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "example-cert-1-2-3",
+			Namespace: namespace,
+		},
+		Spec: acmev1.ChallengeSpec{
+			DNSName: "example.test-domain.com",
+			Key:     "test-value",
+			IssuerRef: cmmeta.ObjectReference{
+				Name: "letsencrypt",
+				Kind: issuerKind,
+			},
+		},
+	}
+}
+
+// A challengeIndex over the given Challenges that has synced, so searches every namespace.
+func newTestChallengeIndex(t *testing.T, challenges ...runtime.Object) *challengeIndex {
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	index := newChallengeIndex(cmfake.NewSimpleClientset(challenges...), stopCh)
+	cache.WaitForCacheSync(stopCh, index.informer.HasSynced)
+	return index
+}
+
+func TestFindChallengeInOtherNamespace(t *testing.T) {
+	index := newTestChallengeIndex(t, newTestChallenge("app", "ClusterIssuer"))
+	ch := &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "cert-manager",
+		DNSName:           "example.test-domain.com",
+		Key:               "test-value",
+	}
+
+	challenge, err := index.find(ch)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", challenge.Namespace)
+
+	ch.Key = "other-value"
+	_, err = index.find(ch)
+	assert.EqualError(t, err, "no Challenge found for example.test-domain.com")
+}
+
+func TestFindChallengeBeforeSync(t *testing.T) {
+	cmClient := cmfake.NewSimpleClientset(newTestChallenge("app", "ClusterIssuer"))
+	stopCh := make(chan struct{})
+	close(stopCh)
+	index := newChallengeIndex(cmClient, stopCh)
+	ch := &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "app",
+		DNSName:           "example.test-domain.com",
+		Key:               "test-value",
+	}
+
+	challenge, err := index.find(ch)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", challenge.Namespace)
+
+	// Other namespaces are never listed
+	ch.ResourceNamespace = "cert-manager"
+	_, err = index.find(ch)
+	assert.EqualError(t, err, "no Challenge found for example.test-domain.com")
+	for _, action := range cmClient.Actions() {
+		assert.NotEqual(t, "", action.GetNamespace())
+	}
+}
+
+func TestEventsRecordedAgainstChallengeAndIssuer(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	solver := &customDNSProviderSolver{
+		challenges: newTestChallengeIndex(t, newTestChallenge("app", "Issuer")),
+		recorder:   recorder,
+	}
+	events := solver.eventsFor(&v1alpha1.ChallengeRequest{
+		ResourceNamespace: "app",
+		DNSName:           "example.test-domain.com",
+		Key:               "test-value",
+	})
+
+	events.Failure(reasonInvalidConfig, &cpanel.Error{Reason: cpanel.ReasonAuthenticationFailed, Message: "cPanel returned login page"})
+	assert.Equal(t, "Warning AuthenticationFailed AuthenticationFailed: cPanel returned login page", <-recorder.Events)
+	assert.Equal(t, "Warning AuthenticationFailed Challenge app/example-cert-1-2-3: AuthenticationFailed: cPanel returned login page", <-recorder.Events)
+
+	events.Failure(reasonInvalidConfig, errors.New("secret not found"))
+	assert.Equal(t, "Warning InvalidConfig InvalidConfig: secret not found", <-recorder.Events)
+	<-recorder.Events
+
+	events.Normal(cpanel.ReasonSerialConflictRetried, "retrying")
+	assert.Equal(t, "Normal SerialConflictRetried retrying", <-recorder.Events)
+}
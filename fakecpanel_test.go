@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// fakeCpanel is an in-memory CPanel serving enough of parse_zone and mass_edit_zone for a single zone to test the
+// webhook end to end. Line indexes are renumbered after every edit, as CPanel's are.
+type fakeCpanel struct {
+	mutex     sync.Mutex
+	serial    int
+	records   []fakeRecord
+	mutations int
+	zoneReads int
+
+	// The NS records at the apex, listed after the TXT records
+	nameservers []string
+
+	// Whether the account lacks the Zone Editor feature
+	noZoneEditor bool
+}
+
+type fakeRecord struct {
+	Name string
+	TTL  int
+	Data []string
+}
+
+func newFakeCpanel(t *testing.T, records ...fakeRecord) (*fakeCpanel, *httptest.Server) {
+	fake := &fakeCpanel{serial: 2022040505, records: records}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+// newFakeCpanelTLS serves the fake over https, so that it can be used in solver configs, trusting its certificate
+// for the rest of the test.
+func newFakeCpanelTLS(t *testing.T, records ...fakeRecord) (*fakeCpanel, *httptest.Server) {
+	fake := &fakeCpanel{serial: 2022040505, records: records}
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+	return fake, server
+}
+
+func (f *fakeCpanel) client(server *httptest.Server, zone string) *cpanel.CpanelClient {
+	return cpanel.NewCpanelClient(server.URL, "user", "password", "").ForZone(zone)
+}
+
+func (f *fakeCpanel) txtValues() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var values []string
+	for _, record := range f.records {
+		values = append(values, record.Name+"="+record.Data[0])
+	}
+	return values
+}
+
+func (f *fakeCpanel) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch req.URL.Path {
+	case "/execute/DNS/parse_zone":
+		f.zoneReads++
+		f.writeZone(w)
+	case "/execute/DNS/mass_edit_zone":
+		f.massEdit(w, req)
+	case "/execute/DomainInfo/list_domains":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data":   map[string]interface{}{"main_domain": "test-domain.com", "addon_domains": []string{}, "parked_domains": []string{}, "sub_domains": []string{"www.test-domain.com"}},
+			"status": 1,
+		})
+	case "/execute/Features/has_feature":
+		if f.noZoneEditor {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"The user does not have access to the feature “zoneedit”."}, "status": 0})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": 1})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (f *fakeCpanel) writeZone(w http.ResponseWriter) {
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	data := []map[string]interface{}{{
+		"line_index":  1,
+		"type":        "record",
+		"record_type": "SOA",
+		"dname_b64":   encode("test-domain.com."),
+		"data_b64":    []string{encode("ns1.test-domain.com."), encode("admin.test-domain.com."), encode(strconv.Itoa(f.serial)), encode("86400"), encode("7200"), encode("3600000"), encode("1800")},
+		"ttl":         86400,
+	}}
+	for i, record := range f.records {
+		var dataB64 []string
+		for _, value := range record.Data {
+			dataB64 = append(dataB64, encode(value))
+		}
+		data = append(data, map[string]interface{}{
+			"line_index":  i + 2,
+			"type":        "record",
+			"record_type": "TXT",
+			"dname_b64":   encode(record.Name),
+			"data_b64":    dataB64,
+			"ttl":         record.TTL,
+		})
+	}
+	for i, nameserver := range f.nameservers {
+		data = append(data, map[string]interface{}{
+			"line_index":  len(f.records) + i + 2,
+			"type":        "record",
+			"record_type": "NS",
+			"dname_b64":   encode("test-domain.com."),
+			"data_b64":    []string{encode(nameserver)},
+			"ttl":         86400,
+		})
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data, "status": 1})
+}
+
+func (f *fakeCpanel) massEdit(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("serial") != strconv.Itoa(f.serial) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"errors": []string{fmt.Sprintf("The given serial number (%s) does not match the DNS zone’s serial number (%d).", query.Get("serial"), f.serial)},
+			"status": 0,
+		})
+		return
+	}
+
+	removed := map[int]bool{}
+	for _, line := range query["remove"] {
+		lineIndex, _ := strconv.Atoi(line)
+		removed[lineIndex] = true
+	}
+	var records []fakeRecord
+	for i, record := range f.records {
+		if !removed[i+2] {
+			records = append(records, record)
+		}
+	}
+	for _, add := range query["add"] {
+		var record struct {
+			Dname string   `json:"dname"`
+			TTL   int      `json:"ttl"`
+			Data  []string `json:"data"`
+		}
+		_ = json.Unmarshal([]byte(add), &record)
+		records = append(records, fakeRecord{Name: record.Dname, TTL: record.TTL, Data: record.Data})
+	}
+
+	f.records = records
+	f.serial++
+	f.mutations++
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"new_serial": f.serial}, "status": 1})
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	log "github.com/sirupsen/logrus"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// The garbage collector is enabled by giving the path to its config in this environment variable.
+const gcConfigEnv = "GC_CONFIG"
+
+// Only records matching one of these patterns (relative to the zone) are ever deleted, whatever the config says.
+var gcDefaultRecordPatterns = []string{`^_acme-challenge(\..+)?$`}
+
+// gcConfig configures the garbage collector, which removes challenge records left behind in CPanel zones when
+// CleanUp never happened (e.g. the webhook crashed or the Challenge was deleted during an outage).
+// It's read as YAML or JSON from the file named by GC_CONFIG, typically a mounted ConfigMap.
+type gcConfig struct {
+	// How often to scan the zones, defaulting to an hour
+	Interval metav1.Duration `json:"interval"`
+
+	// How long a record must have been seen without an active Challenge before it's deleted, defaulting to a day.
+	// This is counted from when the webhook first saw the record, which is kept in a ConfigMap across restarts.
+	GracePeriod metav1.Duration `json:"gracePeriod"`
+
+	// Only log (and count) what would be deleted. This defaults to true, so deleting must be opted in to.
+	DryRun *bool `json:"dryRun"`
+
+	// Regular expressions of record names (relative to the zone) that may be deleted. Records must match one of
+	// these (if any are given) as well as the built in '_acme-challenge' and any of its subdomains.
+	RecordPatterns []string `json:"recordPatterns"`
+
+	// The zones to scan
+	Zones []gcZone `json:"zones"`
+}
+
+type gcZone struct {
+	// The zone to scan, e.g. example.com
+	Zone string `json:"zone"`
+
+	// The solver config of an Issuer for the zone, giving the CPanel URL and credentials. A secretRef without a
+	// namespace is looked for in the cluster resource namespace.
+	Config *extapi.JSON `json:"config"`
+}
+
+// When orphaned records were first seen is kept in this ConfigMap in the webhook's namespace.
+const gcConfigMapName = "cpanel-webhook-gc"
+
+func loadGcConfig(path string) (*gcConfig, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read garbage collector config: %w", err)
+	}
+
+	cfg := &gcConfig{}
+	if err := yaml.UnmarshalStrict(contents, cfg); err != nil {
+		return nil, fmt.Errorf("error decoding garbage collector config: %w", err)
+	}
+
+	if cfg.Interval.Duration == 0 {
+		cfg.Interval.Duration = time.Hour
+	}
+	if cfg.GracePeriod.Duration == 0 {
+		cfg.GracePeriod.Duration = 24 * time.Hour
+	}
+	if cfg.DryRun == nil {
+		dryRun := true
+		cfg.DryRun = &dryRun
+	}
+	for i, zone := range cfg.Zones {
+		if zone.Zone == "" {
+			return nil, fmt.Errorf("zones[%d].zone must be given", i)
+		}
+	}
+	return cfg, nil
+}
+
+// garbageCollector periodically scans zones for challenge records whose value doesn't belong to any Challenge
+// resource in the cluster, deleting those that have stayed that way for longer than the grace period.
+type garbageCollector struct {
+	solver          *customDNSProviderSolver
+	config          *gcConfig
+	defaultPatterns []*regexp.Regexp
+	patterns        []*regexp.Regexp
+
+	// Builds the clients for a zone, one for each server should it have mirrors, replaceable for testing
+	clientFor func(zone gcZone) ([]*cpanel.CpanelClient, error)
+	now       func() time.Time
+
+	// Where sightings are kept across restarts, if anywhere
+	state *gcState
+	// Whether the sightings have been loaded from the state yet
+	loaded bool
+
+	// When each orphaned record was first seen, keyed by gcKey
+	firstSeen map[string]gcSighting
+}
+
+// gcSighting is an orphaned record, on one of the servers of a zone.
+type gcSighting struct {
+	Owner     string    `json:"owner"`
+	Zone      string    `json:"zone"`
+	Server    string    `json:"server"`
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"firstSeen"`
+}
+
+func newGarbageCollector(solver *customDNSProviderSolver, cfg *gcConfig) (*garbageCollector, error) {
+	g := &garbageCollector{
+		solver:    solver,
+		config:    cfg,
+		now:       time.Now,
+		firstSeen: map[string]gcSighting{},
+	}
+	g.clientFor = g.getZoneClients
+	if solver.client != nil {
+		g.state = &gcState{client: solver.client, namespace: podNamespace, name: gcConfigMapName}
+	}
+
+	for _, pattern := range gcDefaultRecordPatterns {
+		g.defaultPatterns = append(g.defaultPatterns, regexp.MustCompile(pattern))
+	}
+	for _, pattern := range cfg.RecordPatterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record pattern %q: %w", pattern, err)
+		}
+		g.patterns = append(g.patterns, compiled)
+	}
+	return g, nil
+}
+
+// Run collects garbage every interval until stopCh is closed.
+func (g *garbageCollector) Run(stopCh <-chan struct{}) {
+	log.Infof("Garbage collecting challenge records in %d zones every %s (dry run: %t)", len(g.config.Zones), g.config.Interval.Duration, *g.config.DryRun)
+	wait.Until(g.collect, g.config.Interval.Duration, stopCh)
+}
+
+func (g *garbageCollector) collect() {
+	// Without knowing what was seen before the grace period would start over, so it's better to wait
+	if err := g.load(); err != nil {
+		log.Errorf("Could not load when orphaned records were first seen, skipping garbage collection: %s", err)
+		for _, zone := range g.config.Zones {
+			gcRunsTotal.WithLabelValues(zone.Zone, "error").Inc()
+		}
+		return
+	}
+
+	// Records are only orphaned if no Challenge presents them, which can't be told until every one has been seen
+	if g.solver.challenges == nil || !g.solver.challenges.informer.HasSynced() {
+		log.Errorf("Challenges haven't synced yet, skipping garbage collection")
+		for _, zone := range g.config.Zones {
+			gcRunsTotal.WithLabelValues(zone.Zone, "error").Inc()
+		}
+		return
+	}
+
+	for _, zone := range g.config.Zones {
+		err := g.collectZone(zone)
+		if err != nil {
+			log.Errorf("Could not garbage collect zone %s: %s", zone.Zone, err)
+			gcRunsTotal.WithLabelValues(zone.Zone, "error").Inc()
+			continue
+		}
+		gcRunsTotal.WithLabelValues(zone.Zone, "success").Inc()
+	}
+}
+
+func (g *garbageCollector) collectZone(zone gcZone) error {
+	clients, err := g.clientFor(zone)
+	if err != nil {
+		return err
+	}
+
+	orphaned, expired := 0, 0
+	var errs []error
+	for _, client := range clients {
+		orphanedCount, expiredCount, err := g.collectServer(zone, client)
+		orphaned += orphanedCount
+		expired += expiredCount
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.CpanelUrl, err))
+		}
+	}
+	gcOrphanedRecords.WithLabelValues(zone.Zone).Set(float64(orphaned))
+	gcExpiredRecords.WithLabelValues(zone.Zone).Set(float64(expired))
+
+	if err := g.save(zone); err != nil {
+		log.Errorf("Could not save when orphaned records in zone %s were first seen: %s", zone.Zone, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Collect the zone on one of its servers, returning how many orphaned records it has and how many of those are
+// past the grace period but still there (all of them in a dry run).
+func (g *garbageCollector) collectServer(zone gcZone, client *cpanel.CpanelClient) (int, int, error) {
+	records, err := client.ListTxtRecords()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := g.now()
+	server := client.CpanelUrl
+	orphaned := map[string]bool{}
+	var expired []cpanel.TxtRecord
+	for _, record := range records {
+		if !g.isChallengeRecord(record.Name) || g.solver.challenges.hasKey(record.Value) {
+			continue
+		}
+
+		key := gcKey(zone.Zone, server, record)
+		orphaned[key] = true
+		sighting, ok := g.firstSeen[key]
+		if !ok {
+			log.Infof("Found orphaned challenge record %s in zone %s on %s, deleting it after %s", record.Name, zone.Zone, server, g.config.GracePeriod.Duration)
+			sighting = gcSighting{Owner: ownerId, Zone: zone.Zone, Server: server, Name: record.Name, FirstSeen: now}
+			g.firstSeen[key] = sighting
+		}
+		if now.Sub(sighting.FirstSeen) >= g.config.GracePeriod.Duration {
+			expired = append(expired, record)
+		}
+	}
+
+	// Forget about records that have gone or become active again
+	for key, sighting := range g.firstSeen {
+		if sighting.Zone == zone.Zone && sighting.Server == server && !orphaned[key] {
+			delete(g.firstSeen, key)
+		}
+	}
+
+	if len(expired) == 0 {
+		return len(orphaned), 0, nil
+	}
+	if *g.config.DryRun {
+		for _, record := range expired {
+			log.Infof("Dry run: would delete orphaned challenge record %s with value %s from zone %s on %s", record.Name, record.Value, zone.Zone, server)
+		}
+		return len(orphaned), len(expired), nil
+	}
+
+	done, err := g.solver.work.start("deleting orphaned challenge records from zone "+zone.Zone, nil)
+	if err != nil {
+		return len(orphaned), len(expired), err
+	}
+	defer done()
+
+	// The client locks the zone, so this doesn't race the solver on the zone serial
+	deleted, err := client.RemoveTxtRecords(expired)
+	gcDeletedRecordsTotal.WithLabelValues(zone.Zone).Add(float64(deleted))
+	if err != nil {
+		return len(orphaned), len(expired), err
+	}
+	log.Infof("Deleted %d orphaned challenge records from zone %s on %s", deleted, zone.Zone, server)
+	for _, record := range expired {
+		key := gcKey(zone.Zone, server, record)
+		delete(g.firstSeen, key)
+		delete(orphaned, key)
+	}
+	return len(orphaned), 0, nil
+}
+
+// Sightings are keyed by a hash of the zone, server, name and value, as ConfigMap keys are restrictive.
+func gcKey(zone string, server string, record cpanel.TxtRecord) string {
+	return cpanel.HashValue(ownerId + "|" + zone + "|" + server + "|" + record.Name + "|" + record.Value)
+}
+
+// Load the sightings of earlier runs, if they haven't been already.
+func (g *garbageCollector) load() error {
+	if g.state == nil || g.loaded {
+		return nil
+	}
+	sightings, err := g.state.load()
+	if err != nil {
+		return err
+	}
+	for key, sighting := range sightings {
+		g.firstSeen[key] = sighting
+	}
+	g.loaded = true
+	return nil
+}
+
+// Save the zone's sightings, replacing those saved before.
+func (g *garbageCollector) save(zone gcZone) error {
+	if g.state == nil {
+		return nil
+	}
+	return g.state.save(zone.Zone, g.firstSeen)
+}
+
+// gcState keeps the garbage collector's sightings in a ConfigMap, so that the grace period of an orphaned record
+// isn't started over whenever the webhook restarts.
+type gcState struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// This deployment's sightings.
+func (s *gcState) load() (map[string]gcSighting, error) {
+	configMap, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(context.Background(), s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sightings := map[string]gcSighting{}
+	for key, value := range configMap.Data {
+		var sighting gcSighting
+		if err := json.Unmarshal([]byte(value), &sighting); err != nil {
+			log.Warnf("Ignoring unreadable garbage collector sighting %s: %s", key, err)
+			continue
+		}
+		if sighting.Owner == ownerId {
+			sightings[key] = sighting
+		}
+	}
+	return sightings, nil
+}
+
+// Replace this deployment's sightings in the zone with those given (from any zone).
+func (s *gcState) save(zone string, sightings map[string]gcSighting) error {
+	values := map[string]string{}
+	for key, sighting := range sightings {
+		if sighting.Zone != zone {
+			continue
+		}
+		value, err := json.Marshal(&sighting)
+		if err != nil {
+			return err
+		}
+		values[key] = string(value)
+	}
+
+	return updateConfigMap(s.client, s.namespace, s.name, func(data map[string]string) {
+		for key, value := range data {
+			var sighting gcSighting
+			if json.Unmarshal([]byte(value), &sighting) == nil && sighting.Owner == ownerId && sighting.Zone == zone {
+				delete(data, key)
+			}
+		}
+		for key, value := range values {
+			data[key] = value
+		}
+	})
+}
+
+func (g *garbageCollector) isChallengeRecord(name string) bool {
+	if !matchesAny(g.defaultPatterns, name) {
+		return false
+	}
+	return len(g.patterns) == 0 || matchesAny(g.patterns, name)
+}
+
+func matchesAny(patterns []*regexp.Regexp, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the clients for the zone, one for each of its servers should the config have mirrors.
+func (g *garbageCollector) getZoneClients(zone gcZone) ([]*cpanel.CpanelClient, error) {
+	// The config is the cluster admin's rather than a tenant's, so it's treated like a ClusterIssuer's
+	zoneName := strings.TrimSuffix(zone.Zone, ".") + "."
+	ch := &v1alpha1.ChallengeRequest{
+		ResourceNamespace:       clusterResourceNamespace,
+		AllowAmbientCredentials: true,
+		ResolvedFQDN:            zoneName,
+		ResolvedZone:            zoneName,
+		Config:                  zone.Config,
+	}
+	client, _, err := g.solver.getDnsClient(ch, &challengeEvents{request: ch})
+	if err != nil {
+		return nil, err
+	}
+
+	// Changes aren't made for a Challenge
+	clients := zoneClients(client)
+	for _, zoneClient := range clients {
+		zoneClient.Notify = nil
+		zoneClient.AuditTrigger = nil
+	}
+	return clients, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cmfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	cminformers "github.com/cert-manager/cert-manager/pkg/client/informers/externalversions"
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/component-base/metrics/testutil"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+func TestLoadGcConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gc.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+interval: 10m
+zones:
+- zone: test-domain.com
+  config:
+    cpanelUrl: https://cpanel.test-domain.com
+    secretRef:
+      name: cpanel-credentials
+`), 0600))
+
+	cfg, err := loadGcConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, cfg.Interval.Duration)
+	assert.Equal(t, 24*time.Hour, cfg.GracePeriod.Duration)
+	assert.True(t, *cfg.DryRun)
+	assert.Len(t, cfg.Zones, 1)
+	assert.JSONEq(t, `{"cpanelUrl": "https://cpanel.test-domain.com", "secretRef": {"name": "cpanel-credentials"}}`, string(cfg.Zones[0].Config.Raw))
+}
+
+func TestGarbageCollectorDeletesExpiredOrphans(t *testing.T) {
+	fake, server := newFakeCpanel(t,
+		fakeRecord{Name: "_acme-challenge.active", TTL: 300, Data: []string{"test-value"}},
+		fakeRecord{Name: "_acme-challenge.orphan", TTL: 300, Data: []string{"orphaned-value"}},
+		fakeRecord{Name: "_dmarc", TTL: 300, Data: []string{"v=DMARC1; p=none"}},
+	)
+	solver := &customDNSProviderSolver{
+		challenges: newTestChallengeIndex(t, newTestChallenge("app", "Issuer")),
+	}
+
+	dryRun := false
+	gc, err := newGarbageCollector(solver, &gcConfig{
+		GracePeriod: metav1.Duration{Duration: time.Hour},
+		DryRun:      &dryRun,
+		Zones:       []gcZone{{Zone: "test-domain.com"}},
+	})
+	assert.NoError(t, err)
+	gc.clientFor = func(zone gcZone) ([]*cpanel.CpanelClient, error) {
+		return []*cpanel.CpanelClient{fake.client(server, zone.Zone+".")}, nil
+	}
+	now := time.Now()
+	gc.now = func() time.Time { return now }
+
+	// The orphan isn't deleted until it's been seen for the grace period
+	gc.collect()
+	assert.Equal(t, 0, fake.mutations)
+
+	now = now.Add(2 * time.Hour)
+	gc.collect()
+	assert.Equal(t, 1, fake.mutations)
+	assert.Equal(t, []string{"_acme-challenge.active=test-value", "_dmarc=v=DMARC1; p=none"}, fake.txtValues())
+	assert.Empty(t, gc.firstSeen)
+}
+
+func TestGarbageCollectorDryRunCountsExpiredOnce(t *testing.T) {
+	fake, server := newFakeCpanel(t, fakeRecord{Name: "_acme-challenge.orphan", TTL: 300, Data: []string{"orphaned-value"}})
+	solver := &customDNSProviderSolver{
+		challenges: newTestChallengeIndex(t),
+	}
+
+	dryRun := true
+	gc, err := newGarbageCollector(solver, &gcConfig{
+		GracePeriod: metav1.Duration{Duration: time.Hour},
+		DryRun:      &dryRun,
+		Zones:       []gcZone{{Zone: "dry-run.test-domain.com"}},
+	})
+	assert.NoError(t, err)
+	gc.clientFor = func(zone gcZone) ([]*cpanel.CpanelClient, error) {
+		return []*cpanel.CpanelClient{fake.client(server, zone.Zone+".")}, nil
+	}
+	now := time.Now()
+	gc.now = func() time.Time { return now }
+
+	gc.collect()
+	expired, err := testutil.GetGaugeMetricValue(gcExpiredRecords.WithLabelValues("dry-run.test-domain.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, expired)
+
+	// Every pass reports the same record, rather than adding it up again
+	now = now.Add(2 * time.Hour)
+	gc.collect()
+	gc.collect()
+	expired, err = testutil.GetGaugeMetricValue(gcExpiredRecords.WithLabelValues("dry-run.test-domain.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, expired)
+	deleted, err := testutil.GetCounterMetricValue(gcDeletedRecordsTotal.WithLabelValues("dry-run.test-domain.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, deleted)
+	assert.Equal(t, 0, fake.mutations)
+}
+
+func TestGarbageCollectorWaitsForChallenges(t *testing.T) {
+	fake, server := newFakeCpanel(t, fakeRecord{Name: "_acme-challenge.orphan", TTL: 300, Data: []string{"orphaned-value"}})
+	// Never started, so never synced
+	solver := &customDNSProviderSolver{
+		challenges: &challengeIndex{informer: cminformers.NewSharedInformerFactory(cmfake.NewSimpleClientset(), 0).Acme().V1().Challenges().Informer()},
+	}
+
+	dryRun := false
+	gc, err := newGarbageCollector(solver, &gcConfig{
+		DryRun: &dryRun,
+		Zones:  []gcZone{{Zone: "test-domain.com"}},
+	})
+	assert.NoError(t, err)
+	gc.clientFor = func(zone gcZone) ([]*cpanel.CpanelClient, error) {
+		return []*cpanel.CpanelClient{fake.client(server, zone.Zone+".")}, nil
+	}
+
+	gc.collect()
+	assert.Equal(t, 0, fake.mutations)
+	assert.Equal(t, []string{"_acme-challenge.orphan=orphaned-value"}, fake.txtValues())
+}
+
+func TestGarbageCollectorRemembersSightings(t *testing.T) {
+	fake, server := newFakeCpanel(t, fakeRecord{Name: "_acme-challenge.orphan", TTL: 300, Data: []string{"orphaned-value"}})
+	solver := &customDNSProviderSolver{
+		client:     k8sfake.NewSimpleClientset(),
+		challenges: newTestChallengeIndex(t),
+	}
+	newCollector := func(now time.Time) *garbageCollector {
+		dryRun := false
+		gc, err := newGarbageCollector(solver, &gcConfig{
+			GracePeriod: metav1.Duration{Duration: time.Hour},
+			DryRun:      &dryRun,
+			Zones:       []gcZone{{Zone: "test-domain.com"}},
+		})
+		assert.NoError(t, err)
+		gc.clientFor = func(zone gcZone) ([]*cpanel.CpanelClient, error) {
+			return []*cpanel.CpanelClient{fake.client(server, zone.Zone+".")}, nil
+		}
+		gc.now = func() time.Time { return now }
+		return gc
+	}
+
+	now := time.Now()
+	newCollector(now).collect()
+	assert.Equal(t, 0, fake.mutations)
+
+	// The grace period isn't started over by a restart
+	newCollector(now.Add(2 * time.Hour)).collect()
+	assert.Equal(t, 1, fake.mutations)
+	assert.Empty(t, fake.txtValues())
+
+	configMap, err := solver.client.CoreV1().ConfigMaps(podNamespace).Get(context.Background(), gcConfigMapName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, configMap.Data)
+}
+
+func TestGarbageCollectorCollectsMirrors(t *testing.T) {
+	primary, primaryServer := newFakeCpanelTLS(t, fakeRecord{Name: "_acme-challenge", TTL: 300, Data: []string{"orphaned-value"}})
+	mirror, mirrorServer := newFakeCpanelTLS(t, fakeRecord{Name: "_acme-challenge", TTL: 300, Data: []string{"orphaned-value"}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	client := k8sfake.NewSimpleClientset(newTestSecret("1", "password"))
+	solver := &customDNSProviderSolver{
+		client:     client,
+		challenges: newTestChallengeIndex(t),
+		secrets:    newSecretCache(client, stopCh),
+	}
+
+	dryRun := false
+	gc, err := newGarbageCollector(solver, &gcConfig{
+		DryRun: &dryRun,
+		Zones: []gcZone{{
+			Zone: "test-domain.com",
+			Config: &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"cpanelUrl": %q, "secretRef": {"name": "cpanel-credentials"},
+				"mirrors": [{"cpanelUrl": %q, "secretRef": {"name": "cpanel-credentials"}}]}`, primaryServer.URL, mirrorServer.URL))},
+		}},
+	})
+	assert.NoError(t, err)
+
+	gc.collect()
+	assert.Empty(t, primary.txtValues())
+	assert.Empty(t, mirror.txtValues())
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	log "github.com/sirupsen/logrus"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// Where records are journalled between Present and CleanUp: "configmap" (the default) in a ConfigMap in the
+// webhook's namespace, or "none".
+const journalEnv = "JOURNAL"
+
+const (
+	journalConfigMap = "configmap"
+	journalNone      = "none"
+)
+
+const journalConfigMapName = "cpanel-webhook-journal"
+
+// Event reason for a record that couldn't be journalled, so wasn't presented.
+const reasonJournalFailed = "JournalFailed"
+
+// The most entries the journal holds, each a few hundred bytes, keeping its ConfigMap well within the 1MiB limit on
+// objects. Records aren't presented while it's full, as they then couldn't be cleaned up should the webhook die.
+const journalMaxEntries = 1000
+
+// configMapJournal keeps an entry for every record presented but not yet cleaned up, keyed by the UID of its
+// Challenge (which cert-manager doesn't send, so is looked up). An entry is written before the record is created
+// and removed once it's deleted, so should the webhook die in between (and the Challenge be deleted or retried
+// elsewhere), the record can still be cleaned up once it starts again. If the ConfigMap can't be used at all,
+// records go unjournalled for a while, with the ConfigMap tried again after longer and longer.
+type configMapJournal struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	// How long to go without journalling once the ConfigMap can't be used, doubling up to the maximum each time
+	// it still can't be
+	fallbackRetry    time.Duration
+	maxFallbackRetry time.Duration
+
+	now func() time.Time
+
+	mutex           sync.Mutex
+	fallbackUntil   time.Time
+	fallbackBackoff time.Duration
+}
+
+// journalEntry holds what's needed to clean up a record once its Challenge is gone: the solver config is found
+// again from its Issuer, and the record's value from the zone by its hash, so that neither need be kept here.
+type journalEntry struct {
+	Owner string    `json:"owner"`
+	UID   types.UID `json:"uid"`
+
+	// The Issuer (or ClusterIssuer) of the Challenge, and a hash of the config of its solver that presented the record
+	IssuerKind      string `json:"issuerKind"`
+	IssuerName      string `json:"issuerName"`
+	IssuerNamespace string `json:"issuerNamespace,omitempty"`
+	ConfigHash      string `json:"configHash"`
+
+	ResourceNamespace       string    `json:"resourceNamespace"`
+	FQDN                    string    `json:"fqdn"`
+	Zone                    string    `json:"zone"`
+	KeyHash                 string    `json:"keyHash"`
+	AllowAmbientCredentials bool      `json:"allowAmbientCredentials,omitempty"`
+	PresentTime             time.Time `json:"presentTime"`
+}
+
+func newConfigMapJournal(client kubernetes.Interface, namespace string, name string) *configMapJournal {
+	return &configMapJournal{
+		client:           client,
+		namespace:        namespace,
+		name:             name,
+		fallbackRetry:    30 * time.Second,
+		maxFallbackRetry: 10 * time.Minute,
+		now:              time.Now,
+	}
+}
+
+// newJournal creates the journal given by the JOURNAL setting, or none.
+func newJournal(mode string, client kubernetes.Interface) (*configMapJournal, error) {
+	switch mode {
+	case "", journalConfigMap:
+		return newConfigMapJournal(client, podNamespace, journalConfigMapName), nil
+	case journalNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown %s %q, expected %s or %s", journalEnv, mode, journalConfigMap, journalNone)
+}
+
+// Record journals the record for a challenge, before it's presented. Without its Challenge there's no Issuer to clean
+// it up with, so it isn't journalled.
+func (j *configMapJournal) Record(ch *v1alpha1.ChallengeRequest, challenge *acmev1.Challenge) error {
+	if challenge == nil {
+		log.Warnf("Not journalling the record for %s, as its Challenge wasn't found", ch.ResolvedFQDN)
+		return nil
+	}
+
+	issuerKind := challenge.Spec.IssuerRef.Kind
+	if issuerKind == "" {
+		issuerKind = "Issuer"
+	}
+	var issuerNamespace string
+	if issuerKind == "Issuer" {
+		issuerNamespace = challenge.Namespace
+	}
+	entry, err := json.Marshal(&journalEntry{
+		Owner:                   ownerId,
+		UID:                     challenge.UID,
+		IssuerKind:              issuerKind,
+		IssuerName:              challenge.Spec.IssuerRef.Name,
+		IssuerNamespace:         issuerNamespace,
+		ConfigHash:              configHash(ch.Config),
+		ResourceNamespace:       ch.ResourceNamespace,
+		FQDN:                    ch.ResolvedFQDN,
+		Zone:                    ch.ResolvedZone,
+		KeyHash:                 cpanel.HashValue(ch.Key),
+		AllowAmbientCredentials: ch.AllowAmbientCredentials,
+		PresentTime:             time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var full bool
+	err = j.update(func(data map[string]string) {
+		if _, ok := data[string(challenge.UID)]; !ok && len(data) >= journalMaxEntries {
+			full = true
+			return
+		}
+		data[string(challenge.UID)] = string(entry)
+	})
+	if err == nil && full {
+		err = fmt.Errorf("ConfigMap %s/%s already holds %d entries, the most it can", j.namespace, j.name, journalMaxEntries)
+	}
+	return err
+}
+
+// Remove drops the record for a challenge from the journal, once it's been cleaned up. It's matched on the record
+// rather than the key, as the Challenge may already be gone.
+func (j *configMapJournal) Remove(ch *v1alpha1.ChallengeRequest) error {
+	keyHash := cpanel.HashValue(ch.Key)
+	return j.update(func(data map[string]string) {
+		for key, value := range data {
+			var entry journalEntry
+			if json.Unmarshal([]byte(value), &entry) != nil {
+				continue
+			}
+			if entry.Owner == ownerId && entry.FQDN == ch.ResolvedFQDN && entry.KeyHash == keyHash {
+				delete(data, key)
+			}
+		}
+	})
+}
+
+// Drop removes an entry whose record is already gone, or can't be cleaned up.
+func (j *configMapJournal) Drop(entry journalEntry) error {
+	return j.update(func(data map[string]string) {
+		delete(data, string(entry.UID))
+	})
+}
+
+// Entries returns this deployment's journalled records, oldest first.
+func (j *configMapJournal) Entries() ([]journalEntry, error) {
+	if j.isFallingBack() {
+		return nil, nil
+	}
+	configMap, err := j.client.CoreV1().ConfigMaps(j.namespace).Get(context.Background(), j.name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		if j.fallBackOn(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	j.recover()
+	if err != nil {
+		// Nothing's been journalled yet
+		return nil, nil
+	}
+
+	var entries []journalEntry
+	for key, value := range configMap.Data {
+		var entry journalEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			log.Warnf("Ignoring unreadable journal entry %s: %s", key, err)
+			continue
+		}
+		if entry.Owner != ownerId {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, k int) bool {
+		return entries[i].PresentTime.Before(entries[k].PresentTime)
+	})
+	return entries, nil
+}
+
+// Change the journal's entries, creating the ConfigMap if needed and retrying on conflicting writes.
+func (j *configMapJournal) update(mutate func(data map[string]string)) error {
+	if j.isFallingBack() {
+		return nil
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	err := updateConfigMap(j.client, j.namespace, j.name, mutate)
+	if err != nil {
+		if j.fallBackOnLocked(err) {
+			return nil
+		}
+		return err
+	}
+	j.recoverLocked()
+	return nil
+}
+
+func (j *configMapJournal) isFallingBack() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.now().Before(j.fallbackUntil)
+}
+
+// Go without journalling for a while if the webhook isn't allowed to use the ConfigMap, rather than failing every
+// challenge over a record that's only needed should it die. Each time it still isn't, it's for twice as long.
+func (j *configMapJournal) fallBackOn(err error) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.fallBackOnLocked(err)
+}
+
+func (j *configMapJournal) fallBackOnLocked(err error) bool {
+	if !apierrors.IsForbidden(err) {
+		return false
+	}
+	if j.fallbackBackoff == 0 {
+		j.fallbackBackoff = j.fallbackRetry
+	} else {
+		j.fallbackBackoff = min(2*j.fallbackBackoff, j.maxFallbackRetry)
+	}
+	j.fallbackUntil = j.now().Add(j.fallbackBackoff)
+	journalFallback.Set(1)
+	log.Warnf("Can't use ConfigMap %s/%s to journal records, not journalling them for %s: %s", j.namespace, j.name, j.fallbackBackoff, err)
+	return true
+}
+
+// The ConfigMap can be used again, so journal records again.
+func (j *configMapJournal) recover() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.recoverLocked()
+}
+
+func (j *configMapJournal) recoverLocked() {
+	if j.fallbackBackoff == 0 {
+		return
+	}
+	j.fallbackBackoff = 0
+	journalFallback.Set(0)
+	log.Infof("ConfigMap %s/%s can be used to journal records again", j.namespace, j.name)
+}
+
+// Solver configs are told apart by a hash of them, should an Issuer have several for the webhook.
+func configHash(config *extapi.JSON) string {
+	if config == nil {
+		return cpanel.HashValue("")
+	}
+	return cpanel.HashValue(string(config.Raw))
+}
+
+// reconcileJournal cleans up the journalled records whose Challenges are gone, which were left behind when the
+// webhook died between presenting and cleaning them up. Records already gone from their zone are just dropped from
+// the journal. Those of live Challenges are left for cert-manager to clean up as usual.
+func (c *customDNSProviderSolver) reconcileJournal() error {
+	// Read before the Challenges, so that an entry can't be written for a Challenge created in between
+	entries, err := c.journal.Entries()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	challenges, err := c.cmClient.AcmeV1().Challenges(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	liveUIDs := map[types.UID]bool{}
+	for _, challenge := range challenges.Items {
+		liveUIDs[challenge.UID] = true
+	}
+
+	var failed int
+	for _, entry := range entries {
+		if liveUIDs[entry.UID] {
+			continue
+		}
+		log.Infof("Challenge for %s presented at %s is gone, cleaning up its record", entry.FQDN, entry.PresentTime)
+		if err := c.cleanUpJournalled(entry); err != nil {
+			log.Errorf("Could not clean up journalled record %s, will try again on restart: %s", entry.FQDN, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not clean up %d journalled records", failed)
+	}
+	return nil
+}
+
+// Clean up a journalled record with its Issuer's solver config, finding its value in the zone.
+func (c *customDNSProviderSolver) cleanUpJournalled(entry journalEntry) error {
+	config, err := c.journalledConfig(entry)
+	if errors.Is(err, errJournalledSolverGone) {
+		log.Warnf("Dropping journalled record %s, leaving it to the garbage collector: %s", entry.FQDN, err)
+		return c.journal.Drop(entry)
+	}
+	if err != nil {
+		return err
+	}
+
+	ch := &v1alpha1.ChallengeRequest{
+		Action:                  v1alpha1.ChallengeActionCleanUp,
+		Type:                    "dns-01",
+		DNSName:                 strings.TrimSuffix(entry.FQDN, "."),
+		ResourceNamespace:       entry.ResourceNamespace,
+		ResolvedFQDN:            entry.FQDN,
+		ResolvedZone:            entry.Zone,
+		AllowAmbientCredentials: entry.AllowAmbientCredentials,
+		Config:                  config,
+	}
+	client, _, err := c.getDnsClient(ch, c.eventsFor(ch))
+	if err != nil {
+		return err
+	}
+	for _, zoneClient := range zoneClients(client) {
+		records, err := zoneClient.ListTxtRecords()
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if cpanel.HashValue(record.Value) == entry.KeyHash {
+				ch.Key = record.Value
+				return c.CleanUp(ch)
+			}
+		}
+	}
+
+	log.Infof("Journalled record %s is already gone", entry.FQDN)
+	return c.journal.Drop(entry)
+}
+
+var errJournalledSolverGone = errors.New("its Issuer no longer has the solver that presented it")
+
+// The config of the journalled record's solver, from its Issuer. Should the Issuer have been changed since, its only
+// solver for the webhook is taken to be the one.
+func (c *customDNSProviderSolver) journalledConfig(entry journalEntry) (*extapi.JSON, error) {
+	var issuer cmapi.GenericIssuer
+	var err error
+	if entry.IssuerKind == "ClusterIssuer" {
+		issuer, err = c.cmClient.CertmanagerV1().ClusterIssuers().Get(context.Background(), entry.IssuerName, metav1.GetOptions{})
+	} else {
+		issuer, err = c.cmClient.CertmanagerV1().Issuers(entry.IssuerNamespace).Get(context.Background(), entry.IssuerName, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%s %s is gone: %w", entry.IssuerKind, entry.IssuerName, errJournalledSolverGone)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if issuer.GetSpec().ACME == nil {
+		return nil, errJournalledSolverGone
+	}
+
+	var candidates []*extapi.JSON
+	for _, solver := range issuer.GetSpec().ACME.Solvers {
+		if solver.DNS01 == nil || solver.DNS01.Webhook == nil {
+			continue
+		}
+		webhook := solver.DNS01.Webhook
+		if webhook.SolverName != c.Name() || (GroupName != "" && webhook.GroupName != GroupName) {
+			continue
+		}
+		if configHash(webhook.Config) == entry.ConfigHash {
+			return webhook.Config, nil
+		}
+		candidates = append(candidates, webhook.Config)
+	}
+	if len(candidates) != 1 {
+		return nil, errJournalledSolverGone
+	}
+	return candidates[0], nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/component-base/metrics/testutil"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// A solver journalling to a fake cluster with the Challenges, and the letsencrypt Issuer in the app namespace whose
+// config it returns.
+func newJournalTestSolver(t *testing.T, challenges ...*acmev1.Challenge) (*customDNSProviderSolver, *fakeCpanel, *extapi.JSON) {
+	cpanel, server := newFakeCpanelTLS(t)
+	config := &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"cpanelUrl": %q, "secretRef": {"name": "cpanel-credentials"}}`, server.URL))}
+	objects := []runtime.Object{newJournalTestIssuer(config)}
+	for _, challenge := range challenges {
+		objects = append(objects, challenge)
+	}
+	cmClient := cmfake.NewSimpleClientset(objects...)
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	challengeIndex := newChallengeIndex(cmClient, stopCh)
+	cache.WaitForCacheSync(stopCh, challengeIndex.informer.HasSynced)
+
+	client := fake.NewSimpleClientset(newTestSecret("1", "password"))
+	solver := &customDNSProviderSolver{
+		client:     client,
+		cmClient:   cmClient,
+		challenges: challengeIndex,
+		secrets:    newSecretCache(client, stopCh),
+		journal:    newConfigMapJournal(client, "cert-manager", journalConfigMapName),
+	}
+	return solver, cpanel, config
+}
+
+func newJournalTestIssuer(config *extapi.JSON) *cmapi.Issuer {
+	return &cmapi.Issuer{
+		ObjectMeta: metav1.ObjectMeta{Name: "letsencrypt", Namespace: "app"},
+		Spec: cmapi.IssuerSpec{IssuerConfig: cmapi.IssuerConfig{ACME: &acmev1.ACMEIssuer{
+			Solvers: []acmev1.ACMEChallengeSolver{
+				{DNS01: &acmev1.ACMEChallengeSolverDNS01{Webhook: &acmev1.ACMEIssuerDNS01ProviderWebhook{
+					SolverName: defaultSolverName,
+					Config:     &extapi.JSON{Raw: []byte(`{"cpanelUrl": "https://other.test-domain.com", "secretRef": {"name": "cpanel-credentials"}}`)},
+				}}},
+				{DNS01: &acmev1.ACMEChallengeSolverDNS01{Webhook: &acmev1.ACMEIssuerDNS01ProviderWebhook{
+					SolverName: defaultSolverName,
+					Config:     config,
+				}}},
+			},
+		}}},
+	}
+}
+
+func newJournalTestChallenge(name string, key string) *acmev1.Challenge {
+	challenge := newTestChallenge("app", "Issuer")
+	challenge.Name = name
+	challenge.UID = types.UID(name + "-uid")
+	challenge.Spec.Key = key
+	return challenge
+}
+
+func newJournalTestRequest(config *extapi.JSON, key string) *v1alpha1.ChallengeRequest {
+	// Challenges are looked for in every namespace, as for a ClusterIssuer
+	return &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "cert-manager",
+		DNSName:           "example.test-domain.com",
+		ResolvedZone:      "test-domain.com.",
+		ResolvedFQDN:      "_acme-challenge.example.test-domain.com.",
+		Key:               key,
+		Config:            config,
+	}
+}
+
+func TestJournalRecordsUntilCleanUp(t *testing.T) {
+	solver, _, config := newJournalTestSolver(t, newJournalTestChallenge("challenge", "test-value"))
+	ch := newJournalTestRequest(config, "test-value")
+
+	assert.NoError(t, solver.Present(ch))
+	entries, err := solver.journal.Entries()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "challenge-uid", string(entries[0].UID))
+		assert.Equal(t, "Issuer", entries[0].IssuerKind)
+		assert.Equal(t, "letsencrypt", entries[0].IssuerName)
+		assert.Equal(t, "app", entries[0].IssuerNamespace)
+		assert.Equal(t, configHash(config), entries[0].ConfigHash)
+		assert.Equal(t, "_acme-challenge.example.test-domain.com.", entries[0].FQDN)
+		assert.Equal(t, cpanel.HashValue("test-value"), entries[0].KeyHash)
+	}
+
+	// Neither the key nor the config are kept
+	configMap, err := solver.client.CoreV1().ConfigMaps("cert-manager").Get(context.Background(), journalConfigMapName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	if assert.Contains(t, configMap.Data, "challenge-uid") {
+		assert.NotContains(t, configMap.Data["challenge-uid"], "test-value")
+		assert.NotContains(t, configMap.Data["challenge-uid"], "cpanelUrl")
+	}
+
+	assert.NoError(t, solver.CleanUp(ch))
+	entries, err = solver.journal.Entries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestJournalSkipsUnknownChallenges(t *testing.T) {
+	solver, server, config := newJournalTestSolver(t)
+
+	// There'd be no Issuer to clean it up with
+	assert.NoError(t, solver.Present(newJournalTestRequest(config, "test-value")))
+	assert.Equal(t, []string{"_acme-challenge.example=test-value"}, server.txtValues())
+	entries, err := solver.journal.Entries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestJournalReconciles(t *testing.T) {
+	gone := newJournalTestChallenge("gone", "gone-value")
+	alreadyGone := newJournalTestChallenge("already-gone", "already-gone-value")
+	issuerGone := newJournalTestChallenge("issuer-gone", "issuer-gone-value")
+	issuerGone.Spec.IssuerRef.Name = "deleted"
+	live := newJournalTestChallenge("live", "live-value")
+	solver, server, config := newJournalTestSolver(t, gone, alreadyGone, issuerGone, live)
+
+	// Presented records whose Challenges are then deleted while the webhook is down
+	assert.NoError(t, solver.Present(newJournalTestRequest(config, "gone-value")))
+	assert.NoError(t, solver.journal.Record(newJournalTestRequest(config, "already-gone-value"), alreadyGone))
+	assert.NoError(t, solver.Present(newJournalTestRequest(config, "issuer-gone-value")))
+	assert.NoError(t, solver.Present(newJournalTestRequest(config, "live-value")))
+	for _, name := range []string{"gone", "already-gone", "issuer-gone"} {
+		assert.NoError(t, solver.cmClient.AcmeV1().Challenges("app").Delete(context.Background(), name, metav1.DeleteOptions{}))
+	}
+	assert.Equal(t, []string{
+		"_acme-challenge.example=gone-value",
+		"_acme-challenge.example=issuer-gone-value",
+		"_acme-challenge.example=live-value",
+	}, server.txtValues())
+
+	// The record is found by its hash, and cleaned up with the Issuer's config. One whose Issuer is gone is left to gc.
+	assert.NoError(t, solver.reconcileJournal())
+	assert.Equal(t, []string{
+		"_acme-challenge.example=issuer-gone-value",
+		"_acme-challenge.example=live-value",
+	}, server.txtValues())
+	entries, err := solver.journal.Entries()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "live-uid", string(entries[0].UID))
+	}
+
+	// Other deployments' entries are left alone
+	ownerId = "other-webhook"
+	defer func() { ownerId = GroupName }()
+	entries, err = solver.journal.Entries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestJournalFull(t *testing.T) {
+	solver, server, config := newJournalTestSolver(t, newJournalTestChallenge("challenge", "test-value"))
+	data := map[string]string{}
+	for i := 0; i < journalMaxEntries; i++ {
+		data[fmt.Sprintf("uid-%d", i)] = "{}"
+	}
+	_, err := solver.client.CoreV1().ConfigMaps("cert-manager").Create(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: journalConfigMapName, Namespace: "cert-manager"},
+		Data:       data,
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// The record isn't presented, as it couldn't be cleaned up should the webhook die
+	err = solver.Present(newJournalTestRequest(config, "test-value"))
+	assert.EqualError(t, err, "could not journal record before presenting it: ConfigMap cert-manager/cpanel-webhook-journal already holds 1000 entries, the most it can")
+	assert.Empty(t, server.txtValues())
+}
+
+func TestJournalFallsBack(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	forbidden := true
+	client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !forbidden {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, journalConfigMapName, nil)
+	})
+	journal := newConfigMapJournal(client, "cert-manager", journalConfigMapName)
+	now := time.Now()
+	journal.now = func() time.Time { return now }
+	fallback := func() float64 {
+		value, err := testutil.GetGaugeMetricValue(journalFallback)
+		assert.NoError(t, err)
+		return value
+	}
+
+	ch := newJournalTestRequest(nil, "test-value")
+	challenge := newJournalTestChallenge("challenge", "test-value")
+	assert.NoError(t, journal.Record(ch, challenge))
+	assert.NoError(t, journal.Remove(ch))
+	entries, err := journal.Entries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Len(t, client.Actions(), 1)
+	assert.Equal(t, float64(1), fallback())
+
+	// The ConfigMap is tried again once the backoff is up, for twice as long each time it still can't be used
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, journal.Record(ch, challenge))
+	assert.Len(t, client.Actions(), 2)
+	assert.Equal(t, time.Minute, journal.fallbackBackoff)
+
+	// Until it can be again
+	forbidden = false
+	now = now.Add(time.Minute)
+	assert.NoError(t, journal.Record(ch, challenge))
+	assert.Equal(t, time.Duration(0), journal.fallbackBackoff)
+	assert.Equal(t, float64(0), fallback())
+	entries, err = journal.Entries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestNewJournal(t *testing.T) {
+	journal, err := newJournal("", fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	assert.NotNil(t, journal)
+
+	journal, err = newJournal("none", fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	assert.Nil(t, journal)
+
+	_, err = newJournal("crd", fake.NewSimpleClientset())
+	assert.EqualError(t, err, `unknown JOURNAL "crd", expected configmap or none`)
+}
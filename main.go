@@ -1,43 +1,60 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"strings"
-	"sync"
 
 	corev1 "k8s.io/api/core/v1"
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 
-	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/cmd"
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	cmscheme "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/scheme"
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/propagation"
 	log "github.com/sirupsen/logrus"
 )
 
 var GroupName = os.Getenv("GROUP_NAME")
 
 func main() {
+	// Operator subcommands are run instead of the server, which itself only takes flags
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCli(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	log.SetLevel(log.DebugLevel)
 	log.Info("cert-manager CPanel webhook solver starting, v0.3.0")
 	if GroupName == "" {
 		log.Panic("GROUP_NAME must be specified as an environment variable")
 	}
+	solver, solvers, err := newSolvers(getEnvOrDefault(solverNameEnv, defaultSolverName), os.Getenv(solverVariantsEnv))
+	if err != nil {
+		log.Panic(err)
+	}
+	timeout, err := shutdownTimeout()
+	if err != nil {
+		log.Panic(err)
+	}
 
 	// This will register our custom DNS provider with the webhook serving
 	// library, making it available as an API under the provided GroupName.
 	// You can register multiple DNS provider implementations with a single
 	// webhook, where the Name() method will be used to disambiguate between
 	// the different implementations.
-	cmd.RunWebhookServer(GroupName,
-		&customDNSProviderSolver{},
-	)
+	cmd.RunWebhookServer(GroupName, solvers...)
+
+	// The server returns once it's been told to stop, leaving the changes it started to finish
+	solver.drain(timeout)
 }
 
 // customDNSProviderSolver implements the provider-specific logic needed to
@@ -45,12 +62,31 @@ func main() {
 // To do so, it must implement the `github.com/jetstack/cert-manager/pkg/acme/webhook.Solver`
 // interface.
 type customDNSProviderSolver struct {
-	client *kubernetes.Clientset
+	// The solverName Issuers use, defaulting to cpanel-solver
+	name string
+
+	client   kubernetes.Interface
+	cmClient cmclient.Interface
+	recorder record.EventRecorder
+	events   record.EventBroadcaster
+	secrets  *secretCache
+	ambient  *ambientCredentials
+	registry *configMapOwnership
+	audit    cpanel.AuditSink
+	locker   cpanel.ZoneLocker
+	journal  *configMapJournal
+	cache    *cpanel.ZoneCache
+
+	// Finds the Challenge behind a request, to record events against it
+	challenges *challengeIndex
+
+	// Queries nameservers for the propagation check, replaceable for testing
+	resolver propagation.Resolver
 
-	// CPanel requires the zone serial in requests. This value could be sent in two requests concurrently
-	// but only one will win and actually be persisted in the zone file - there's not even an error back from CPanel.
-	// We therefore use this mutex to disallow concurrent requests to CPanel if multiple DNS names are given.
-	mutex sync.Mutex
+	// Changes under way, so they can finish before the webhook shuts down
+	work workTracker
+	// Closed once the webhook's been told to stop
+	stopCh <-chan struct{}
 }
 
 // customDNSProviderConfig is a structure that is used to decode into when
@@ -71,12 +107,50 @@ type customDNSProviderConfig struct {
 	// These fields will be set by users in the
 	// `issuer.spec.acme.dns01.providers.webhook.config` field.
 
-	// The URL to a CPanel instance without a trailing slash, e.g. https://cpanel.mydomain.com
-	CpanelUrl string `json:"cpanelUrl"`
+	// The https URL to a CPanel instance, e.g. https://cpanel.mydomain.com (a trailing slash is ignored), or a list
+	// of URLs for the same account to fail over between
+	CpanelUrl cpanelUrls `json:"cpanelUrl"`
 
-	// A reference to a secret, in the form "namespace/secret-name"
-	// This secret should have data of 'username' and 'password'
-	SecretRef string `json:"secretRef"`
+	// A reference to a secret, either as an object of name and optional namespace or in the form "namespace/secret-name".
+	// This secret should have data of 'username' and 'password' (or 'apiToken')
+	SecretRef secretReference `json:"secretRef"`
+
+	// The TTL of new challenge records, defaulting to 300
+	Ttl int `json:"ttl,omitempty"`
+
+	// Bounds on the TTL of existing TXT records sharing the name of a new record, as they must all have the same TTL
+	MinTtl int `json:"minTtl,omitempty"`
+	MaxTtl int `json:"maxTtl,omitempty"`
+
+	// What to do when existing records have a TTL outside of minTtl and maxTtl, one of "adopt" (the default) to use
+	// their TTL anyway, "rewrite" to change them all to the new TTL, or "fail"
+	TtlConflictPolicy cpanel.TtlConflictStrategy `json:"ttlConflictPolicy,omitempty"`
+
+	// How to keep track of the records created by the webhook, so that only those are ever deleted: "marker" for a
+	// companion TXT record alongside each, or "registry" for a ConfigMap. By default any matching record is deleted.
+	Ownership string `json:"ownership,omitempty"`
+
+	// If given, Present waits for the record to be served by every authoritative nameserver of the zone
+	PropagationCheck *propagationCheckConfig `json:"propagationCheck,omitempty"`
+
+	// Several CPanel accounts, each serving some of the zones, in place of cpanelUrl and secretRef
+	Accounts []cpanelAccount `json:"accounts,omitempty"`
+
+	// Further CPanel servers independently serving the same zones, which every change is also made on
+	Mirrors []cpanelMirror `json:"mirrors,omitempty"`
+
+	// How many of the servers must be changed for Present and CleanUp to succeed: "all" (the default) or "quorum"
+	// for a majority
+	MirrorWrites string `json:"mirrorWrites,omitempty"`
+}
+
+func (cfg customDNSProviderConfig) ttlPolicy() cpanel.TtlPolicy {
+	return cpanel.TtlPolicy{
+		Ttl:      cfg.Ttl,
+		MinTtl:   cfg.MinTtl,
+		MaxTtl:   cfg.MaxTtl,
+		Conflict: cfg.TtlConflictPolicy,
+	}
 }
 
 // Name is used as the name for this DNS solver when referencing it on the ACME
@@ -86,7 +160,10 @@ type customDNSProviderConfig struct {
 // within a single webhook deployment**.
 // For example, `cloudflare` may be used as the name of a solver.
 func (c *customDNSProviderSolver) Name() string {
-	return "cpanel-solver"
+	if c.name == "" {
+		return defaultSolverName
+	}
+	return c.name
 }
 
 // Present is responsible for actually presenting the DNS record with the
@@ -96,18 +173,56 @@ func (c *customDNSProviderSolver) Name() string {
 // solver has correctly configured the DNS provider.
 func (c *customDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
 	log.Infof("Got request to present: %+v", ch)
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	events := c.eventsFor(ch)
+	done, err := c.work.start("presenting "+ch.ResolvedFQDN, events)
+	if err != nil {
+		events.Failure(reasonShuttingDown, err)
+		return err
+	}
+	cfg, err := c.present(ch, events)
+	done()
+	if err != nil {
+		return err
+	}
+
+	// Waited for outside of the zone lock, so that a slow nameserver doesn't hold up other challenges
+	if cfg.PropagationCheck != nil {
+		err = c.checkPropagation(ch, cfg.PropagationCheck)
+		if err == errShuttingDown {
+			events.Failure(reasonShuttingDown, err)
+			return err
+		}
+		if err != nil {
+			events.Failure(reasonPropagationTimeout, err)
+			return err
+		}
+	}
+	log.Debugf("Present complete %+v", ch)
+	return nil
+}
+
+func (c *customDNSProviderSolver) present(ch *v1alpha1.ChallengeRequest, events *challengeEvents) (customDNSProviderConfig, error) {
 	log.Debugf("Presenting %+v", ch)
-	cpanel, err := c.getDnsClient(ch)
+	cpanel, cfg, err := c.getDnsClient(ch, events)
 	if err != nil {
 		log.Error("Could not get cpanelClient")
-		return err
+		events.Failure(reasonInvalidConfig, err)
+		return cfg, err
+	}
+
+	if c.journal != nil {
+		if err := c.journal.Record(ch, events.getChallenge()); err != nil {
+			err = fmt.Errorf("could not journal record before presenting it: %w", err)
+			events.Failure(reasonJournalFailed, err)
+			return cfg, err
+		}
 	}
 
 	err = cpanel.SetDnsTxt(ch.ResolvedFQDN, ch.Key)
-	log.Debugf("Present complete %+v", ch)
-	return err
+	if err != nil {
+		events.Failure("", err)
+	}
+	return cfg, err
 }
 
 // CleanUp should delete the relevant TXT record from the DNS provider console.
@@ -118,16 +233,31 @@ func (c *customDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
 // concurrently.
 func (c *customDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
 	log.Infof("Got request to clean up: %+v", ch)
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	events := c.eventsFor(ch)
+	done, err := c.work.start("cleaning up "+ch.ResolvedFQDN, events)
+	if err != nil {
+		events.Failure(reasonShuttingDown, err)
+		return err
+	}
+	defer done()
+
 	log.Debugf("Deleting %+v", ch)
-	cpanel, err := c.getDnsClient(ch)
+	cpanel, _, err := c.getDnsClient(ch, events)
 	if err != nil {
 		log.Error("Could not get cpanelClient")
+		events.Failure(reasonInvalidConfig, err)
 		return err
 	}
 
 	err = cpanel.ClearDnsTxt(ch.ResolvedFQDN, ch.Key)
+	if err != nil {
+		events.Failure("", err)
+	} else if c.journal != nil {
+		// Left in the journal the record would only be cleaned up again (to no effect) on restart
+		if err := c.journal.Remove(ch); err != nil {
+			log.Errorf("Could not remove cleaned up record %s from the journal: %s", ch.ResolvedFQDN, err)
+		}
+	}
 	log.Debugf("CleanUp complete %+v", ch)
 	return err
 }
@@ -148,50 +278,173 @@ func (c *customDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stop
 		return err
 	}
 
+	cmCl, err := cmclient.NewForConfig(kubeClientConfig)
+	if err != nil {
+		log.Error("couldn't get cert-manager clientset", err)
+		return err
+	}
+
+	// Events are recorded against cert-manager's Challenges, so its types need to be known to the recorder
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cl.CoreV1().Events("")})
+	c.recorder = broadcaster.NewRecorder(cmscheme.Scheme, corev1.EventSource{Component: "cert-manager-cpanel-webhook"})
+	c.events = broadcaster
+
 	c.client = cl
+	c.cmClient = cmCl
+	c.challenges = newChallengeIndex(cmCl, stopCh)
+	c.stopCh = stopCh
+	go c.watchShutdown(stopCh)
+	c.secrets = newSecretCache(cl, stopCh)
+	c.ambient = newAmbientCredentials(os.Getenv(ambientCredentialsDirEnv))
+	c.registry = newConfigMapOwnership(cl, podNamespace, ownershipConfigMapName)
+	c.audit, err = newAuditSink(os.Getenv(auditLogEnv), cl)
+	if err != nil {
+		log.Error("couldn't create audit log", err)
+		return err
+	}
+	c.locker, err = newZoneLocker(os.Getenv(zoneLocksEnv), cl)
+	if err != nil {
+		log.Error("couldn't create zone locker", err)
+		return err
+	}
+	c.cache, err = newZoneCache(os.Getenv(zoneCacheTtlEnv))
+	if err != nil {
+		log.Error("couldn't create zone cache", err)
+		return err
+	}
+	c.journal, err = newJournal(os.Getenv(journalEnv), cl)
+	if err != nil {
+		log.Error("couldn't create journal", err)
+		return err
+	}
+	if c.journal != nil {
+		// Clean up after a previous run that died between presenting and cleaning up records
+		go func() {
+			if err := c.reconcileJournal(); err != nil {
+				log.Error("couldn't reconcile journal", err)
+			}
+		}()
+	}
+
+	if gcConfigPath := os.Getenv(gcConfigEnv); gcConfigPath != "" {
+		gcCfg, err := loadGcConfig(gcConfigPath)
+		if err != nil {
+			log.Error("couldn't load garbage collector config", err)
+			return err
+		}
+		gc, err := newGarbageCollector(c, gcCfg)
+		if err != nil {
+			log.Error("couldn't create garbage collector", err)
+			return err
+		}
+		go gc.Run(stopCh)
+	}
 	return nil
 }
 
-// Lookup the secret in the config and get values out of it to construct a client instance
-func (c *customDNSProviderSolver) getDnsClient(ch *v1alpha1.ChallengeRequest) (*cpanel.CpanelClient, error) {
+// Lookup the secret in the config and get values out of it to construct a client instance, recording noteworthy
+// events and audited changes against the Challenge
+func (c *customDNSProviderSolver) getDnsClient(ch *v1alpha1.ChallengeRequest, events *challengeEvents) (txtClient, customDNSProviderConfig, error) {
 	cfg, err := loadConfig(ch.Config)
 	if err != nil {
-		return nil, err
+		return nil, cfg, err
 	}
 
 	log.Infof("Decoded webhook configuration %+v", cfg)
-	if cfg.CpanelUrl == "" {
+	accountCfg, err := cfg.forName(ch.ResolvedFQDN)
+	if err != nil {
+		return nil, cfg, err
+	}
+	client, err := c.getZoneClient(ch, accountCfg, ch.ResolvedZone)
+	if err != nil {
+		return nil, cfg, err
+	}
+	if len(accountCfg.Mirrors) == 0 {
+		client.Notify = events.Normal
+		client.AuditTrigger = events.AuditTrigger
+		return client, cfg, nil
+	}
+
+	mirrored, err := c.getMirroredClient(ch, accountCfg, client)
+	if err != nil {
+		return nil, cfg, err
+	}
+	mirrored.Notify = events.Normal
+	mirrored.AuditTrigger = events.AuditTrigger
+	return mirrored, cfg, nil
+}
+
+// Get a client for the given zone of the CPanel account in the config
+func (c *customDNSProviderSolver) getZoneClient(ch *v1alpha1.ChallengeRequest, cfg customDNSProviderConfig, dnsZone string) (*cpanel.CpanelClient, error) {
+	client, err := c.getAccountClient(ch, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	zoneClient := client.ForZone(dnsZone)
+	zoneClient.TtlPolicy = cfg.ttlPolicy()
+	zoneClient.AuditSink = c.audit
+	zoneClient.Locker = c.locker
+	zoneClient.Cache = c.cache
+	switch cfg.Ownership {
+	case ownershipMarker:
+		zoneClient.Ownership = &cpanel.MarkerOwnership{Owner: ownerId}
+	case ownershipRegistry:
+		if c.registry == nil {
+			return nil, errors.New("ownership registry isn't available")
+		}
+		zoneClient.Ownership = c.registry
+	}
+	return zoneClient, nil
+}
+
+// Get a client for the CPanel account in the config, not yet bound to a zone
+func (c *customDNSProviderSolver) getAccountClient(ch *v1alpha1.ChallengeRequest, cfg customDNSProviderConfig) (*cpanel.CpanelClient, error) {
+	if cfg.SecretRef.Name == "" && ch.AllowAmbientCredentials && c.ambient != nil {
+		log.Debug("No secretRef given, using ambient credentials")
+		return c.ambient.Client()
+	}
+
+	if len(cfg.CpanelUrl) == 0 {
 		return nil, errors.New("dnsZone or cpanelUrl wasn't provided")
 	}
-	secretRefSplit := strings.Split(cfg.SecretRef, "/")
-	if len(secretRefSplit) != 2 {
-		return nil, errors.New("expected secretRef to be in the form namespace/name")
+	secretNamespace, secretName, err := c.resolveSecretRef(ch, cfg.SecretRef)
+	if err != nil {
+		return nil, err
 	}
-	secretNamespace := secretRefSplit[0]
-	secretName := secretRefSplit[1]
 
-	log.Debugf("Fetching contents of secret %s from namespace %s", secretName, secretNamespace)
-	secret, err := c.client.CoreV1().Secrets(secretNamespace).Get(context.Background(), secretName, metav1.GetOptions{})
+	secret, err := c.secrets.Get(secretNamespace, secretName)
 	if err != nil {
 		log.Error("could not get secret", err)
 		return nil, err
 	}
 
-	client, err := CreateClientFromSecretValues(secret, ch.ResolvedZone, cfg.CpanelUrl)
-	return client, err
+	// Issuers could read the same secret with different keys, so they need their own clients
+	clientKey := strings.Join([]string{strings.Join(cfg.CpanelUrl, ","), cfg.SecretRef.usernameKey(), cfg.SecretRef.passwordKey(), cfg.SecretRef.apiTokenKey()}, "|")
+	return c.secrets.ClientFor(secret, clientKey, func() (*cpanel.CpanelClient, error) {
+		client, err := CreateClientFromSecretValues(secret, cfg.SecretRef, "", cfg.CpanelUrl.primary())
+		if err != nil {
+			return nil, err
+		}
+		client.Failover = newFailover(cfg.CpanelUrl)
+		return client, nil
+	})
 }
 
-func CreateClientFromSecretValues(secret *corev1.Secret, dnsZone, cpanelUrl string) (*cpanel.CpanelClient, error) {
-	usernameBytes, ok := secret.Data["username"]
+// CreateClientFromSecretValues builds a client from the credentials in the secret, found under the keys named by ref.
+// Both Opaque and kubernetes.io/basic-auth secrets are accepted.
+func CreateClientFromSecretValues(secret *corev1.Secret, ref secretReference, dnsZone, cpanelUrl string) (*cpanel.CpanelClient, error) {
+	usernameBytes, ok := secret.Data[ref.usernameKey()]
 	if !ok {
-		err := errors.New("username field not present in secret")
+		err := fmt.Errorf("%s field not present in secret", ref.usernameKey())
 		log.Error(err)
 		return nil, err
 	}
-	passwordBytes, passwordOk := secret.Data["password"]
-	apiTokenBytes, apiOk := secret.Data["apiToken"]
+	passwordBytes, passwordOk := secret.Data[ref.passwordKey()]
+	apiTokenBytes, apiOk := secret.Data[ref.apiTokenKey()]
 	if !passwordOk && !apiOk {
-		err := errors.New("password or API token field not present in secret")
+		err := fmt.Errorf("password or API token field (%s or %s) not present in secret", ref.passwordKey(), ref.apiTokenKey())
 		log.Error(err)
 		return nil, err
 	}
@@ -202,18 +455,14 @@ func CreateClientFromSecretValues(secret *corev1.Secret, dnsZone, cpanelUrl stri
 
 	log.Info("Got credentials from secret")
 
-	cpanel := &cpanel.CpanelClient{
-		DnsZone:   dnsZone,
-		CpanelUrl: cpanelUrl,
-		Username:  username,
-		Password:  password,
-		ApiToken:  apiToken,
-	}
+	cpanel := cpanel.NewCpanelClient(cpanelUrl, username, password, apiToken)
+	cpanel.DnsZone = dnsZone
 	return cpanel, nil
 }
 
 // loadConfig is a small helper function that decodes JSON configuration into
 // the typed config struct.
+// Unknown fields and invalid values are rejected, with every problem reported at once.
 func loadConfig(cfgJSON *extapi.JSON) (customDNSProviderConfig, error) {
 	cfg := customDNSProviderConfig{}
 	// handle the 'base case' where no configuration has been provided
@@ -224,5 +473,15 @@ func loadConfig(cfgJSON *extapi.JSON) (customDNSProviderConfig, error) {
 		return cfg, fmt.Errorf("error decoding solver config: %+v", err)
 	}
 
+	var raw interface{}
+	if err := json.Unmarshal(cfgJSON.Raw, &raw); err != nil {
+		return cfg, fmt.Errorf("error decoding solver config: %+v", err)
+	}
+	errs := unknownFields(configPath, raw, reflect.TypeOf(cfg))
+	errs = append(errs, validateConfig(&cfg)...)
+	if len(errs) > 0 {
+		return cfg, fmt.Errorf("invalid solver config: %s", errs.ToAggregate())
+	}
+
 	return cfg, nil
 }
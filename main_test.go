@@ -20,7 +20,7 @@ func CreatesClientFromSecretValues(t *testing.T) {
 			"apiToken": []byte("apiToken"),
 		},
 	}
-	client, err := CreateClientFromSecretValues(&configJson, "zone", "cpanel")
+	client, err := CreateClientFromSecretValues(&configJson, secretReference{}, "zone", "cpanel")
 	if err != nil {
 		t.Error("Unexpected error")
 	}
@@ -38,7 +38,7 @@ func ReturnsErrorDueToMissingUsername(t *testing.T) {
 			"password": []byte("password"),
 		},
 	}
-	_, err := CreateClientFromSecretValues(&emptyConfig, "zone", "cpanel")
+	_, err := CreateClientFromSecretValues(&emptyConfig, secretReference{}, "zone", "cpanel")
 	assert.EqualError(t, err, "username field not present in secret")
 }
 
@@ -48,7 +48,7 @@ func ReturnsErrorDueToMissingCredentials(t *testing.T) {
 			"username": []byte("user"),
 		},
 	}
-	_, err := CreateClientFromSecretValues(&emptyConfig, "zone", "cpanel")
+	_, err := CreateClientFromSecretValues(&emptyConfig, secretReference{}, "zone", "cpanel")
 	assert.EqualError(t, err, "username field not present in secret")
 }
 
@@ -70,3 +70,22 @@ func TestRunsSuite(t *testing.T) {
 	// fixture.RunExtended(t)
 
 }
+
+func TestCreatesClientFromBasicAuthSecretWithCustomKeys(t *testing.T) {
+	secret := corev1.Secret{
+		Type: corev1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			"username": []byte("user"),
+			"password": []byte("password"),
+			"token":    []byte("ABCDEF1234567890"),
+		},
+	}
+	client, err := CreateClientFromSecretValues(&secret, secretReference{ApiTokenKey: "token"}, "zone", "cpanel")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", client.Username)
+	assert.Equal(t, "password", client.Password)
+	assert.Equal(t, "ABCDEF1234567890", client.ApiToken)
+
+	_, err = CreateClientFromSecretValues(&secret, secretReference{UsernameKey: "login"}, "zone", "cpanel")
+	assert.EqualError(t, err, "login field not present in secret")
+}
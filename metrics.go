@@ -0,0 +1,76 @@
+package main
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// Metrics are registered with the global registry, which the webhook's API server serves at /metrics.
+const metricsNamespace = "cpanel_webhook"
+
+var (
+	gcRunsTotal = metrics.NewCounterVec(&metrics.CounterOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      "gc",
+		Name:           "runs_total",
+		Help:           "Number of garbage collection passes over a zone, by result.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"zone", "result"})
+
+	gcOrphanedRecords = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      "gc",
+		Name:           "orphaned_records",
+		Help:           "Number of challenge records without an active Challenge found in the last pass over a zone.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"zone"})
+
+	gcExpiredRecords = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      "gc",
+		Name:           "expired_records",
+		Help:           "Number of orphaned challenge records past the grace period left in a zone by the last pass over it, as in a dry run.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"zone"})
+
+	gcDeletedRecordsTotal = metrics.NewCounterVec(&metrics.CounterOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      "gc",
+		Name:           "deleted_records_total",
+		Help:           "Number of orphaned challenge records deleted.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"zone"})
+
+	zoneCacheEventsTotal = metrics.NewCounterVec(&metrics.CounterOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      "zone_cache",
+		Name:           "events_total",
+		Help:           "Number of zone snapshot cache hits, misses, in place updates and invalidations, by zone.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"zone", "event"})
+
+	zoneLocksFallback = metrics.NewGauge(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      "zone_locks",
+		Name:           "fallback",
+		Help:           "1 while zones are only locked within each replica as Leases can't be used, otherwise 0.",
+		StabilityLevel: metrics.ALPHA,
+	})
+
+	journalFallback = metrics.NewGauge(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      "journal",
+		Name:           "fallback",
+		Help:           "1 while records aren't journalled as the journal's ConfigMap can't be used, otherwise 0.",
+		StabilityLevel: metrics.ALPHA,
+	})
+)
+
+func init() {
+	legacyregistry.MustRegister(
+		gcRunsTotal, gcOrphanedRecords, gcExpiredRecords, gcDeletedRecordsTotal,
+		zoneCacheEventsTotal,
+		zoneLocksFallback,
+		journalFallback,
+	)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// Values for the mirrorWrites field of the solver config.
+const (
+	mirrorWritesAll    = "all"
+	mirrorWritesQuorum = "quorum"
+)
+
+// cpanelMirror is a further CPanel server serving the same zones as the config's, without a DNS cluster link
+// between them. Whichever of them the ACME server asks must have the record.
+type cpanelMirror struct {
+	// As cpanelUrl and secretRef of the config
+	CpanelUrl cpanelUrls      `json:"cpanelUrl"`
+	SecretRef secretReference `json:"secretRef"`
+}
+
+// txtClient presents and cleans up challenge records, on one CPanel server or mirrored across several.
+type txtClient interface {
+	SetDnsTxt(recordName string, value string) error
+	ClearDnsTxt(recordName string, value string) error
+}
+
+// Get a client making changes on both the given client and each of the config's mirrors.
+func (c *customDNSProviderSolver) getMirroredClient(ch *v1alpha1.ChallengeRequest, cfg customDNSProviderConfig, client *cpanel.CpanelClient) (*cpanel.MirroredClient, error) {
+	mirrored := &cpanel.MirroredClient{Clients: []*cpanel.CpanelClient{client}}
+	for _, mirror := range cfg.Mirrors {
+		mirrorCfg := cfg
+		mirrorCfg.CpanelUrl = mirror.CpanelUrl
+		mirrorCfg.SecretRef = mirror.SecretRef
+		mirrorClient, err := c.getZoneClient(ch, mirrorCfg, client.DnsZone)
+		if err != nil {
+			return nil, err
+		}
+		mirrored.Clients = append(mirrored.Clients, mirrorClient)
+	}
+
+	if cfg.MirrorWrites == mirrorWritesQuorum {
+		mirrored.Required = len(mirrored.Clients)/2 + 1
+	}
+	return mirrored, nil
+}
+
+func validateMirrors(path *field.Path, mirrors []cpanelMirror) field.ErrorList {
+	var errs field.ErrorList
+	for i := range mirrors {
+		mirror := &mirrors[i]
+		mirrorPath := path.Index(i)
+		// A mirror is a different server, so can't use ambient credentials
+		if len(mirror.CpanelUrl) == 0 {
+			errs = append(errs, field.Required(mirrorPath.Child("cpanelUrl"), ""))
+		}
+		if mirror.SecretRef.Name == "" {
+			errs = append(errs, field.Required(mirrorPath.Child("secretRef", "name"), ""))
+		}
+		errs = append(errs, validateCpanelUrls(mirrorPath.Child("cpanelUrl"), mirror.CpanelUrl)...)
+		errs = append(errs, validateSecretRef(mirrorPath.Child("secretRef"), mirror.SecretRef)...)
+	}
+	return errs
+}
+
+func validateMirrorWrites(path *field.Path, cfg *customDNSProviderConfig) field.ErrorList {
+	var errs field.ErrorList
+
+	if cfg.MirrorWrites != "" && cfg.MirrorWrites != mirrorWritesAll && cfg.MirrorWrites != mirrorWritesQuorum {
+		errs = append(errs, field.NotSupported(path.Child("mirrorWrites"), cfg.MirrorWrites, []string{mirrorWritesAll, mirrorWritesQuorum}))
+	}
+
+	hasMirrors := len(cfg.Mirrors) > 0
+	for _, account := range cfg.Accounts {
+		hasMirrors = hasMirrors || len(account.Mirrors) > 0
+	}
+	// Registry entries aren't kept per server, so cleaning up one server would disown the record on the others
+	if hasMirrors && cfg.Ownership == ownershipRegistry {
+		errs = append(errs, field.Invalid(path.Child("ownership"), cfg.Ownership, "can't be used with mirrors, use marker instead"))
+	}
+	return errs
+}
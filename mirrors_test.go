@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+func TestMirroredWrites(t *testing.T) {
+	primary, primaryServer := newFakeCpanel(t)
+	secondary, secondaryServer := newFakeCpanel(t)
+	mirrored := &cpanel.MirroredClient{Clients: []*cpanel.CpanelClient{
+		primary.client(primaryServer, "test-domain.com."),
+		secondary.client(secondaryServer, "test-domain.com."),
+	}}
+
+	assert.NoError(t, mirrored.SetDnsTxt("_acme-challenge.test-domain.com.", "test-value"))
+	assert.Equal(t, []string{"_acme-challenge=test-value"}, primary.txtValues())
+	assert.Equal(t, []string{"_acme-challenge=test-value"}, secondary.txtValues())
+
+	assert.NoError(t, mirrored.ClearDnsTxt("_acme-challenge.test-domain.com.", "test-value"))
+	assert.Empty(t, primary.txtValues())
+	assert.Empty(t, secondary.txtValues())
+}
+
+func TestMirroredWritesRollBack(t *testing.T) {
+	primary, primaryServer := newFakeCpanel(t)
+	existing, existingServer := newFakeCpanel(t, fakeRecord{Name: "_acme-challenge", TTL: 300, Data: []string{"test-value"}})
+	down, downServer := newFakeCpanel(t)
+	mirrored := &cpanel.MirroredClient{Clients: []*cpanel.CpanelClient{
+		primary.client(primaryServer, "test-domain.com."),
+		existing.client(existingServer, "test-domain.com."),
+		down.client(downServer, "test-domain.com."),
+	}}
+	downServer.Close()
+
+	err := mirrored.SetDnsTxt("_acme-challenge.test-domain.com.", "test-value")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "TXT record set on 2 of 3 CPanel servers, 3 needed: "+downServer.URL+": ")
+	}
+	// Only the record that was created is removed again
+	assert.Empty(t, primary.txtValues())
+	assert.Equal(t, 2, primary.mutations)
+	assert.Equal(t, []string{"_acme-challenge=test-value"}, existing.txtValues())
+	assert.Equal(t, 0, existing.mutations)
+}
+
+func TestMirroredWritesQuorum(t *testing.T) {
+	primary, primaryServer := newFakeCpanel(t)
+	secondary, secondaryServer := newFakeCpanel(t)
+	down, downServer := newFakeCpanel(t)
+	mirrored := &cpanel.MirroredClient{
+		Clients: []*cpanel.CpanelClient{
+			primary.client(primaryServer, "test-domain.com."),
+			secondary.client(secondaryServer, "test-domain.com."),
+			down.client(downServer, "test-domain.com."),
+		},
+		Required: 2,
+	}
+	var notified []string
+	mirrored.Notify = func(reason string, message string) {
+		notified = append(notified, reason)
+	}
+	downServer.Close()
+
+	assert.NoError(t, mirrored.SetDnsTxt("_acme-challenge.test-domain.com.", "test-value"))
+	assert.Equal(t, []string{"_acme-challenge=test-value"}, primary.txtValues())
+	assert.Equal(t, []string{"_acme-challenge=test-value"}, secondary.txtValues())
+	assert.Equal(t, []string{cpanel.ReasonMirrorWriteFailed}, notified)
+}
+
+func TestLoadConfigMirrors(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{
+		"cpanelUrl": "https://cpanel.test-domain.com", "secretRef": {"name": "primary"},
+		"mirrors": [{"cpanelUrl": "https://cpanel2.test-domain.com/", "secretRef": {"name": "secondary"}}],
+		"mirrorWrites": "quorum"
+	}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, []cpanelMirror{{CpanelUrl: cpanelUrls{"https://cpanel2.test-domain.com"}, SecretRef: secretReference{Name: "secondary"}}}, cfg.Mirrors)
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"mirrors": [{"secretRef": {"name": "secondary"}}], "mirrorWrites": "most", "ownership": "registry"}`)})
+	assert.EqualError(t, err, `invalid solver config: [`+
+		`config.mirrors[0].cpanelUrl: Required value, `+
+		`config.mirrorWrites: Unsupported value: "most": supported values: "all", "quorum", `+
+		`config.ownership: Invalid value: "registry": can't be used with mirrors, use marker instead]`)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// Values for the ownership field of the solver config.
+const (
+	ownershipMarker   = "marker"
+	ownershipRegistry = "registry"
+)
+
+// Identifies this deployment in ownership markers and the registry, so that several can share zones.
+var ownerId = getEnvOrDefault("OWNER_ID", GroupName)
+
+// The namespace the webhook runs in, where its own resources (such as the ownership registry) are kept.
+var podNamespace = getEnvOrDefault("POD_NAMESPACE", clusterResourceNamespace)
+
+const ownershipConfigMapName = "cpanel-webhook-ownership"
+
+// configMapOwnership keeps a registry of the records created by the webhook in a ConfigMap, keeping zones free of
+// marker records. Entries are keyed by a hash of the zone, name and value, as ConfigMap keys are restrictive.
+type configMapOwnership struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	mutex sync.Mutex
+}
+
+type ownershipEntry struct {
+	Owner      string    `json:"owner"`
+	Zone       string    `json:"zone"`
+	Name       string    `json:"name"`
+	ValueHash  string    `json:"valueSha256"`
+	CreateTime time.Time `json:"createTime"`
+}
+
+func newConfigMapOwnership(client kubernetes.Interface, namespace string, name string) *configMapOwnership {
+	return &configMapOwnership{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func (o *configMapOwnership) Claim(zone string, record cpanel.TxtRecord) ([]cpanel.TxtRecord, error) {
+	entry, err := json.Marshal(&ownershipEntry{
+		Owner:      ownerId,
+		Zone:       zone,
+		Name:       record.Name,
+		ValueHash:  cpanel.HashValue(record.Value),
+		CreateTime: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Claimed before the record is created, so that a crash in between can't leave behind a record we don't own
+	return nil, o.update(func(data map[string]string) {
+		data[ownershipKey(zone, record)] = string(entry)
+	})
+}
+
+func (o *configMapOwnership) Owned(zone string, zoneRecords []cpanel.TxtRecord, candidates []cpanel.TxtRecord) ([]cpanel.TxtRecord, error) {
+	configMap, err := o.get()
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []cpanel.TxtRecord
+	for _, candidate := range candidates {
+		if _, ok := configMap.Data[ownershipKey(zone, candidate)]; !ok {
+			log.Infof("Record %s isn't in the ownership registry, leaving it alone", candidate.Name)
+			continue
+		}
+		owned = append(owned, candidate)
+	}
+	return owned, nil
+}
+
+func (o *configMapOwnership) Released(zone string, records []cpanel.TxtRecord) error {
+	return o.update(func(data map[string]string) {
+		for _, record := range records {
+			delete(data, ownershipKey(zone, record))
+		}
+	})
+}
+
+func (o *configMapOwnership) get() (*corev1.ConfigMap, error) {
+	configMap, err := o.client.CoreV1().ConfigMaps(o.namespace).Get(context.Background(), o.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &corev1.ConfigMap{}, nil
+	}
+	return configMap, err
+}
+
+// Change the registry's entries, creating the ConfigMap if needed and retrying on conflicting writes.
+func (o *configMapOwnership) update(mutate func(data map[string]string)) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return updateConfigMap(o.client, o.namespace, o.name, mutate)
+}
+
+func ownershipKey(zone string, record cpanel.TxtRecord) string {
+	return cpanel.HashValue(ownerId + "|" + zone + "|" + record.Name + "|" + record.Value)
+}
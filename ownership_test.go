@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+func TestConfigMapOwnershipLimitsCleanUp(t *testing.T) {
+	cpanelServer, server := newFakeCpanel(t,
+		fakeRecord{Name: "_acme-challenge", TTL: 300, Data: []string{"autossl-value"}},
+	)
+	registry := newConfigMapOwnership(fake.NewSimpleClientset(), "cert-manager", ownershipConfigMapName)
+	client := cpanelServer.client(server, "test-domain.com.")
+	client.Ownership = registry
+
+	assert.NoError(t, client.SetDnsTxt("_acme-challenge.test-domain.com.", "test-value"))
+	owned, err := registry.Owned("test-domain.com", nil, []cpanel.TxtRecord{
+		{Name: "_acme-challenge", Value: "test-value"},
+		{Name: "_acme-challenge", Value: "autossl-value"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []cpanel.TxtRecord{{Name: "_acme-challenge", Value: "test-value"}}, owned)
+
+	// Records made by something else are left alone
+	assert.NoError(t, client.ClearDnsTxt("_acme-challenge.test-domain.com.", "autossl-value"))
+	assert.Equal(t, []string{"_acme-challenge=autossl-value", "_acme-challenge=test-value"}, cpanelServer.txtValues())
+
+	assert.NoError(t, client.ClearDnsTxt("_acme-challenge.test-domain.com.", "test-value"))
+	assert.Equal(t, []string{"_acme-challenge=autossl-value"}, cpanelServer.txtValues())
+
+	configMap, err := registry.get()
+	assert.NoError(t, err)
+	assert.Empty(t, configMap.Data)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/propagation"
+)
+
+// Event reason for a record that didn't reach every nameserver in time.
+const reasonPropagationTimeout = "PropagationTimeout"
+
+// The check runs within Present, which the API server gives 60 seconds before failing cert-manager's request (which
+// then retries while the first is still waiting). So it's kept well within that, leaving time for CPanel's changes.
+const maxPropagationTimeout = 30 * time.Second
+
+// propagationCheckConfig configures waiting for a presented record to reach the zone's authoritative nameservers.
+// CPanel can take a while to reload its nameservers, and cert-manager's own self check goes through recursive
+// resolvers which then cache the record's absence.
+type propagationCheckConfig struct {
+	// How long to wait in total, at most and by default maxPropagationTimeout. Present fails after this, and is
+	// retried by cert-manager.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+
+	// How long to wait between queries, defaulting to two seconds
+	Interval metav1.Duration `json:"interval,omitempty"`
+}
+
+func (c *customDNSProviderSolver) checkPropagation(ch *v1alpha1.ChallengeRequest, cfg *propagationCheckConfig) error {
+	checker := &propagation.Checker{
+		Resolver: c.resolver,
+		Timeout:  cfg.Timeout.Duration,
+		Interval: cfg.Interval.Duration,
+	}
+	if checker.Resolver == nil {
+		checker.Resolver = &propagation.NetResolver{}
+	}
+	if checker.Timeout == 0 {
+		checker.Timeout = maxPropagationTimeout
+	}
+	if checker.Interval == 0 {
+		checker.Interval = 2 * time.Second
+	}
+	// The record's already been made, so on shutdown there's no need to keep waiting: cert-manager checks it itself
+	ctx, cancel := c.stopContext()
+	defer cancel()
+	err := checker.WaitForTXT(ctx, ch.ResolvedZone, ch.ResolvedFQDN, ch.Key)
+	if err != nil && ctx.Err() != nil {
+		return errShuttingDown
+	}
+	return err
+}
+
+func validatePropagationCheck(path *field.Path, cfg *propagationCheckConfig) field.ErrorList {
+	var errs field.ErrorList
+	if cfg == nil {
+		return errs
+	}
+
+	if cfg.Timeout.Duration < 0 {
+		errs = append(errs, field.Invalid(path.Child("timeout"), cfg.Timeout.Duration.String(), "must not be negative"))
+	}
+	if cfg.Timeout.Duration > maxPropagationTimeout {
+		errs = append(errs, field.Invalid(path.Child("timeout"), cfg.Timeout.Duration.String(), "must not be greater than "+maxPropagationTimeout.String()+", as Present must finish within the API server's 60s request timeout"))
+	}
+	if cfg.Interval.Duration < 0 {
+		errs = append(errs, field.Invalid(path.Child("interval"), cfg.Interval.Duration.String(), "must not be negative"))
+	}
+	if cfg.Timeout.Duration > 0 && cfg.Interval.Duration > cfg.Timeout.Duration {
+		errs = append(errs, field.Invalid(path.Child("interval"), cfg.Interval.Duration.String(), "must not be greater than timeout"))
+	}
+	return errs
+}
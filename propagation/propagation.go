@@ -0,0 +1,146 @@
+// Package propagation checks that DNS records have reached every authoritative nameserver of a zone, rather than
+// trusting recursive resolvers which may have cached an earlier NXDOMAIN.
+package propagation
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Resolver looks up the nameservers of a zone and queries them directly.
+type Resolver interface {
+	// LookupNS returns the hostnames of the zone's nameservers.
+	LookupNS(ctx context.Context, zone string) ([]string, error)
+
+	// LookupTXTAt returns the TXT records of name from the given nameserver.
+	LookupTXTAt(ctx context.Context, nameserver string, name string) ([]string, error)
+}
+
+// NetResolver is a Resolver using Go's own DNS client.
+type NetResolver struct {
+	// The address (host:port) of a server to look up NS records with, defaulting to the system's resolver
+	Server string
+
+	// The port nameservers are queried on, defaulting to 53
+	Port string
+}
+
+func (r *NetResolver) LookupNS(ctx context.Context, zone string) ([]string, error) {
+	resolver := net.DefaultResolver
+	if r.Server != "" {
+		resolver = resolverFor(r.Server)
+	}
+
+	records, err := resolver.LookupNS(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	var nameservers []string
+	for _, record := range records {
+		nameservers = append(nameservers, strings.TrimSuffix(record.Host, "."))
+	}
+	return nameservers, nil
+}
+
+func (r *NetResolver) LookupTXTAt(ctx context.Context, nameserver string, name string) ([]string, error) {
+	port := r.Port
+	if port == "" {
+		port = "53"
+	}
+	return resolverFor(net.JoinHostPort(nameserver, port)).LookupTXT(ctx, name)
+}
+
+// A resolver sending every query to the given server.
+func resolverFor(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Checker waits for TXT records to be served by every authoritative nameserver of their zone.
+type Checker struct {
+	Resolver Resolver
+
+	// How long to wait in total, and between queries
+	Timeout  time.Duration
+	Interval time.Duration
+}
+
+// WaitForTXT returns once every nameserver of zone serves value among the TXT records of fqdn, or errors with those
+// that still don't once the timeout is up.
+func (c *Checker) WaitForTXT(ctx context.Context, zone string, fqdn string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	var pending map[string]string // Nameserver to why it's still pending
+	for {
+		if pending == nil {
+			nameservers, err := c.Resolver.LookupNS(ctx, zone)
+			if err != nil {
+				log.Warnf("Could not look up nameservers of %s: %s", zone, err)
+			} else if len(nameservers) == 0 {
+				log.Warnf("Zone %s has no nameservers", zone)
+			} else {
+				pending = map[string]string{}
+				for _, nameserver := range nameservers {
+					pending[nameserver] = "not yet queried"
+				}
+			}
+		}
+
+		for nameserver := range pending {
+			values, err := c.Resolver.LookupTXTAt(ctx, nameserver, fqdn)
+			switch {
+			case err != nil:
+				pending[nameserver] = err.Error()
+			case !contains(values, value):
+				pending[nameserver] = "record not found"
+			default:
+				log.Debugf("Nameserver %s has the record for %s", nameserver, fqdn)
+				delete(pending, nameserver)
+			}
+		}
+		if pending != nil && len(pending) == 0 {
+			log.Infof("Record for %s has propagated to all nameservers of %s", fqdn, zone)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return timeoutError(zone, fqdn, pending)
+		case <-time.After(c.Interval):
+		}
+	}
+}
+
+func timeoutError(zone string, fqdn string, pending map[string]string) error {
+	if pending == nil {
+		return fmt.Errorf("timed out looking up the nameservers of %s", zone)
+	}
+
+	var reasons []string
+	for nameserver, reason := range pending {
+		reasons = append(reasons, nameserver+": "+reason)
+	}
+	sort.Strings(reasons)
+	return fmt.Errorf("timed out waiting for the record for %s to propagate to %s", fqdn, strings.Join(reasons, ", "))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package propagation
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The nameserver the test server claims to be, which testResolver maps to its loopback address.
+const testNameserverHost = "ns1.test-domain.com"
+
+// testNameserver is a minimal authoritative nameserver over UDP for the zone test-domain.com.
+type testNameserver struct {
+	conn net.PacketConn
+
+	mutex sync.Mutex
+	txt   map[string][]string
+}
+
+func newTestNameserver(t *testing.T) *testNameserver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ns := &testNameserver{conn: conn, txt: map[string][]string{}}
+	go ns.serve()
+	return ns
+}
+
+func (ns *testNameserver) setTXT(name string, values ...string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.txt[name] = values
+}
+
+func (ns *testNameserver) resolver() Resolver {
+	_, port, _ := net.SplitHostPort(ns.conn.LocalAddr().String())
+	return &testResolver{NetResolver{Server: ns.conn.LocalAddr().String(), Port: port}}
+}
+
+// testResolver queries the test server for its made up nameserver, rather than looking up its address.
+type testResolver struct {
+	NetResolver
+}
+
+func (r *testResolver) LookupTXTAt(ctx context.Context, nameserver string, name string) ([]string, error) {
+	if nameserver == testNameserverHost {
+		nameserver = "127.0.0.1"
+	}
+	return r.NetResolver.LookupTXTAt(ctx, nameserver, name)
+}
+
+func (ns *testNameserver) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := ns.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		answer := ns.answer(query)
+		response, err := answer.Pack()
+		if err != nil {
+			continue
+		}
+		ns.conn.WriteTo(response, addr)
+	}
+}
+
+func (ns *testNameserver) answer(query dnsmessage.Message) dnsmessage.Message {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	question := query.Questions[0]
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+		Questions: query.Questions,
+	}
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	switch question.Type {
+	case dnsmessage.TypeNS:
+		response.Answers = append(response.Answers, dnsmessage.Resource{
+			Header: header,
+			Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName(testNameserverHost + ".")},
+		})
+	case dnsmessage.TypeTXT:
+		values, ok := ns.txt[strings.ToLower(question.Name.String())]
+		if !ok {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+		for _, value := range values {
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: header,
+				Body:   &dnsmessage.TXTResource{TXT: []string{value}},
+			})
+		}
+	}
+	return response
+}
+
+func TestWaitForTXTAgainstNameserver(t *testing.T) {
+	ns := newTestNameserver(t)
+	ns.setTXT("_acme-challenge.test-domain.com.", "other-value")
+	checker := &Checker{Resolver: ns.resolver(), Timeout: 5 * time.Second, Interval: 10 * time.Millisecond}
+
+	// The record only appears after a few queries, as if CPanel were reloading the zone
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ns.setTXT("_acme-challenge.test-domain.com.", "other-value", "test-value")
+	}()
+	err := checker.WaitForTXT(context.Background(), "test-domain.com.", "_acme-challenge.test-domain.com.", "test-value")
+	assert.NoError(t, err)
+}
+
+func TestWaitForTXTTimesOut(t *testing.T) {
+	ns := newTestNameserver(t)
+	checker := &Checker{Resolver: ns.resolver(), Timeout: 200 * time.Millisecond, Interval: 10 * time.Millisecond}
+
+	err := checker.WaitForTXT(context.Background(), "test-domain.com.", "_acme-challenge.test-domain.com.", "test-value")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out waiting for the record for _acme-challenge.test-domain.com. to propagate to ns1.test-domain.com: ")
+	}
+}
+
+type fakeResolver struct {
+	nameservers map[string][]string // Nameserver to the values it serves
+}
+
+func (r *fakeResolver) LookupNS(ctx context.Context, zone string) ([]string, error) {
+	var nameservers []string
+	for nameserver := range r.nameservers {
+		nameservers = append(nameservers, nameserver)
+	}
+	return nameservers, nil
+}
+
+func (r *fakeResolver) LookupTXTAt(ctx context.Context, nameserver string, name string) ([]string, error) {
+	return r.nameservers[nameserver], nil
+}
+
+func TestWaitForTXTRequiresEveryNameserver(t *testing.T) {
+	resolver := &fakeResolver{nameservers: map[string][]string{
+		"ns1.test-domain.com": {"test-value"},
+		"ns2.test-domain.com": {"other-value"},
+	}}
+	checker := &Checker{Resolver: resolver, Timeout: 50 * time.Millisecond, Interval: 10 * time.Millisecond}
+
+	err := checker.WaitForTXT(context.Background(), "test-domain.com.", "_acme-challenge.test-domain.com.", "test-value")
+	assert.EqualError(t, err, "timed out waiting for the record for _acme-challenge.test-domain.com. to propagate to ns2.test-domain.com: record not found")
+}
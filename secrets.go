@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// The namespace cert-manager uses for ClusterIssuer resources, used to recognise ClusterIssuer requests when their
+// Challenge can't be found.
+var clusterResourceNamespace = getEnvOrDefault("CLUSTER_RESOURCE_NAMESPACE", "cert-manager")
+
+// secretReference points at the Secret containing CPanel credentials.
+// It may be given as an object, or as a "namespace/name" string as in earlier versions.
+type secretReference struct {
+	// The name of the secret
+	Name string `json:"name"`
+
+	// The namespace of the secret, defaulting to the Issuer's namespace (or the cluster resource namespace for
+	// ClusterIssuers). Only ClusterIssuers may reference a secret in another namespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// The keys within the secret holding each credential, defaulting to 'username', 'password' and 'apiToken'.
+	// The username and password defaults match those of a kubernetes.io/basic-auth secret.
+	UsernameKey string `json:"usernameKey,omitempty"`
+	PasswordKey string `json:"passwordKey,omitempty"`
+	ApiTokenKey string `json:"apiTokenKey,omitempty"`
+
+	// Set when the reference was given in the deprecated string form
+	legacy bool
+}
+
+func (r *secretReference) UnmarshalJSON(data []byte) error {
+	var legacyRef string
+	if err := json.Unmarshal(data, &legacyRef); err == nil {
+		split := strings.Split(legacyRef, "/")
+		if len(split) != 2 {
+			return errors.New("expected secretRef to be in the form namespace/name")
+		}
+		*r = secretReference{Namespace: split[0], Name: split[1], legacy: true}
+		return nil
+	}
+
+	// Avoid recursing back into this function
+	type plainSecretReference secretReference
+	return json.Unmarshal(data, (*plainSecretReference)(r))
+}
+
+func (r secretReference) usernameKey() string {
+	if r.UsernameKey != "" {
+		return r.UsernameKey
+	}
+	return corev1.BasicAuthUsernameKey
+}
+
+func (r secretReference) passwordKey() string {
+	if r.PasswordKey != "" {
+		return r.PasswordKey
+	}
+	return corev1.BasicAuthPasswordKey
+}
+
+func (r secretReference) apiTokenKey() string {
+	if r.ApiTokenKey != "" {
+		return r.ApiTokenKey
+	}
+	return "apiToken"
+}
+
+// resolveSecretRef returns the namespace and name of the referenced secret, defaulting the namespace to that of the
+// request. To stop tenants reading each other's credentials a namespaced Issuer may only reference secrets in its
+// own namespace, whereas ClusterIssuers can reference any.
+func (c *customDNSProviderSolver) resolveSecretRef(ch *v1alpha1.ChallengeRequest, ref secretReference) (string, string, error) {
+	if ref.Name == "" {
+		return "", "", errors.New("secretRef must specify the name of a secret")
+	}
+	if ref.legacy {
+		log.Warn("secretRef given as a 'namespace/name' string, this is deprecated in favour of {name: ..., namespace: ...}")
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = ch.ResourceNamespace
+	}
+	if namespace != ch.ResourceNamespace && !c.isClusterIssuerRequest(ch) {
+		return "", "", fmt.Errorf("secretRef %s/%s is outside of the Issuer's namespace %s, only a ClusterIssuer may reference secrets in other namespaces",
+			namespace, ref.Name, ch.ResourceNamespace)
+	}
+	return namespace, ref.Name, nil
+}
+
+// isClusterIssuerRequest works out whether a request came from a ClusterIssuer, which the request itself doesn't say.
+// This comes from the Challenge's issuerRef if it can be found, else by whether the request's resource namespace is
+// the cluster resource namespace.
+func (c *customDNSProviderSolver) isClusterIssuerRequest(ch *v1alpha1.ChallengeRequest) bool {
+	if c.challenges != nil {
+		challenge, err := c.challenges.find(ch)
+		if err == nil {
+			return challenge.Spec.IssuerRef.Kind == "ClusterIssuer"
+		}
+		log.Warnf("Could not find Challenge to check its issuer kind: %s", err)
+	}
+	return ch.ResourceNamespace == clusterResourceNamespace
+}
+
+func getEnvOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// How long a newly watched Secret is given to sync before giving up on watching it and always fetching it directly.
+const secretSyncTimeout = 10 * time.Second
+
+// secretCache serves credential Secrets from informers rather than hitting the API server on every request.
+// Each referenced Secret gets its own informer (limited by a field selector), so only Secrets that are actually
+// referenced by an Issuer are watched. CPanel clients built from a Secret are kept alongside it and are dropped as soon
+// as the Secret changes. A Present or CleanUp may still be using a dropped client, so it's only retired (stopping
+// its failover probes) rather than closed.
+type secretCache struct {
+	client kubernetes.Interface
+	stopCh <-chan struct{}
+
+	mutex     sync.Mutex
+	informers map[string]cache.SharedIndexInformer // Keyed by namespace/name
+	clients   map[string]map[string]*cachedClient  // Keyed by namespace/name, then client key
+}
+
+type cachedClient struct {
+	resourceVersion string
+	client          *cpanel.CpanelClient
+}
+
+func newSecretCache(client kubernetes.Interface, stopCh <-chan struct{}) *secretCache {
+	return &secretCache{
+		client:    client,
+		stopCh:    stopCh,
+		informers: map[string]cache.SharedIndexInformer{},
+		clients:   map[string]map[string]*cachedClient{},
+	}
+}
+
+// Get returns the Secret from the cache, starting to watch it if this is the first time it has been asked for.
+// Until the watch has synced, or if the Secret can't be watched (e.g. RBAC only allows 'get'), it is fetched directly
+// instead, so that a slow watch never holds up a request.
+func (s *secretCache) Get(namespace string, name string) (*corev1.Secret, error) {
+	key := namespace + "/" + name
+	informer := s.informerFor(namespace, name)
+	if informer == nil || !informer.HasSynced() {
+		log.Debugf("Fetching contents of secret %s from namespace %s", name, namespace)
+		return s.client.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	}
+
+	obj, exists, err := informer.GetStore().GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apierrors.NewNotFound(corev1.Resource("secrets"), name)
+	}
+	return obj.(*corev1.Secret), nil
+}
+
+// ClientFor returns a cached CPanel client for the Secret and client key (e.g. the CPanel URL), building a new one
+// with build if there isn't one for the current version of the Secret.
+func (s *secretCache) ClientFor(secret *corev1.Secret, clientKey string, build func() (*cpanel.CpanelClient, error)) (*cpanel.CpanelClient, error) {
+	key := secret.Namespace + "/" + secret.Name
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cached, ok := s.clients[key][clientKey]
+	if ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached.client, nil
+	}
+	if ok {
+		log.Infof("Secret %s has changed, replacing its CPanel client", key)
+		cached.client.Retire()
+	}
+
+	client, err := build()
+	if err != nil {
+		return nil, err
+	}
+	if s.clients[key] == nil {
+		s.clients[key] = map[string]*cachedClient{}
+	}
+	s.clients[key][clientKey] = &cachedClient{
+		resourceVersion: secret.ResourceVersion,
+		client:          client,
+	}
+	return client, nil
+}
+
+// informerFor returns the Secret's informer, starting one that syncs in the background if there isn't one yet, or nil if
+// it couldn't be watched.
+func (s *secretCache) informerFor(namespace string, name string) cache.SharedIndexInformer {
+	key := namespace + "/" + name
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if informer, ok := s.informers[key]; ok {
+		return informer
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(s.client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	informer := factory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, _ interface{}) { s.invalidate(key) },
+		DeleteFunc: func(_ interface{}) { s.invalidate(key) },
+	})
+
+	// Each informer gets its own stop channel so that one that fails to sync can be given up on
+	informerStopCh := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(informerStopCh) }) }
+	go func() {
+		select {
+		case <-s.stopCh:
+			stop()
+		case <-informerStopCh:
+		}
+	}()
+	factory.Start(informerStopCh)
+	s.informers[key] = informer
+	go s.waitForSync(key, informer, stop)
+	return informer
+}
+
+func (s *secretCache) waitForSync(key string, informer cache.SharedIndexInformer, stop func()) {
+	syncCtx, cancel := context.WithTimeout(context.Background(), secretSyncTimeout)
+	defer cancel()
+	if cache.WaitForCacheSync(syncCtx.Done(), informer.HasSynced) {
+		return
+	}
+	select {
+	case <-s.stopCh:
+		return // Shutting down rather than failing to sync
+	default:
+	}
+
+	log.Warnf("Could not watch secret %s, fetching it directly instead. Does the webhook have list/watch permissions on secrets?", key)
+	stop()
+	// Remember this so that the informer isn't started again
+	s.mutex.Lock()
+	s.informers[key] = nil
+	s.mutex.Unlock()
+}
+
+func (s *secretCache) invalidate(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, cached := range s.clients[key] {
+		cached.client.Retire()
+	}
+	if len(s.clients[key]) > 0 {
+		log.Infof("Secret %s changed, dropping its cached CPanel clients", key)
+	}
+	delete(s.clients, key)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+func newTestSecret(resourceVersion string, password string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "cpanel-credentials",
+			Namespace:       "cert-manager",
+			ResourceVersion: resourceVersion,
+		},
+		Data: map[string][]byte{
+			"username": []byte("user"),
+			"password": []byte(password),
+		},
+	}
+}
+
+func TestSecretCacheRotation(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	client := fake.NewSimpleClientset(newTestSecret("1", "password"))
+	secrets := newSecretCache(client, stopCh)
+
+	build := func(secret *corev1.Secret) func() (*cpanel.CpanelClient, error) {
+		return func() (*cpanel.CpanelClient, error) {
+			return CreateClientFromSecretValues(secret, secretReference{}, "", "https://cpanel.test-domain.com")
+		}
+	}
+
+	secret, err := secrets.Get("cert-manager", "cpanel-credentials")
+	assert.NoError(t, err)
+	first, err := secrets.ClientFor(secret, "https://cpanel.test-domain.com", build(secret))
+	assert.NoError(t, err)
+	assert.Equal(t, "password", first.Password)
+
+	// The same version of the secret gets the same client
+	again, err := secrets.ClientFor(secret, "https://cpanel.test-domain.com", build(secret))
+	assert.NoError(t, err)
+	assert.Same(t, first, again)
+
+	// Rotating the credentials is picked up by the informer and gives a new client
+	_, err = client.CoreV1().Secrets("cert-manager").Update(context.Background(), newTestSecret("2", "rotated"), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		secret, err = secrets.Get("cert-manager", "cpanel-credentials")
+		return err == nil && secret.ResourceVersion == "2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rotated, err := secrets.ClientFor(secret, "https://cpanel.test-domain.com", build(secret))
+	assert.NoError(t, err)
+	assert.NotSame(t, first, rotated)
+	assert.Equal(t, "rotated", rotated.Password)
+}
+
+func TestSecretCacheNotFound(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	secrets := newSecretCache(fake.NewSimpleClientset(), stopCh)
+
+	_, err := secrets.Get("cert-manager", "cpanel-credentials")
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestSecretCacheWatchForbidden(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	client := fake.NewSimpleClientset(newTestSecret("1", "password"))
+	client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(corev1.Resource("secrets"), "", nil)
+	})
+	secrets := newSecretCache(client, stopCh)
+
+	// Fetched directly without waiting for the watch to sync
+	start := time.Now()
+	secret, err := secrets.Get("cert-manager", "cpanel-credentials")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", secret.ResourceVersion)
+	assert.Less(t, time.Since(start), secretSyncTimeout)
+}
+
+func TestLoadConfigSecretRefForms(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"cpanelUrl": "https://cpanel.test-domain.com", "secretRef": "cert-manager/cpanel-credentials"}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, "cert-manager", cfg.SecretRef.Namespace)
+	assert.Equal(t, "cpanel-credentials", cfg.SecretRef.Name)
+
+	cfg, err = loadConfig(&extapi.JSON{Raw: []byte(`{"cpanelUrl": "https://cpanel.test-domain.com", "secretRef": {"name": "cpanel-credentials"}}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, "", cfg.SecretRef.Namespace)
+	assert.Equal(t, "cpanel-credentials", cfg.SecretRef.Name)
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"cpanelUrl": "https://cpanel.test-domain.com", "secretRef": "cpanel-credentials"}`)})
+	assert.EqualError(t, err, "error decoding solver config: expected secretRef to be in the form namespace/name")
+}
+
+func TestResolveSecretRefNamespaceIsolation(t *testing.T) {
+	solver := &customDNSProviderSolver{
+		challenges: newTestChallengeIndex(t, newTestChallenge("tenant-a", "Issuer")),
+	}
+	ch := &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "tenant-a",
+		DNSName:           "example.test-domain.com",
+		Key:               "test-value",
+	}
+
+	namespace, name, err := solver.resolveSecretRef(ch, secretReference{Name: "cpanel-credentials"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant-a", namespace)
+	assert.Equal(t, "cpanel-credentials", name)
+
+	_, _, err = solver.resolveSecretRef(ch, secretReference{Name: "cpanel-credentials", Namespace: "tenant-b"})
+	assert.EqualError(t, err, "secretRef tenant-b/cpanel-credentials is outside of the Issuer's namespace tenant-a, only a ClusterIssuer may reference secrets in other namespaces")
+
+	// ClusterIssuers may reference secrets anywhere
+	solver.challenges = newTestChallengeIndex(t, newTestChallenge("tenant-a", "ClusterIssuer"))
+	ch.ResourceNamespace = "cert-manager"
+	namespace, _, err = solver.resolveSecretRef(ch, secretReference{Name: "cpanel-credentials", Namespace: "tenant-b"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant-b", namespace)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long changes under way are given to finish once the webhook's told to stop, counted from the signal. It
+// should be shorter than the pod's terminationGracePeriodSeconds, after which it's killed regardless.
+const shutdownTimeoutEnv = "SHUTDOWN_TIMEOUT"
+
+const defaultShutdownTimeout = 25 * time.Second
+
+const (
+	// Event reason for challenges turned away while shutting down, which cert-manager retries on another replica
+	reasonShuttingDown = "ShuttingDown"
+	// Event reason for changes still under way when the webhook gave up waiting for them
+	reasonInterrupted = "Interrupted"
+)
+
+var errShuttingDown = errors.New("webhook is shutting down, the challenge will be retried")
+
+// workTracker keeps track of the changes to zones under way, so that on shutdown new ones can be turned away and
+// those already started given a chance to finish rather than leave a zone half changed.
+type workTracker struct {
+	mutex     sync.Mutex
+	stopping  bool
+	stoppedAt time.Time
+	nextId    int
+	running   map[int]*work
+	idle      chan struct{}
+
+	now func() time.Time
+}
+
+// work is a change under way, recorded against its Challenge (if any) should it be interrupted.
+type work struct {
+	description string
+	started     time.Time
+	events      *challengeEvents
+}
+
+// start records the start of some work, returning the function to call once it's done, or errShuttingDown if no
+// more is being accepted.
+func (t *workTracker) start(description string, events *challengeEvents) (func(), error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopping {
+		return nil, errShuttingDown
+	}
+	if t.running == nil {
+		t.running = map[int]*work{}
+	}
+	id := t.nextId
+	t.nextId++
+	t.running[id] = &work{description: description, started: t.timeNow(), events: events}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			delete(t.running, id)
+			if len(t.running) == 0 && t.idle != nil {
+				close(t.idle)
+				t.idle = nil
+			}
+		})
+	}, nil
+}
+
+// stop turns away any new work, returning how much is still under way. Only the first call counts towards when
+// the webhook stopped.
+func (t *workTracker) stop() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.stopping {
+		t.stopping = true
+		t.stoppedAt = t.timeNow()
+	}
+	return len(t.running)
+}
+
+// drain stops accepting work and waits for what's under way to finish, until the given time has passed since
+// stop was first called. Whatever is still running by then is returned, oldest first.
+func (t *workTracker) drain(timeout time.Duration) []*work {
+	t.stop()
+
+	t.mutex.Lock()
+	if len(t.running) == 0 {
+		t.mutex.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	remaining := timeout - t.timeNow().Sub(t.stoppedAt)
+	t.mutex.Unlock()
+
+	if remaining > 0 {
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		select {
+		case <-idle:
+			return nil
+		case <-timer.C:
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	interrupted := make([]*work, 0, len(t.running))
+	for _, w := range t.running {
+		interrupted = append(interrupted, w)
+	}
+	sort.Slice(interrupted, func(i, j int) bool {
+		return interrupted[i].started.Before(interrupted[j].started)
+	})
+	return interrupted
+}
+
+func (t *workTracker) timeNow() time.Time {
+	if t.now == nil {
+		return time.Now()
+	}
+	return t.now()
+}
+
+// Stop taking on challenges once the stop channel is closed, i.e. the webhook's been sent a SIGTERM.
+func (c *customDNSProviderSolver) watchShutdown(stopCh <-chan struct{}) {
+	<-stopCh
+	running := c.work.stop()
+	log.Infof("Shutting down, no longer accepting challenges and waiting for %d changes under way", running)
+}
+
+// drain waits for the changes under way to finish, up to the timeout since the webhook was told to stop. Any
+// still running are logged and recorded against their Challenges, as the records they were changing may have been
+// left behind or not yet created.
+func (c *customDNSProviderSolver) drain(timeout time.Duration) {
+	if c.events != nil {
+		// Deliver what's been recorded before the process exits
+		defer c.events.Shutdown()
+	}
+	interrupted := c.work.drain(timeout)
+	if len(interrupted) == 0 {
+		log.Info("All changes under way finished, shutting down")
+		return
+	}
+	for _, w := range interrupted {
+		err := fmt.Errorf("webhook shut down before %s finished, after %s; the zone may need checking", w.description, time.Since(w.started).Round(time.Second))
+		log.Error(err)
+		if w.events != nil {
+			w.events.Failure(reasonInterrupted, err)
+		}
+	}
+}
+
+// A context cancelled once the webhook's told to stop, so that waiting around doesn't hold up shutdown.
+func (c *customDNSProviderSolver) stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// The time changes are given to finish on shutdown, from SHUTDOWN_TIMEOUT.
+func shutdownTimeout() (time.Duration, error) {
+	value := os.Getenv(shutdownTimeoutEnv)
+	if value == "" {
+		return defaultShutdownTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a duration such as 25s", shutdownTimeoutEnv, value)
+	}
+	return timeout, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWorkTrackerDrains(t *testing.T) {
+	var tracker workTracker
+	first, err := tracker.start("presenting a", nil)
+	assert.NoError(t, err)
+	second, err := tracker.start("presenting b", nil)
+	assert.NoError(t, err)
+
+	drained := make(chan []*work)
+	go func() {
+		drained <- tracker.drain(time.Minute)
+	}()
+
+	// No new work once stopping
+	assert.Eventually(t, func() bool {
+		_, err := tracker.start("presenting c", nil)
+		return err == errShuttingDown
+	}, time.Second, time.Millisecond)
+
+	first()
+	first()
+	second()
+	select {
+	case interrupted := <-drained:
+		assert.Empty(t, interrupted)
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain didn't return once the work finished")
+	}
+
+	// Nothing under way
+	assert.Empty(t, tracker.drain(time.Minute))
+}
+
+func TestWorkTrackerReportsInterrupted(t *testing.T) {
+	now := time.Now()
+	tracker := workTracker{now: func() time.Time { return now }}
+	_, err := tracker.start("presenting a", nil)
+	assert.NoError(t, err)
+	now = now.Add(time.Second)
+	_, err = tracker.start("cleaning up b", nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, tracker.stop())
+
+	// The timeout counts from when the webhook was told to stop, so is already up
+	now = now.Add(30 * time.Second)
+	interrupted := tracker.drain(25 * time.Second)
+	if assert.Len(t, interrupted, 2) {
+		assert.Equal(t, "presenting a", interrupted[0].description)
+		assert.Equal(t, "cleaning up b", interrupted[1].description)
+	}
+}
+
+func TestSolverShutsDown(t *testing.T) {
+	cpanel, server := newFakeCpanelTLS(t)
+	stopCh := make(chan struct{})
+	solver := &customDNSProviderSolver{
+		secrets:  newSecretCache(fake.NewSimpleClientset(newTestSecret("1", "password")), stopCh),
+		resolver: nsResolver{"ns1.test-domain.com."},
+		stopCh:   stopCh,
+	}
+	go solver.watchShutdown(stopCh)
+
+	ch := &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "cert-manager",
+		ResolvedZone:      "test-domain.com.",
+		ResolvedFQDN:      "_acme-challenge.test-domain.com.",
+		Key:               "test-value",
+		Config:            &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"cpanelUrl": %q, "secretRef": {"name": "cpanel-credentials"}, "propagationCheck": {"timeout": "30s"}}`, server.URL))},
+	}
+
+	// The record never propagates, so Present waits until the webhook's told to stop
+	presented := make(chan error)
+	go func() {
+		presented <- solver.Present(ch)
+	}()
+	assert.Eventually(t, func() bool {
+		return len(cpanel.txtValues()) == 1
+	}, 5*time.Second, time.Millisecond)
+	close(stopCh)
+	select {
+	case err := <-presented:
+		assert.Equal(t, errShuttingDown, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Present kept waiting for propagation after shutdown")
+	}
+
+	// The record was made before the stop and nothing was left in flight
+	assert.Empty(t, solver.work.drain(time.Minute))
+	mutations := cpanel.mutations
+	assert.Equal(t, errShuttingDown, solver.Present(ch))
+	assert.Equal(t, errShuttingDown, solver.CleanUp(ch))
+	assert.Equal(t, mutations, cpanel.mutations)
+	assert.Equal(t, []string{"_acme-challenge=test-value"}, cpanel.txtValues())
+}
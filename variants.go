@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook"
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// The solverName Issuers use for the webhook can be changed with this environment variable, e.g. to run a second
+// deployment alongside under the same group.
+const solverNameEnv = "SOLVER_NAME"
+
+const defaultSolverName = "cpanel-solver"
+
+// Further variants of the solver to register, separated by commas, each named after the solver with a suffix.
+const solverVariantsEnv = "SOLVER_VARIANTS"
+
+// Event reason for what a dry run solver would have done.
+const reasonDryRun = "DryRun"
+
+// The variants that can be registered, by name, each sharing the state of the main solver.
+var solverVariants = map[string]func(solver *customDNSProviderSolver) webhook.Solver{
+	"dry-run": func(solver *customDNSProviderSolver) webhook.Solver {
+		return &dryRunSolver{solver: solver}
+	},
+}
+
+// newSolvers returns the solver with the given name, and it along with the listed variants of it to register.
+func newSolvers(name string, variants string) (*customDNSProviderSolver, []webhook.Solver, error) {
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid %s %q: %s", solverNameEnv, name, strings.Join(errs, ", "))
+	}
+
+	solver := &customDNSProviderSolver{name: name}
+	solvers := []webhook.Solver{solver}
+	for _, variant := range strings.Split(variants, ",") {
+		variant = strings.TrimSpace(variant)
+		if variant == "" {
+			continue
+		}
+		newVariant, ok := solverVariants[variant]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown solver variant %q in %s, expected dry-run", variant, solverVariantsEnv)
+		}
+		solvers = append(solvers, newVariant(solver))
+	}
+	return solver, solvers, nil
+}
+
+// dryRunSolver goes as far as reading the zone for a challenge but never changes it, recording what it would have
+// done instead, so an Issuer's config can be tried out without touching DNS. Challenges using it can't succeed.
+type dryRunSolver struct {
+	solver *customDNSProviderSolver
+}
+
+func (d *dryRunSolver) Name() string {
+	return d.solver.Name() + "-dry-run"
+}
+
+// Initialize does nothing, as the main solver it shares everything with is initialised itself.
+func (d *dryRunSolver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{}) error {
+	return nil
+}
+
+func (d *dryRunSolver) Present(ch *v1alpha1.ChallengeRequest) error {
+	return d.dryRun(ch, "presenting", (*cpanel.CpanelClient).PlanSetDnsTxt)
+}
+
+func (d *dryRunSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
+	return d.dryRun(ch, "cleaning up", (*cpanel.CpanelClient).PlanClearDnsTxt)
+}
+
+// Work out the change on each server as the main solver would make it, reading each zone without locking it.
+func (d *dryRunSolver) dryRun(ch *v1alpha1.ChallengeRequest, action string, plan func(client *cpanel.CpanelClient, recordName string, value string) ([]cpanel.PlannedChange, error)) error {
+	events := d.solver.eventsFor(ch)
+	done, err := d.solver.work.start("dry run of "+action+" "+ch.ResolvedFQDN, events)
+	if err != nil {
+		events.Failure(reasonShuttingDown, err)
+		return err
+	}
+	defer done()
+
+	client, _, err := d.solver.getDnsClient(ch, events)
+	if err != nil {
+		events.Failure(reasonInvalidConfig, err)
+		return err
+	}
+	for _, zoneClient := range zoneClients(client) {
+		changes, err := plan(zoneClient, ch.ResolvedFQDN, ch.Key)
+		if err != nil {
+			events.Failure("", err)
+			return err
+		}
+		message := describePlan(action, ch.ResolvedFQDN, zoneClient, changes)
+		log.Info(message)
+		events.Normal(reasonDryRun, message)
+	}
+	return nil
+}
+
+// The Event recorded for a dry run, e.g. "Dry run: presenting _acme-challenge.example.com. would have added
+// _acme-challenge with TTL 300 on cpanel.example.com"
+func describePlan(action string, fqdn string, client *cpanel.CpanelClient, changes []cpanel.PlannedChange) string {
+	host := client.CpanelUrl
+	if parsed, err := url.Parse(host); err == nil && parsed.Host != "" {
+		host = parsed.Host
+	}
+	if len(changes) == 0 {
+		return fmt.Sprintf("Dry run: %s %s would have changed nothing on %s", action, fqdn, host)
+	}
+
+	var descriptions []string
+	for _, change := range changes {
+		switch change.Change {
+		case "add":
+			descriptions = append(descriptions, fmt.Sprintf("added %s with TTL %d", change.Name, change.TTL))
+		case "edit":
+			descriptions = append(descriptions, fmt.Sprintf("changed the TTL of %s to %d", change.Name, change.TTL))
+		case "remove":
+			descriptions = append(descriptions, fmt.Sprintf("removed %s", change.Name))
+		}
+	}
+	return fmt.Sprintf("Dry run: %s %s would have %s on %s", action, fqdn, strings.Join(descriptions, ", "), host)
+}
+
+// The client for each server a change would be made on.
+func zoneClients(client txtClient) []*cpanel.CpanelClient {
+	if mirrored, ok := client.(*cpanel.MirroredClient); ok {
+		return mirrored.Clients
+	}
+	return []*cpanel.CpanelClient{client.(*cpanel.CpanelClient)}
+}
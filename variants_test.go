@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook"
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestNewSolvers(t *testing.T) {
+	solver, solvers, err := newSolvers("cpanel-solver", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []webhook.Solver{solver}, solvers)
+	assert.Equal(t, "cpanel-solver", solver.Name())
+
+	solver, solvers, err = newSolvers("reseller", " dry-run ")
+	assert.NoError(t, err)
+	assert.Len(t, solvers, 2)
+	assert.Equal(t, webhook.Solver(solver), solvers[0])
+	assert.Equal(t, "reseller", solvers[0].Name())
+	assert.Equal(t, "reseller-dry-run", solvers[1].Name())
+
+	_, _, err = newSolvers("CPanel_Solver", "")
+	assert.ErrorContains(t, err, `invalid SOLVER_NAME "CPanel_Solver"`)
+
+	_, _, err = newSolvers("cpanel-solver", "dry-run,whm")
+	assert.EqualError(t, err, `unknown solver variant "whm" in SOLVER_VARIANTS, expected dry-run`)
+}
+
+func TestDryRunSolver(t *testing.T) {
+	cpanel, server := newFakeCpanelTLS(t)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	solver, solvers, err := newSolvers("cpanel-solver", "dry-run")
+	assert.NoError(t, err)
+	solver.secrets = newSecretCache(fake.NewSimpleClientset(newTestSecret("1", "password")), stopCh)
+	recorder := record.NewFakeRecorder(10)
+	solver.recorder = recorder
+	solver.challenges = newTestChallengeIndex(t, newTestChallenge("cert-manager", "Issuer"))
+
+	ch := &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "cert-manager",
+		DNSName:           "example.test-domain.com",
+		ResolvedZone:      "test-domain.com.",
+		ResolvedFQDN:      "_acme-challenge.test-domain.com.",
+		Key:               "test-value",
+		Config:            &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"cpanelUrl": %q, "secretRef": {"name": "cpanel-credentials"}}`, server.URL))},
+	}
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	// What would be done is worked out from the zone as it is
+	assert.NoError(t, solvers[1].Present(ch))
+	assert.Equal(t, "Normal DryRun Dry run: presenting _acme-challenge.test-domain.com. would have added _acme-challenge with TTL 300 on "+host, <-recorder.Events)
+	assert.NoError(t, solvers[1].CleanUp(ch))
+	assert.Equal(t, "Normal DryRun Dry run: cleaning up _acme-challenge.test-domain.com. would have changed nothing on "+host, <-recorder.Events)
+	assert.Equal(t, 0, cpanel.mutations)
+
+	cpanel.records = append(cpanel.records, fakeRecord{Name: "_acme-challenge", TTL: 300, Data: []string{"test-value"}})
+	assert.NoError(t, solvers[1].Present(ch))
+	assert.Equal(t, "Normal DryRun Dry run: presenting _acme-challenge.test-domain.com. would have changed nothing on "+host, <-recorder.Events)
+	assert.NoError(t, solvers[1].CleanUp(ch))
+	assert.Equal(t, "Normal DryRun Dry run: cleaning up _acme-challenge.test-domain.com. would have removed _acme-challenge on "+host, <-recorder.Events)
+	assert.Equal(t, 0, cpanel.mutations)
+
+	// Problems are still reported
+	ch.Config = &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"cpanelUrl": %q, "secretRef": {"name": "missing"}}`, server.URL))}
+	assert.Error(t, solvers[1].Present(ch))
+
+	// And nothing is started once shutting down
+	solver.work.stop()
+	ch.Config = &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"cpanelUrl": %q, "secretRef": {"name": "cpanel-credentials"}}`, server.URL))}
+	assert.Equal(t, errShuttingDown, solvers[1].Present(ch))
+}
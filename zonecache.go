@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// How long a snapshot of a zone is used for changes after it's downloaded, or 0 to download it for every change.
+// It's off unless set, so that upgrading doesn't change how zones are read.
+const zoneCacheTtlEnv = "ZONE_CACHE_TTL"
+
+// newZoneCache creates the cache given by the ZONE_CACHE_TTL setting, counting what it does in the
+// cpanel_webhook_zone_cache_events_total metric, or none if it's turned off.
+func newZoneCache(value string) (*cpanel.ZoneCache, error) {
+	if value == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("invalid %s %q, expected a duration such as 30s, or 0 to turn it off", zoneCacheTtlEnv, value)
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+
+	cache := cpanel.NewZoneCache(ttl)
+	cache.Observe = func(zone string, event string) {
+		zoneCacheEventsTotal.WithLabelValues(zone, event).Inc()
+	}
+	return cache, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestZoneCacheCutsZoneReads(t *testing.T) {
+	cpanel, server := newFakeCpanelTLS(t)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	cache, err := newZoneCache("30s")
+	assert.NoError(t, err)
+	solver := &customDNSProviderSolver{
+		secrets: newSecretCache(fake.NewSimpleClientset(newTestSecret("1", "password")), stopCh),
+		cache:   cache,
+	}
+	config := &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"cpanelUrl": %q, "secretRef": {"name": "cpanel-credentials"}}`, server.URL))}
+
+	// A certificate for several names presents a challenge for each in turn
+	var challenges []*v1alpha1.ChallengeRequest
+	for _, name := range []string{"www", "api", "mail"} {
+		challenges = append(challenges, &v1alpha1.ChallengeRequest{
+			ResourceNamespace: "cert-manager",
+			ResolvedZone:      "test-domain.com.",
+			ResolvedFQDN:      "_acme-challenge." + name + ".test-domain.com.",
+			Key:               "test-value-" + name,
+			Config:            config,
+		})
+	}
+	for _, ch := range challenges {
+		assert.NoError(t, solver.Present(ch))
+	}
+	assert.Equal(t, 1, cpanel.zoneReads)
+	assert.Equal(t, 3, cpanel.mutations)
+
+	// Records we added aren't at known lines, so cleaning up reads the zone
+	for _, ch := range challenges {
+		assert.NoError(t, solver.CleanUp(ch))
+	}
+	assert.Empty(t, cpanel.txtValues())
+	assert.Equal(t, 6, cpanel.mutations)
+}
+
+func TestNewZoneCache(t *testing.T) {
+	// Off unless turned on
+	cache, err := newZoneCache("")
+	assert.NoError(t, err)
+	assert.Nil(t, cache)
+
+	cache, err = newZoneCache("2m")
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, cache.TTL)
+
+	cache, err = newZoneCache("0")
+	assert.NoError(t, err)
+	assert.Nil(t, cache)
+
+	_, err = newZoneCache("soon")
+	assert.EqualError(t, err, `invalid ZONE_CACHE_TTL "soon", expected a duration such as 30s, or 0 to turn it off`)
+}
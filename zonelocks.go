@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jamesorlakin/cert-manager-cpanel-dns-webhook/cpanel"
+)
+
+// How zones are locked while they're changed: "lease" (the default) across replicas with a Lease for each zone, or
+// "local" within a replica only, which is enough with a single replica.
+const zoneLocksEnv = "ZONE_LOCKS"
+
+const (
+	zoneLocksLease = "lease"
+	zoneLocksLocal = "local"
+)
+
+const (
+	// Leases are named with this prefix and a hash of the zone, as hosts and accounts needn't be valid names
+	zoneLeasePrefix = "cpanel-webhook-zone-"
+
+	zoneLeaseHostAnnotation    = "cpanel-webhook/host"
+	zoneLeaseAccountAnnotation = "cpanel-webhook/account"
+	zoneLeaseZoneAnnotation    = "cpanel-webhook/zone"
+)
+
+var errLeaseLost = errors.New("held by another replica")
+
+// localLocker locks each zone within this replica, then with next (if there is one) across replicas. Changes to
+// different zones never wait for each other, so waiting on another replica's Lease only holds up the one zone.
+type localLocker struct {
+	next cpanel.ZoneLocker
+
+	mutex sync.Mutex
+	zones map[string]*zoneMutex // Keyed by host, account and zone, while locked or waited for
+}
+
+type zoneMutex struct {
+	sync.Mutex
+	users int
+}
+
+func (l *localLocker) LockZone(host string, account string, zone string) (context.Context, func(), error) {
+	key := host + "|" + account + "|" + zone
+	l.mutex.Lock()
+	if l.zones == nil {
+		l.zones = map[string]*zoneMutex{}
+	}
+	zoneLock, ok := l.zones[key]
+	if !ok {
+		zoneLock = &zoneMutex{}
+		l.zones[key] = zoneLock
+	}
+	zoneLock.users++
+	l.mutex.Unlock()
+
+	zoneLock.Lock()
+	release := func() {
+		zoneLock.Unlock()
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		zoneLock.users--
+		if zoneLock.users == 0 {
+			delete(l.zones, key)
+		}
+	}
+	if l.next == nil {
+		return context.Background(), release, nil
+	}
+
+	ctx, unlock, err := l.next.LockZone(host, account, zone)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			unlock()
+			release()
+		})
+	}, nil
+}
+
+// leaseLocker locks zones across replicas of the webhook with a coordination.k8s.io Lease for each (host, account,
+// zone), renewed while it's held. A Lease that's gone unrenewed for its duration was left by a replica that died
+// and is taken over. If Leases can't be used at all (e.g. the webhook isn't allowed to) it leaves locking to each
+// replica's localLocker for a while, trying Leases again after longer and longer. It's only used behind a
+// localLocker, so never waits on a Lease it holds itself.
+type leaseLocker struct {
+	client    kubernetes.Interface
+	namespace string
+	identity  string
+
+	// How long a Lease lasts without renewal, how often it's renewed, how often a held Lease is checked while
+	// waiting for it, and how long to wait in total
+	leaseDuration  time.Duration
+	renewInterval  time.Duration
+	retryInterval  time.Duration
+	acquireTimeout time.Duration
+
+	// How long to lock within the replica only once Leases can't be used, doubling up to the maximum each time
+	// they still can't be
+	fallbackRetry    time.Duration
+	maxFallbackRetry time.Duration
+
+	now func() time.Time
+
+	mutex           sync.Mutex
+	fallbackUntil   time.Time
+	fallbackBackoff time.Duration
+}
+
+func newLeaseLocker(client kubernetes.Interface, namespace string) *leaseLocker {
+	return &leaseLocker{
+		client:           client,
+		namespace:        namespace,
+		identity:         lockIdentity(),
+		leaseDuration:    15 * time.Second,
+		renewInterval:    5 * time.Second,
+		retryInterval:    time.Second,
+		acquireTimeout:   time.Minute,
+		fallbackRetry:    30 * time.Second,
+		maxFallbackRetry: 10 * time.Minute,
+		now:              time.Now,
+	}
+}
+
+// newZoneLocker creates the locker given by the ZONE_LOCKS setting, always locking within the replica.
+func newZoneLocker(mode string, client kubernetes.Interface) (cpanel.ZoneLocker, error) {
+	switch mode {
+	case "", zoneLocksLease:
+		return &localLocker{next: newLeaseLocker(client, podNamespace)}, nil
+	case zoneLocksLocal:
+		return &localLocker{}, nil
+	}
+	return nil, fmt.Errorf("unknown %s %q, expected %s or %s", zoneLocksEnv, mode, zoneLocksLease, zoneLocksLocal)
+}
+
+// The pod's name along with something random, so that a restarted pod doesn't think it holds its old Leases.
+func lockIdentity() string {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "cpanel-webhook"
+	}
+	random := make([]byte, 4)
+	_, _ = rand.Read(random)
+	return name + "_" + hex.EncodeToString(random)
+}
+
+func (l *leaseLocker) LockZone(host string, account string, zone string) (context.Context, func(), error) {
+	if l.isFallingBack() {
+		return context.Background(), func() {}, nil
+	}
+
+	name := zoneLeasePrefix + cpanel.HashValue(host + "|" + account + "|" + zone)[:16]
+	annotations := map[string]string{
+		zoneLeaseHostAnnotation:    host,
+		zoneLeaseAccountAnnotation: account,
+		zoneLeaseZoneAnnotation:    zone,
+	}
+
+	deadline := l.now().Add(l.acquireTimeout)
+	for {
+		acquired, err := l.tryAcquire(name, annotations)
+		if err != nil {
+			if l.fallBackOn(err) {
+				return context.Background(), func() {}, nil
+			}
+			return nil, nil, err
+		}
+		l.recover()
+		if acquired {
+			log.Debugf("Locked zone %s with Lease %s", zone, name)
+			ctx, unlock := l.startRenewing(name, zone)
+			return ctx, unlock, nil
+		}
+		if l.now().After(deadline) {
+			return nil, nil, fmt.Errorf("timed out after %s waiting for Lease %s held by another replica", l.acquireTimeout, name)
+		}
+		time.Sleep(l.retryInterval)
+	}
+}
+
+// Try to take the Lease, creating it if needed, returning whether it's now held.
+func (l *leaseLocker) tryAcquire(name string, annotations map[string]string) (bool, error) {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(l.now())
+	duration := int32(l.leaseDuration / time.Second)
+
+	lease, err := leases.Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   l.namespace,
+				Annotations: annotations,
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = leases.Create(context.Background(), lease, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != "" && *holder != l.identity {
+		if !l.expired(lease) {
+			return false, nil
+		}
+		log.Warnf("Taking over Lease %s from %s, which hasn't renewed it since %s", name, *holder, lease.Spec.RenewTime)
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+	}
+
+	lease.Spec.HolderIdentity = &l.identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(context.Background(), lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *leaseLocker) expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return l.now().After(expiry)
+}
+
+// Renew the Lease until the returned function is called, which then releases it. The returned context is cancelled
+// if the Lease is taken by another replica, or can't be renewed before it expires, as the zone may then be changed
+// by another replica.
+func (l *leaseLocker) startRenewing(name string, zone string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.renewInterval)
+		defer ticker.Stop()
+		renewed := l.now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := l.update(name, func(lease *coordinationv1.Lease) {
+					now := metav1.NewMicroTime(l.now())
+					lease.Spec.RenewTime = &now
+				})
+				if err == nil {
+					renewed = l.now()
+					continue
+				}
+				log.Errorf("Could not renew Lease %s for zone %s: %s", name, zone, err)
+				if errors.Is(err, errLeaseLost) {
+					cancel(fmt.Errorf("lease %s is %w", name, errLeaseLost))
+					return
+				}
+				if l.now().Sub(renewed) >= l.leaseDuration {
+					cancel(fmt.Errorf("lease %s expired before it could be renewed: %w", name, err))
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+			lost := errors.Is(context.Cause(ctx), errLeaseLost)
+			cancel(nil)
+			if lost {
+				return
+			}
+			err := l.update(name, func(lease *coordinationv1.Lease) {
+				lease.Spec.HolderIdentity = nil
+				lease.Spec.AcquireTime = nil
+				lease.Spec.RenewTime = nil
+			})
+			if err != nil {
+				// It'll be taken over once it expires
+				log.Errorf("Could not release Lease %s for zone %s: %s", name, zone, err)
+				return
+			}
+			log.Debugf("Unlocked zone %s", zone)
+		})
+	}
+}
+
+// Change the Lease if it's still held by us.
+func (l *leaseLocker) update(name string, mutate func(lease *coordinationv1.Lease)) error {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		return errLeaseLost
+	}
+	mutate(lease)
+	_, err = leases.Update(context.Background(), lease, metav1.UpdateOptions{})
+	return err
+}
+
+func (l *leaseLocker) isFallingBack() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.now().Before(l.fallbackUntil)
+}
+
+// Lock within the replica only for a while if Leases can't be used at all (e.g. the Role doesn't allow them),
+// rather than failing every challenge until it's fixed. Each time they still can't be it's for twice as long.
+func (l *leaseLocker) fallBackOn(err error) bool {
+	if !apierrors.IsForbidden(err) && !apierrors.IsNotFound(err) && !apierrors.IsMethodNotSupported(err) {
+		return false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.fallbackBackoff == 0 {
+		l.fallbackBackoff = l.fallbackRetry
+	} else {
+		l.fallbackBackoff = min(2*l.fallbackBackoff, l.maxFallbackRetry)
+	}
+	l.fallbackUntil = l.now().Add(l.fallbackBackoff)
+	zoneLocksFallback.Set(1)
+	log.Warnf("Can't use Leases to lock zones, locking them within this replica only for %s: %s", l.fallbackBackoff, err)
+	return true
+}
+
+// Leases can be used again, so stop falling back.
+func (l *leaseLocker) recover() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.fallbackBackoff == 0 {
+		return
+	}
+	l.fallbackBackoff = 0
+	zoneLocksFallback.Set(0)
+	log.Infof("Leases can be used to lock zones again")
+}
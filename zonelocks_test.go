@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func newTestLeaseLocker(client kubernetes.Interface, identity string) *leaseLocker {
+	locker := newLeaseLocker(client, "cert-manager")
+	locker.identity = identity
+	locker.renewInterval = time.Hour
+	locker.retryInterval = 10 * time.Millisecond
+	locker.acquireTimeout = 50 * time.Millisecond
+	return locker
+}
+
+func getTestLease(t *testing.T, client kubernetes.Interface) *coordinationv1.Lease {
+	leases, err := client.CoordinationV1().Leases("cert-manager").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, leases.Items, 1)
+	return &leases.Items[0]
+}
+
+func TestLeaseLockerExcludesOtherReplicas(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	first := newTestLeaseLocker(client, "first")
+	second := newTestLeaseLocker(client, "second")
+
+	_, unlock, err := first.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+	assert.NoError(t, err)
+	lease := getTestLease(t, client)
+	assert.Equal(t, "first", *lease.Spec.HolderIdentity)
+	assert.Equal(t, map[string]string{
+		"cpanel-webhook/host":    "cpanel.test-domain.com",
+		"cpanel-webhook/account": "user",
+		"cpanel-webhook/zone":    "test-domain.com",
+	}, lease.Annotations)
+
+	_, _, err = second.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+	assert.ErrorContains(t, err, "timed out after 50ms waiting for Lease")
+
+	// Other zones and accounts have their own Leases
+	_, unlockOther, err := second.LockZone("cpanel.test-domain.com", "other-user", "test-domain.com")
+	assert.NoError(t, err)
+	unlockOther()
+
+	unlock()
+	_, unlock, err = second.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+	assert.NoError(t, err)
+	unlock()
+}
+
+func TestLeaseLockerTakesOverStaleLease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	crashed := newTestLeaseLocker(client, "crashed")
+	_, _, err := crashed.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+	assert.NoError(t, err)
+
+	later := newTestLeaseLocker(client, "later")
+	later.now = func() time.Time { return time.Now().Add(time.Minute) }
+	_, unlock, err := later.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+	assert.NoError(t, err)
+	lease := getTestLease(t, client)
+	assert.Equal(t, "later", *lease.Spec.HolderIdentity)
+	assert.Equal(t, int32(1), *lease.Spec.LeaseTransitions)
+
+	unlock()
+	assert.Nil(t, getTestLease(t, client).Spec.HolderIdentity)
+}
+
+func TestLeaseLockerRenews(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	locker := newTestLeaseLocker(client, "renewing")
+	locker.renewInterval = 10 * time.Millisecond
+
+	_, unlock, err := locker.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+	assert.NoError(t, err)
+	acquired := getTestLease(t, client).Spec.AcquireTime.Time
+	assert.Eventually(t, func() bool {
+		return getTestLease(t, client).Spec.RenewTime.After(acquired)
+	}, time.Second, 10*time.Millisecond)
+	unlock()
+}
+
+func TestLeaseLockerAbandonsLostLease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	locker := newTestLeaseLocker(client, "slow")
+	locker.renewInterval = 10 * time.Millisecond
+
+	ctx, unlock, err := locker.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+	assert.NoError(t, err)
+	defer unlock()
+
+	// Taken over by another replica, e.g. after a long pause, the change can't go ahead
+	lease := getTestLease(t, client)
+	other := "other"
+	lease.Spec.HolderIdentity = &other
+	_, err = client.CoordinationV1().Leases("cert-manager").Update(context.Background(), lease, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	select {
+	case <-ctx.Done():
+		assert.ErrorIs(t, context.Cause(ctx), errLeaseLost)
+	case <-time.After(5 * time.Second):
+		t.Fatal("context wasn't cancelled once the Lease was lost")
+	}
+
+	// Nor is the other replica's Lease released
+	unlock()
+	assert.Equal(t, "other", *getTestLease(t, client).Spec.HolderIdentity)
+}
+
+func TestLocalLockerLocksEachZone(t *testing.T) {
+	locker := &localLocker{}
+	_, unlock, err := locker.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+	assert.NoError(t, err)
+
+	// Another zone needn't wait
+	_, unlockOther, err := locker.LockZone("cpanel.test-domain.com", "user", "other-domain.com")
+	assert.NoError(t, err)
+	unlockOther()
+
+	// The same zone does, until it's unlocked
+	locked := make(chan struct{})
+	go func() {
+		_, unlock, _ := locker.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+		close(locked)
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("zone was locked twice at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("zone wasn't locked once unlocked")
+	}
+	assert.Eventually(t, func() bool {
+		locker.mutex.Lock()
+		defer locker.mutex.Unlock()
+		return len(locker.zones) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestLeaseLockerFallsBack(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	forbidden := true
+	client.PrependReactor("get", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !forbidden {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, "", nil)
+	})
+	locker := newTestLeaseLocker(client, "forbidden")
+	now := time.Now()
+	locker.now = func() time.Time { return now }
+
+	lock := func() {
+		_, unlock, err := locker.LockZone("cpanel.test-domain.com", "user", "test-domain.com")
+		assert.NoError(t, err)
+		unlock()
+	}
+	fallback := func() float64 {
+		value, err := testutil.GetGaugeMetricValue(zoneLocksFallback)
+		assert.NoError(t, err)
+		return value
+	}
+
+	// Leases aren't tried again until the backoff is up
+	lock()
+	lock()
+	assert.Len(t, client.Actions(), 1)
+	assert.Equal(t, float64(1), fallback())
+
+	// Then for twice as long each time they still can't be used, up to the maximum
+	now = now.Add(30 * time.Second)
+	lock()
+	assert.Len(t, client.Actions(), 2)
+	assert.Equal(t, time.Minute, locker.fallbackBackoff)
+	locker.fallbackBackoff = 8 * time.Minute
+	now = now.Add(time.Minute)
+	lock()
+	assert.Equal(t, 10*time.Minute, locker.fallbackBackoff)
+
+	// Until they can be again
+	forbidden = false
+	now = now.Add(10 * time.Minute)
+	lock()
+	assert.Equal(t, time.Duration(0), locker.fallbackBackoff)
+	assert.Equal(t, float64(0), fallback())
+	getTestLease(t, client)
+}
+
+func TestNewZoneLocker(t *testing.T) {
+	locker, err := newZoneLocker("", fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	assert.IsType(t, &leaseLocker{}, locker.(*localLocker).next)
+
+	locker, err = newZoneLocker("local", fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	assert.Nil(t, locker.(*localLocker).next)
+
+	_, err = newZoneLocker("redis", fake.NewSimpleClientset())
+	assert.EqualError(t, err, `unknown ZONE_LOCKS "redis", expected lease or local`)
+}